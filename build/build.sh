@@ -13,9 +13,11 @@ if [ -z "${VERSION}" ]; then
     exit 1
 fi
 
+DRIVER_NAME="${DRIVER_NAME:-kvm}"
+
 export CGO_ENABLED=1
 
 go install                                                         \
-    -ldflags "-X ${PKG}/pkg/version.VERSION=${VERSION}"            \
+    -ldflags "-X ${PKG}/pkg/version.VERSION=${VERSION} -X ${PKG}/pkg/kvm.Name=${DRIVER_NAME}" \
     -tags libvirt.1.2.14					   \
     ./...
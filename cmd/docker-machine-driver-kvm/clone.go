@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// engineCerts are the docker engine certificates docker-machine keeps in
+// the machine directory
+var engineCerts = []string{"ca.pem", "cert.pem", "key.pem", "server.pem", "server-key.pem"}
+
+// cloneMachine implements `clone MACHINE NAME [--linked]`
+func cloneMachine(args []string) error {
+	linked := len(args) == 3 && args[2] == "--linked"
+	if len(args) != 2 && !linked {
+		return errors.New("usage: docker-machine-driver-kvm clone MACHINE NAME [--linked]")
+	}
+	src, name := args[0], args[1]
+	if _, err := os.Stat(filepath.Dir(machineConfigPath(name))); err == nil {
+		return errors.Errorf("Machine %s already exists", name)
+	}
+
+	d, err := loadDriver(src)
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	c, err := d.Clone(name, linked)
+	if c == nil {
+		return err
+	}
+	// A clone whose key rotation failed runs and is still registered, for
+	// docker-machine to manage it
+	if regErr := registerClone(src, name, c); regErr != nil {
+		return regErr
+	}
+	if linked {
+		if saveErr := saveDriver(src, d); saveErr != nil {
+			return saveErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Cloned %s as %s, run 'docker-machine regenerate-certs %s' for its engine certificates to match its IP\n", src, name, name)
+	return nil
+}
+
+// registerClone writes the config.json of the clone from the one of src,
+// pointing its paths at the clone directory, and copies the engine
+// certificates
+func registerClone(src, name string, c *kvm.Driver) error {
+	data, err := ioutil.ReadFile(machineConfigPath(src))
+	if err != nil {
+		return errors.Wrapf(err, "reading config of machine %s", src)
+	}
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(data, &config); err != nil {
+		return errors.Wrapf(err, "parsing config of machine %s", src)
+	}
+	if config["Driver"], err = json.Marshal(c); err != nil {
+		return errors.Wrap(err, "encoding driver config")
+	}
+	if config["Name"], err = json.Marshal(name); err != nil {
+		return errors.Wrap(err, "encoding machine name")
+	}
+	from, to := filepath.Dir(machineConfigPath(src)), filepath.Dir(machineConfigPath(name))
+	for _, sep := range []string{"/", `"`} {
+		config["HostOptions"] = bytes.Replace(config["HostOptions"], []byte(from+sep), []byte(to+sep), -1)
+	}
+	if data, err = json.MarshalIndent(config, "", "    "); err != nil {
+		return errors.Wrap(err, "encoding machine config")
+	}
+
+	for _, cert := range engineCerts {
+		if err := mcnutils.CopyFile(filepath.Join(from, cert), filepath.Join(to, cert)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "copying %s", cert)
+		}
+	}
+	return ioutil.WriteFile(machineConfigPath(name), data, 0600)
+}
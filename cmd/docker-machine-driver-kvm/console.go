@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// attachConsole implements `console MACHINE [--force]`
+func attachConsole(args []string) error {
+	force := len(args) == 2 && args[1] == "--force"
+	if len(args) != 1 && !force {
+		return errors.New("usage: docker-machine-driver-kvm console MACHINE [--force]")
+	}
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		// Keys go to the guest as typed, Ctrl-C included
+		old, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return errors.Wrap(err, "setting terminal to raw mode")
+		}
+		defer terminal.Restore(fd, old)
+	}
+	fmt.Fprintf(os.Stderr, "Connected to the console of %s, escape character is ^]\r\n", args[0])
+	return d.Console(os.Stdin, os.Stdout, force)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// setCPUs implements `set-cpus MACHINE COUNT`
+func setCPUs(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: docker-machine-driver-kvm set-cpus MACHINE COUNT")
+	}
+	cpus, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errors.Wrapf(err, "parsing vCPU count %s", args[1])
+	}
+
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	if err := d.SetCPUCount(cpus); err != nil {
+		return err
+	}
+	return saveDriver(args[0], d)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// dryRun implements `dry-run MACHINE [--kvm-FLAG=VALUE...]`, printing the
+// xml a create with those flags would define
+func dryRun(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: docker-machine-driver-kvm dry-run MACHINE [--kvm-FLAG=VALUE...]")
+	}
+
+	d := kvm.NewDriver(args[0], storePath())
+	opts, err := parseFlags(d.GetCreateFlags(), args[1:])
+	if err != nil {
+		return err
+	}
+	if err := d.SetConfigFromFlags(opts); err != nil {
+		return err
+	}
+	return d.DryRun(os.Stdout)
+}
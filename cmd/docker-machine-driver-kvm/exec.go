@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// execTimeout bounds the commands exec runs
+const execTimeout = 5 * time.Minute
+
+// execInMachine implements `exec MACHINE COMMAND [ARG...]`, running the
+// command through the guest agent and exiting with its status. Piped input
+// is passed to the command.
+func execInMachine(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: docker-machine-driver-kvm exec MACHINE COMMAND [ARG...]")
+	}
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+
+	var stdin []byte
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		if stdin, err = ioutil.ReadAll(os.Stdin); err != nil {
+			return errors.Wrap(err, "reading input")
+		}
+	}
+	result, err := d.Exec(args[1:], stdin, execTimeout)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(result.Stdout)
+	os.Stderr.Write(result.Stderr)
+	switch {
+	case result.Signal != 0:
+		return errors.Errorf("%s killed by signal %d", args[1], result.Signal)
+	case result.ExitCode != 0:
+		kvm.CloseConnections()
+		os.Exit(result.ExitCode)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// exportMachine implements `export MACHINE FILE`
+func exportMachine(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: docker-machine-driver-kvm export MACHINE FILE")
+	}
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+
+	f, err := os.Create(args[1])
+	if err != nil {
+		return errors.Wrap(err, "creating export file")
+	}
+	if err := d.Export(f); err != nil {
+		f.Close()
+		os.Remove(args[1])
+		return err
+	}
+	return f.Close()
+}
+
+// importMachine implements `import FILE`, unpacking an export into the
+// store and recreating the machine on this host
+func importMachine(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: docker-machine-driver-kvm import FILE")
+	}
+	name, err := unpackExport(args[0])
+	if err != nil {
+		return err
+	}
+	if err := relocateConfig(name); err != nil {
+		return err
+	}
+
+	d, err := loadDriver(name)
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	if err := d.Import(); err != nil {
+		return err
+	}
+	return saveDriver(name, d)
+}
+
+// unpackExport extracts the export into the machines directory of the
+// store, returning the machine name. An existing machine is never
+// overwritten.
+func unpackExport(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "opening export")
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", errors.Wrap(err, "reading export")
+	}
+	tr := tar.NewReader(gz)
+
+	machines := filepath.Join(storePath(), "machines")
+	name := ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "reading export")
+		}
+		rel := filepath.Clean(hdr.Name)
+		parts := strings.SplitN(rel, string(filepath.Separator), 2)
+		if len(parts) != 2 || strings.HasPrefix(rel, "..") || filepath.IsAbs(rel) {
+			return "", errors.Errorf("Unexpected file %s in export", hdr.Name)
+		}
+		if name == "" {
+			name = parts[0]
+			if _, err := os.Stat(filepath.Join(machines, name)); err == nil {
+				return "", errors.Errorf("Machine %s already exists", name)
+			}
+		} else if parts[0] != name {
+			return "", errors.Errorf("Unexpected file %s in export of machine %s", hdr.Name, name)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		dst := filepath.Join(machines, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return "", errors.Wrap(err, "creating machine directory")
+		}
+		out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return "", errors.Wrapf(err, "creating %s", dst)
+		}
+		_, err = io.Copy(out, tr)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "extracting %s", dst)
+		}
+	}
+	if name == "" {
+		return "", errors.New("The export is empty")
+	}
+	return name, nil
+}
+
+// relocateConfig rewrites the paths of the source host store in the
+// machine config.json to this store
+func relocateConfig(name string) error {
+	path := machineConfigPath(name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "reading config of machine %s", name)
+	}
+	var config struct {
+		Driver struct {
+			StorePath string
+		}
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return errors.Wrapf(err, "parsing config of machine %s", name)
+	}
+	if from := config.Driver.StorePath; from != "" && from != storePath() {
+		// Only whole path prefixes, followed by a separator or the
+		// closing quote of the JSON string
+		for _, sep := range []string{"/", `"`} {
+			data = bytes.Replace(data, []byte(from+sep), []byte(storePath()+sep), -1)
+		}
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/pkg/errors"
+)
+
+// flagOptions are driver options parsed from --kvm-* command line flags, in
+// place of the ones docker-machine would pass over the plugin protocol
+type flagOptions map[string]interface{}
+
+// parseFlags reads args against the driver create flags, starting from
+// their defaults and environment variables
+func parseFlags(flags []mcnflag.Flag, args []string) (flagOptions, error) {
+	opts := flagOptions{}
+	known := map[string]mcnflag.Flag{}
+	for _, f := range flags {
+		known[f.String()] = f
+		opts[f.String()] = f.Default()
+		switch f := f.(type) {
+		case mcnflag.StringFlag:
+			if v := os.Getenv(f.EnvVar); f.EnvVar != "" && v != "" {
+				opts[f.Name] = v
+			}
+		case mcnflag.IntFlag:
+			if v, err := strconv.Atoi(os.Getenv(f.EnvVar)); f.EnvVar != "" && err == nil {
+				opts[f.Name] = v
+			}
+		case mcnflag.BoolFlag:
+			if f.EnvVar != "" && os.Getenv(f.EnvVar) != "" {
+				opts[f.Name] = true
+			}
+		}
+	}
+	// Slices given on the command line replace their defaults
+	seen := map[string]bool{}
+
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimPrefix(args[i], "--")
+		if name == args[i] {
+			return nil, errors.Errorf("Unexpected argument %s", args[i])
+		}
+		value, hasValue := "", false
+		if j := strings.Index(name, "="); j != -1 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+		f, ok := known[name]
+		if !ok {
+			return nil, errors.Errorf("Unknown flag --%s", name)
+		}
+		if _, isBool := f.(mcnflag.BoolFlag); isBool {
+			opts[name] = !hasValue || value == "true"
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				return nil, errors.Errorf("Flag --%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		switch f.(type) {
+		case mcnflag.IntFlag:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing --%s", name)
+			}
+			opts[name] = n
+		case mcnflag.StringSliceFlag:
+			if !seen[name] {
+				opts[name] = []string(nil)
+				seen[name] = true
+			}
+			opts[name] = append(opts[name].([]string), value)
+		default:
+			opts[name] = value
+		}
+	}
+	return opts, nil
+}
+
+func (o flagOptions) String(key string) string {
+	v, _ := o[key].(string)
+	return v
+}
+
+func (o flagOptions) StringSlice(key string) []string {
+	v, _ := o[key].([]string)
+	return v
+}
+
+func (o flagOptions) Int(key string) int {
+	v, _ := o[key].(int)
+	return v
+}
+
+func (o flagOptions) Bool(key string) bool {
+	v, _ := o[key].(bool)
+	return v
+}
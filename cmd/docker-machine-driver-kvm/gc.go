@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+const gcUsage = "usage: docker-machine-driver-kvm gc [--dry-run] [--kvm-connection-uri=URI]"
+
+// collectGarbage implements `gc`, removing the libvirt resources of
+// machines that are no longer in the docker-machine store
+func collectGarbage(args []string) error {
+	dryRun := false
+	uri := os.Getenv("KVM_CONNECTION_URI")
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--dry-run":
+			dryRun = true
+		case strings.HasPrefix(arg, "--kvm-connection-uri="):
+			uri = strings.TrimPrefix(arg, "--kvm-connection-uri=")
+		case arg == "--kvm-connection-uri" && i+1 < len(args):
+			i++
+			uri = args[i]
+		default:
+			return errors.New(gcUsage)
+		}
+	}
+
+	machines, err := storeMachines()
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	return kvm.CollectGarbage(uri, storePath(), machines, dryRun)
+}
+
+// storeMachines lists the machines of the store, whatever their driver
+func storeMachines() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(storePath(), "machines"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "listing machines")
+	}
+	var machines []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			machines = append(machines, entry.Name())
+		}
+	}
+	return machines, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// machineHealth implements `health MACHINE`, failing unless the machine
+// runs and its guest agent answers
+func machineHealth(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: docker-machine-driver-kvm health MACHINE")
+	}
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	h, err := d.Health()
+	if err != nil {
+		return err
+	}
+	if !h.Agent {
+		return errors.Errorf("Machine %s is %s, its guest agent doesn't answer", args[0], h.State)
+	}
+	fmt.Printf("Machine %s is %s, its guest agent answers\n", args[0], h.State)
+	if h.Hostname != "" {
+		fmt.Printf("Hostname: %s\n", h.Hostname)
+	}
+	if h.OS != "" {
+		fmt.Printf("OS: %s, kernel %s\n", h.OS, h.KernelRelease)
+	}
+	return nil
+}
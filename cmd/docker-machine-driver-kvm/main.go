@@ -8,10 +8,53 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/docker/machine/libmachine/drivers/plugin"
 	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
 )
 
+// commands are maintenance verbs run directly against a machine, outside
+// of the docker-machine plugin protocol
+var commands = map[string]func(args []string) error{
+	"resize-disk":   resizeDisk,
+	"pause":         pauseMachine,
+	"resume":        resumeMachine,
+	"set-cpus":      setCPUs,
+	"upgrade":       upgradeMachine,
+	"dry-run":       dryRun,
+	"gc":            collectGarbage,
+	"export":        exportMachine,
+	"import":        importMachine,
+	"clone":         cloneMachine,
+	"migrate":       migrateMachine,
+	"console":       attachConsole,
+	"stats":         machineStats,
+	"serve-metrics": serveMetrics,
+	"health":        machineHealth,
+	"exec":          execInMachine,
+	"status":        machineStatus,
+	"supervise":     supervise,
+	"recover":       recoverMachine,
+	"redefine":      redefineMachine,
+}
+
 func main() {
+	if !kvm.IsDriverName(kvm.Name) {
+		fmt.Fprintf(os.Stderr, "Unsupported driver name %s\n", kvm.Name)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	plugin.RegisterDriver(kvm.NewDriver("", ""))
 }
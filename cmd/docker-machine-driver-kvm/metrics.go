@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+const (
+	serveMetricsUsage = "usage: docker-machine-driver-kvm serve-metrics [--listen=ADDR]"
+	// defaultMetricsAddr is where serve-metrics listens by default. The
+	// machine names and usage are only served locally unless --listen says so.
+	defaultMetricsAddr = "127.0.0.1:9477"
+)
+
+// serveMetrics implements `serve-metrics`, serving the statistics of the
+// kvm machines of the store on /metrics until it is killed
+func serveMetrics(args []string) error {
+	addr := defaultMetricsAddr
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case strings.HasPrefix(arg, "--listen="):
+			addr = strings.TrimPrefix(arg, "--listen=")
+		case arg == "--listen" && i+1 < len(args):
+			i++
+			addr = args[i]
+		default:
+			return errors.New(serveMetricsUsage)
+		}
+	}
+	defer kvm.CloseConnections()
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		// The store is read on every scrape, for machines created since
+		machines, err := kvmMachines()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		if err := kvm.WriteMetrics(&buf, machines); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+	log.Infof("Serving metrics on %s/metrics", addr)
+	return http.ListenAndServe(addr, nil)
+}
+
+// kvmMachines loads the drivers of the kvm machines of the store
+func kvmMachines() ([]*kvm.Driver, error) {
+	names, err := storeMachines()
+	if err != nil {
+		return nil, err
+	}
+	var machines []*kvm.Driver
+	for _, name := range names {
+		d, err := loadDriver(name)
+		if err != nil {
+			log.Debugf("Skipping machine %s: %v", name, err)
+			continue
+		}
+		machines = append(machines, d)
+	}
+	return machines, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// migrateMachine implements `migrate MACHINE URI [--copy-storage]`
+func migrateMachine(args []string) error {
+	copyStorage := len(args) == 3 && args[2] == "--copy-storage"
+	if len(args) != 2 && !copyStorage {
+		return errors.New("usage: docker-machine-driver-kvm migrate MACHINE URI [--copy-storage]")
+	}
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	if err := d.Migrate(args[1], copyStorage); err != nil {
+		return err
+	}
+	return saveDriver(args[0], d)
+}
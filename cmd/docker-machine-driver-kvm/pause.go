@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// pauseMachine implements `pause MACHINE`
+func pauseMachine(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: docker-machine-driver-kvm pause MACHINE")
+	}
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	return d.Suspend()
+}
+
+// resumeMachine implements `resume MACHINE`
+func resumeMachine(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: docker-machine-driver-kvm resume MACHINE")
+	}
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	return d.Resume()
+}
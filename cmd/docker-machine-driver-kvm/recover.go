@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+const recoverUsage = "usage: docker-machine-driver-kvm recover MACHINE [--kvm-connection-uri=URI]"
+
+// recoverMachine implements `recover MACHINE`, recreating the store entry
+// of a machine from the configuration its domain carries
+func recoverMachine(args []string) error {
+	if len(args) == 0 {
+		return errors.New(recoverUsage)
+	}
+	name := args[0]
+	uri := os.Getenv("KVM_CONNECTION_URI")
+	for i := 1; i < len(args); i++ {
+		switch arg := args[i]; {
+		case strings.HasPrefix(arg, "--kvm-connection-uri="):
+			uri = strings.TrimPrefix(arg, "--kvm-connection-uri=")
+		case arg == "--kvm-connection-uri" && i+1 < len(args):
+			i++
+			uri = args[i]
+		default:
+			return errors.New(recoverUsage)
+		}
+	}
+	if _, err := os.Stat(machineConfigPath(name)); err == nil {
+		return errors.Errorf("Machine %s already exists", name)
+	}
+
+	d, err := kvm.RecoverDriver(uri, storePath(), name)
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	if err := os.MkdirAll(filepath.Dir(machineConfigPath(name)), 0755); err != nil {
+		return errors.Wrap(err, "creating machine directory")
+	}
+	data, err := json.MarshalIndent(machineConfig(name, d), "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "encoding machine config")
+	}
+	if err := ioutil.WriteFile(machineConfigPath(name), data, 0600); err != nil {
+		return errors.Wrap(err, "writing machine config")
+	}
+	// The machine may have been created in a store elsewhere
+	if err := relocateConfig(name); err != nil {
+		return err
+	}
+
+	if d, err = loadDriver(name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(d.GetSSHKeyPath()); err != nil {
+		log.Warnf("The SSH key %s of the machine is gone, docker-machine can't reach it", d.GetSSHKeyPath())
+	}
+	fmt.Printf("Recovered %s, run 'docker-machine regenerate-certs %s' for new engine certificates\n", name, name)
+	return nil
+}
+
+// machineConfig is the docker-machine config.json of a machine with the
+// default engine options and the certificates of the store
+func machineConfig(name string, d *kvm.Driver) map[string]interface{} {
+	certs := filepath.Join(storePath(), "certs")
+	dir := filepath.Dir(machineConfigPath(name))
+	return map[string]interface{}{
+		"ConfigVersion": 3,
+		"Driver":        d,
+		"DriverName":    kvm.Name,
+		"HostOptions": map[string]interface{}{
+			"Driver": "",
+			"Memory": 0,
+			"Disk":   0,
+			"EngineOptions": map[string]interface{}{
+				"ArbitraryFlags":   []string{},
+				"Env":              []string{},
+				"InsecureRegistry": []string{},
+				"Labels":           []string{},
+				"RegistryMirror":   []string{},
+				"StorageDriver":    "",
+				"TlsVerify":        true,
+				"InstallURL":       "https://get.docker.com",
+			},
+			"SwarmOptions": map[string]interface{}{
+				"IsSwarm": false,
+			},
+			"AuthOptions": map[string]interface{}{
+				"CertDir":          certs,
+				"CaCertPath":       filepath.Join(certs, "ca.pem"),
+				"CaPrivateKeyPath": filepath.Join(certs, "ca-key.pem"),
+				"ClientCertPath":   filepath.Join(certs, "cert.pem"),
+				"ClientKeyPath":    filepath.Join(certs, "key.pem"),
+				"ServerCertPath":   filepath.Join(dir, "server.pem"),
+				"ServerKeyPath":    filepath.Join(dir, "server-key.pem"),
+				"ServerCertSANs":   []string{},
+				"StorePath":        dir,
+			},
+		},
+		"Name": name,
+	}
+}
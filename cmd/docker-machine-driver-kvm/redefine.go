@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// redefineMachine implements `redefine MACHINE`
+func redefineMachine(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: docker-machine-driver-kvm redefine MACHINE")
+	}
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	return d.Redefine()
+}
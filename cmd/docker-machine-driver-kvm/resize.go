@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// resizeDisk implements `resize-disk MACHINE SIZE_MB`
+func resizeDisk(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: docker-machine-driver-kvm resize-disk MACHINE SIZE_MB")
+	}
+	size, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "parsing size %s", args[1])
+	}
+
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	if err := d.ResizeDisk(size); err != nil {
+		return err
+	}
+	return saveDriver(args[0], d)
+}
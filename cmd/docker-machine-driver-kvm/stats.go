@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// machineStats implements `stats MACHINE [--json]`
+func machineStats(args []string) error {
+	asJSON := len(args) == 2 && args[1] == "--json"
+	if len(args) != 1 && !asJSON {
+		return errors.New("usage: docker-machine-driver-kvm stats MACHINE [--json]")
+	}
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	stats, err := d.Stats()
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(stats)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "CPU time:\t%s (%d vCPUs)\n", stats.CPUTime, stats.VCPUs)
+	fmt.Fprintf(w, "Memory:\t%s, %s resident on the host\n", kib(stats.MemoryBalloon), kib(stats.MemoryRSS))
+	if stats.MemoryUnused > 0 {
+		fmt.Fprintf(w, "Memory unused:\t%s\n", kib(stats.MemoryUnused))
+	}
+	for _, disk := range stats.Disks {
+		fmt.Fprintf(w, "Disk %s:\tread %s in %d requests, written %s in %d requests, %d errors\n",
+			disk.Device, humanBytes(disk.ReadBytes), disk.ReadReqs, humanBytes(disk.WriteBytes), disk.WriteReqs, disk.Errors)
+	}
+	for _, iface := range stats.Interfaces {
+		fmt.Fprintf(w, "Interface %s (%s):\treceived %s in %d packets, sent %s in %d packets, %d drops, %d errors\n",
+			iface.Device, iface.MAC, humanBytes(iface.RxBytes), iface.RxPackets, humanBytes(iface.TxBytes), iface.TxPackets, iface.Drops, iface.Errors)
+	}
+	return w.Flush()
+}
+
+// kib formats a size in KiB
+func kib(n uint64) string {
+	return humanBytes(int64(n) << 10)
+}
+
+// humanBytes formats a size in bytes with a binary unit
+func humanBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, unit := float64(n)/1024, 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", size, units[unit])
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// machineStatus implements `status MACHINE`, with the reason of an Error
+// state that docker-machine status doesn't show
+func machineStatus(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: docker-machine-driver-kvm status MACHINE")
+	}
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	details, err := d.StatusDetails()
+	if err != nil {
+		return err
+	}
+	fmt.Println(details)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// storePath is the docker-machine store, honouring MACHINE_STORAGE_PATH
+func storePath() string {
+	if path := os.Getenv("MACHINE_STORAGE_PATH"); path != "" {
+		return path
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker", "machine")
+}
+
+func machineConfigPath(name string) string {
+	return filepath.Join(storePath(), "machines", name, "config.json")
+}
+
+// loadDriver reads the kvm driver of a machine from its config.json
+func loadDriver(name string) (*kvm.Driver, error) {
+	data, err := ioutil.ReadFile(machineConfigPath(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading config of machine %s", name)
+	}
+	var config struct {
+		DriverName string
+		Driver     *kvm.Driver
+	}
+	// Fields machines created by older releases lack keep their defaults
+	config.Driver = kvm.NewDriver(name, storePath())
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrapf(err, "parsing config of machine %s", name)
+	}
+	if !kvm.IsDriverName(config.DriverName) || config.Driver == nil {
+		return nil, errors.Errorf("Machine %s does not use the kvm driver", name)
+	}
+	return config.Driver, nil
+}
+
+// saveDriver writes the driver back to the machine config.json, keeping
+// everything else docker-machine stored there
+func saveDriver(name string, d *kvm.Driver) error {
+	path := machineConfigPath(name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "reading config of machine %s", name)
+	}
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(data, &config); err != nil {
+		return errors.Wrapf(err, "parsing config of machine %s", name)
+	}
+	if config["Driver"], err = json.Marshal(d); err != nil {
+		return errors.Wrap(err, "encoding driver config")
+	}
+	if data, err = json.MarshalIndent(config, "", "    "); err != nil {
+		return errors.Wrap(err, "encoding machine config")
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+const (
+	superviseUsage = "usage: docker-machine-driver-kvm supervise [--interval=SECONDS]"
+	// defaultSuperviseInterval is how often supervise checks the machines
+	defaultSuperviseInterval = 10 * time.Second
+)
+
+// supervise implements `supervise`, checking the state of the kvm machines
+// of the store with --kvm-auto-restart until it is killed, and starting
+// those that crashed again, unless they were stopped since
+func supervise(args []string) error {
+	interval := defaultSuperviseInterval
+	for i := 0; i < len(args); i++ {
+		value := ""
+		switch arg := args[i]; {
+		case strings.HasPrefix(arg, "--interval="):
+			value = strings.TrimPrefix(arg, "--interval=")
+		case arg == "--interval" && i+1 < len(args):
+			i++
+			value = args[i]
+		default:
+			return errors.New(superviseUsage)
+		}
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return errors.New(superviseUsage)
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+	defer kvm.CloseConnections()
+
+	log.Infof("Checking machines every %s", interval)
+	for {
+		// The store is read every time, for machines created since
+		machines, err := kvmMachines()
+		if err != nil {
+			return err
+		}
+		for _, d := range machines {
+			if !d.AutoRestart {
+				continue
+			}
+			restarted, err := d.RestartCrashed()
+			if err != nil {
+				log.Warnf("Unable to restart machine %s: %v", d.MachineName, err)
+				continue
+			}
+			if restarted {
+				// Start refreshed the IP and the port forwards
+				if err := saveDriver(d.MachineName, d); err != nil {
+					log.Warnf("Unable to save machine %s: %v", d.MachineName, err)
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	kvm "github.com/r2d4/docker-machine-driver-kvm/pkg/kvm"
+)
+
+// upgradeMachine implements `upgrade MACHINE [ISO_URL]`
+func upgradeMachine(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: docker-machine-driver-kvm upgrade MACHINE [ISO_URL]")
+	}
+	isoURL := ""
+	if len(args) == 2 {
+		isoURL = args[1]
+	}
+
+	d, err := loadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	defer kvm.CloseConnections()
+	if err := d.Upgrade(isoURL); err != nil {
+		return err
+	}
+	return saveDriver(args[0], d)
+}
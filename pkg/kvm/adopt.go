@@ -0,0 +1,139 @@
+package kvm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+// domainConfigXML is the part of the domain xml checked before adopting a
+// domain
+type domainConfigXML struct {
+	Memory struct {
+		Unit  string `xml:"unit,attr"`
+		Value uint64 `xml:",chardata"`
+	} `xml:"memory"`
+	VCPU  int `xml:"vcpu"`
+	Disks []struct {
+		Device string `xml:"device,attr"`
+		Source struct {
+			Pool   string `xml:"pool,attr"`
+			Volume string `xml:"volume,attr"`
+			Dev    string `xml:"dev,attr"`
+			Name   string `xml:"name,attr"`
+		} `xml:"source"`
+	} `xml:"devices>disk"`
+}
+
+// memoryKiB converts a libvirt memory size to KiB
+func memoryKiB(value uint64, unit string) uint64 {
+	switch unit {
+	case "b", "bytes":
+		return value / 1024
+	case "KB":
+		return value * 1000 / 1024
+	case "M", "MiB":
+		return value << 10
+	case "MB":
+		return value * 1000 * 1000 / 1024
+	case "G", "GiB":
+		return value << 20
+	case "GB":
+		return value * 1000 * 1000 * 1000 / 1024
+	}
+	return value
+}
+
+// domainMismatches lists how the domain xml differs from the machine
+// configuration
+func (d *Driver) domainMismatches(domainXML string) ([]string, error) {
+	var config domainConfigXML
+	if err := xml.Unmarshal([]byte(domainXML), &config); err != nil {
+		return nil, errors.Wrap(err, "parsing domain xml")
+	}
+
+	var mismatches []string
+	// libvirt aligns the memory size, so allow for a MiB of difference
+	have, want := memoryKiB(config.Memory.Value, config.Memory.Unit), memoryKiB(uint64(d.Memory), "MB")
+	if have+1024 < want || want+1024 < have {
+		mismatches = append(mismatches, fmt.Sprintf("memory is %d KiB, expected %d KiB", have, want))
+	}
+	if config.VCPU != d.maxCPUs() {
+		mismatches = append(mismatches, fmt.Sprintf("vcpu is %d, expected %d", config.VCPU, d.maxCPUs()))
+	}
+
+	foundDisk := false
+	for _, disk := range config.Disks {
+		if disk.Device != "disk" {
+			continue
+		}
+		switch {
+		case d.DiskDevice != "":
+			foundDisk = foundDisk || disk.Source.Dev == d.DiskDevice
+		case d.RBDPool != "":
+			foundDisk = foundDisk || disk.Source.Name == d.RBDPool+"/"+d.diskVolumeName()
+		default:
+			foundDisk = foundDisk || (disk.Source.Pool == d.storagePoolName() && disk.Source.Volume == d.diskVolumeName())
+		}
+	}
+	if !foundDisk {
+		mismatches = append(mismatches, "the machine disk is not attached")
+	}
+
+	return mismatches, nil
+}
+
+// adoptDomain takes over an existing domain of the machine name, after
+// checking that it matches the machine configuration. It returns false when
+// there is no such domain.
+func (d *Driver) adoptDomain(conn *libvirt.Connect) (bool, error) {
+	dom, err := conn.LookupDomainByName(d.MachineName)
+	if err != nil {
+		return false, nil
+	}
+	defer dom.Free()
+
+	if !d.AdoptExisting {
+		return true, fmt.Errorf("Domain %s already exists, remove it or use --kvm-adopt-existing", d.MachineName)
+	}
+
+	domainXML, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return true, errors.Wrap(err, "getting domain xml")
+	}
+	mismatches, err := d.domainMismatches(domainXML)
+	if err != nil {
+		return true, err
+	}
+	if len(mismatches) > 0 {
+		return true, fmt.Errorf("Domain %s does not match the machine configuration: %s", d.MachineName, strings.Join(mismatches, ", "))
+	}
+
+	log.Infof("Adopting existing domain %s", d.MachineName)
+	if d.Autostart {
+		if err := dom.SetAutostart(true); err != nil {
+			return true, errors.Wrap(err, "setting domain to autostart")
+		}
+	}
+	return true, nil
+}
+
+// checkAdoptedSSHKey makes sure an adopted machine has an SSH key, which
+// the guest must already accept: it doesn't get one installed
+func (d *Driver) checkAdoptedSSHKey() error {
+	switch {
+	case d.SSHAgent:
+		return nil
+	case d.SSHKeySource != "":
+		return d.importSSHKey()
+	}
+	if _, err := os.Stat(d.GetSSHKeyPath()); err != nil {
+		return fmt.Errorf("Domain %s has no machine SSH key at %s, pass the key its guest accepts with --kvm-ssh-key-source or --kvm-ssh-agent", d.MachineName, d.GetSSHKeyPath())
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package kvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+// agentCommandTimeout bounds, in seconds, a single guest agent command
+const agentCommandTimeout = 5
+
+// agentCommand runs the guest agent command execute with args, decoding
+// its return value into ret when it's not nil
+func agentCommand(dom *libvirt.Domain, execute string, args, ret interface{}) error {
+	command := map[string]interface{}{"execute": execute}
+	if args != nil {
+		command["arguments"] = args
+	}
+	data, err := json.Marshal(command)
+	if err != nil {
+		return errors.Wrapf(err, "encoding %s", execute)
+	}
+	out, err := dom.QemuAgentCommand(string(data), libvirt.DomainQemuAgentCommandTimeout(agentCommandTimeout), 0)
+	if err != nil {
+		return err
+	}
+	if ret == nil {
+		return nil
+	}
+	reply := struct {
+		Return interface{} `json:"return"`
+	}{ret}
+	if err := json.Unmarshal([]byte(out), &reply); err != nil {
+		return errors.Wrapf(err, "parsing reply to %s", execute)
+	}
+	return nil
+}
+
+// Health is what the machine reports about itself
+type Health struct {
+	State state.State
+	// Agent is whether the qemu guest agent answers, the other fields are
+	// only set when it does
+	Agent         bool
+	Hostname      string `json:",omitempty"`
+	OS            string `json:",omitempty"`
+	KernelRelease string `json:",omitempty"`
+}
+
+// guestOSInfo is the reply to guest-get-osinfo
+type guestOSInfo struct {
+	PrettyName    string `json:"pretty-name"`
+	Name          string `json:"name"`
+	Version       string `json:"version"`
+	KernelRelease string `json:"kernel-release"`
+}
+
+// Health pings the guest agent of the machine and asks it about the guest.
+// A machine without a running agent is not an error, Agent is false.
+func (d *Driver) Health() (*Health, error) {
+	s, err := d.GetState()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting state of VM")
+	}
+	h := &Health{State: s}
+	if s != state.Running {
+		return h, nil
+	}
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting domain")
+	}
+	defer closeDomain(dom, conn)
+
+	if err := agentCommand(dom, "guest-ping", nil, nil); err != nil {
+		return h, nil
+	}
+	h.Agent = true
+	// Older agents lack these commands, they only leave the fields empty
+	var host struct {
+		HostName string `json:"host-name"`
+	}
+	if err := agentCommand(dom, "guest-get-host-name", nil, &host); err == nil {
+		h.Hostname = host.HostName
+	}
+	var info guestOSInfo
+	if err := agentCommand(dom, "guest-get-osinfo", nil, &info); err == nil {
+		h.OS = info.PrettyName
+		if h.OS == "" {
+			h.OS = fmt.Sprintf("%s %s", info.Name, info.Version)
+		}
+		h.KernelRelease = info.KernelRelease
+	}
+	return h, nil
+}
+
+// waitForAgent pings the guest agent until it answers, timeout elapses or
+// the machine stops running
+func (d *Driver) waitForAgent(timeout time.Duration) error {
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return errors.Wrap(err, "getting domain")
+	}
+	defer closeDomain(dom, conn)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := agentCommand(dom, "guest-ping", nil, nil)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return d.waitError(fmt.Sprintf("Guest agent not available after %s", timeout), err)
+		}
+		if s, serr := d.GetState(); serr == nil && (s == state.Stopped || s == state.Error) {
+			return d.waitError("Machine stopped while waiting for the guest agent", err)
+		}
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// ExecResult is the outcome of a command run by the guest agent
+type ExecResult struct {
+	// ExitCode is the exit status of the command, or -1 when a signal
+	// killed it
+	ExitCode int
+	Signal   int
+	Stdout   []byte
+	Stderr   []byte
+}
+
+// guestExecStatus is the reply to guest-exec-status
+type guestExecStatus struct {
+	Exited   bool   `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	Signal   int    `json:"signal"`
+	OutData  []byte `json:"out-data"`
+	ErrData  []byte `json:"err-data"`
+	OutTrunc bool   `json:"out-truncated"`
+	ErrTrunc bool   `json:"err-truncated"`
+}
+
+// Exec runs argv in the guest through the guest agent, feeding it stdin,
+// and waits up to timeout for it to exit. It needs no network in the guest,
+// unlike SSH. The agent buffers the output, which it truncates past a few
+// MiB.
+func (d *Driver) Exec(argv []string, stdin []byte, timeout time.Duration) (*ExecResult, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("No command to run")
+	}
+	s, err := d.GetState()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting state of VM")
+	}
+	if s != state.Running {
+		return nil, errors.Errorf("Machine %s is %s, start it to run commands", d.MachineName, s)
+	}
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting domain")
+	}
+	defer closeDomain(dom, conn)
+
+	// []byte fields are base64 encoded, as the agent expects
+	args := struct {
+		Path          string   `json:"path"`
+		Arg           []string `json:"arg,omitempty"`
+		InputData     []byte   `json:"input-data,omitempty"`
+		CaptureOutput bool     `json:"capture-output"`
+	}{argv[0], argv[1:], stdin, true}
+	var started struct {
+		PID int `json:"pid"`
+	}
+	if err := agentCommand(dom, "guest-exec", args, &started); err != nil {
+		return nil, errors.Wrapf(err, "running %s through the guest agent", argv[0])
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var status guestExecStatus
+		if err := agentCommand(dom, "guest-exec-status", map[string]int{"pid": started.PID}, &status); err != nil {
+			return nil, errors.Wrapf(err, "getting status of %s", argv[0])
+		}
+		if status.Exited {
+			if status.OutTrunc || status.ErrTrunc {
+				log.Warnf("The guest agent truncated the output of %s", argv[0])
+			}
+			result := &ExecResult{ExitCode: status.ExitCode, Signal: status.Signal, Stdout: status.OutData, Stderr: status.ErrData}
+			if status.Signal != 0 {
+				result.ExitCode = -1
+			}
+			return result, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("%s didn't exit after %s, it still runs in the guest as pid %d", argv[0], timeout, started.PID)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
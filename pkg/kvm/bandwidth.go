@@ -0,0 +1,59 @@
+package kvm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// bandwidthLimit caps the traffic of an interface in one direction. Average
+// and Peak are in KiB/s, Burst in KiB.
+type bandwidthLimit struct {
+	Average, Peak, Burst int
+}
+
+// bandwidth is the QoS of the machine interfaces, from the guest point of
+// view: Inbound is what it receives and Outbound what it sends
+type bandwidth struct {
+	Inbound, Outbound *bandwidthLimit
+}
+
+// netBandwidth parses DIRECTION=AVERAGE[:PEAK[:BURST]] entries, returning
+// nil when there are none
+func netBandwidth(specs []string) (*bandwidth, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	bw := &bandwidth{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Malformed bandwidth %q, expected inbound|outbound=AVERAGE[:PEAK[:BURST]]", spec)
+		}
+		var values []int
+		for _, field := range strings.Split(parts[1], ":") {
+			value, err := strconv.Atoi(field)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("Invalid bandwidth %q, rates are KiB/s and burst KiB", spec)
+			}
+			values = append(values, value)
+		}
+		if len(values) > 3 || values[0] == 0 {
+			return nil, fmt.Errorf("Invalid bandwidth %q, expected a non-zero AVERAGE with optional PEAK and BURST", spec)
+		}
+		values = append(values, 0, 0)
+		limit := &bandwidthLimit{Average: values[0], Peak: values[1], Burst: values[2]}
+		if limit.Peak != 0 && limit.Peak < limit.Average {
+			return nil, fmt.Errorf("Invalid bandwidth %q, the peak is below the average", spec)
+		}
+		switch parts[0] {
+		case "inbound":
+			bw.Inbound = limit
+		case "outbound":
+			bw.Outbound = limit
+		default:
+			return nil, fmt.Errorf("Invalid bandwidth direction %q, must be inbound or outbound", parts[0])
+		}
+	}
+	return bw, nil
+}
@@ -0,0 +1,57 @@
+package kvm
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// diskFormat is the image format of the machine disk: qcow2 overlays when
+// cloning a base image, raw otherwise
+func (d *Driver) diskFormat() string {
+	if d.BaseImageURL != "" || d.LinkedCloneOf != "" {
+		return "qcow2"
+	}
+	return "raw"
+}
+
+// baseImageCacheDir holds the base images shared by every machine
+func (d *Driver) baseImageCacheDir() string {
+	return filepath.Join(d.StorePath, "cache", "kvm-base")
+}
+
+// cachedBaseImage returns the path of the cached copy of the base image,
+// downloading it on first use. Images are keyed by their URL, so a new image
+// version gets its own cache entry.
+func (d *Driver) cachedBaseImage() (string, error) {
+	name := fmt.Sprintf("%x.qcow2", sha256.Sum256([]byte(d.BaseImageURL)))
+	dir := d.baseImageCacheDir()
+	path := filepath.Join(dir, name)
+
+	// libvirt must be able to read the image as the qemu user
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "creating base image cache directory")
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return "", errors.Wrap(err, "locking base image cache")
+	}
+	defer unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		log.Debugf("Using cached base image %s", path)
+		return path, nil
+	}
+	if err := downloadFile(d.BaseImageURL, path); err != nil {
+		return "", errors.Wrapf(err, "downloading base image %s", d.BaseImageURL)
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		return "", errors.Wrap(err, "setting base image permissions")
+	}
+
+	return path, nil
+}
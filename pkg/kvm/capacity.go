@@ -0,0 +1,69 @@
+package kvm
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// checkHostCapacity fails when the machine can never fit on the hypervisor,
+// and warns when it doesn't fit right now. It only makes sense before the
+// machine is created.
+func (d *Driver) checkHostCapacity() error {
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+
+	info, err := conn.GetNodeInfo()
+	if err != nil {
+		return errors.Wrap(err, "getting host info")
+	}
+	if uint(d.maxCPUs()) > info.Cpus {
+		return fmt.Errorf("%d vCPUs requested but the host has %d CPUs, lower --kvm-cpu-count", d.maxCPUs(), info.Cpus)
+	}
+
+	// Memory is in MB as in the domain xml, the host reports KiB
+	memory := uint64(d.Memory) * 1000 * 1000
+	if total := info.Memory << 10; memory > total {
+		return fmt.Errorf("%d MB of memory requested but the host has %d MB, lower --kvm-memory", d.Memory, total/1000/1000)
+	}
+	if free, err := conn.GetFreeMemory(); err == nil && memory > free {
+		log.Warnf("%d MB of memory requested but only %d MB are free on the host", d.Memory, free/1000/1000)
+	}
+
+	return d.checkDiskSpace()
+}
+
+// checkDiskSpace compares the disks with the free space of the machine
+// store, where a machine-owned pool lives. Other pools are checked in
+// checkStoragePool. Sparse disks only need the space as they fill up, so
+// only preallocated disks fail the check.
+func (d *Driver) checkDiskSpace() error {
+	if !d.ownsStoragePool() || d.RBDPool != "" || d.DiskDevice != "" || d.isRemote() {
+		return nil
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(d.StorePath, &fs); err != nil {
+		return errors.Wrap(err, "getting free space of the machine store")
+	}
+	free := fs.Bavail * uint64(fs.Bsize) >> 20
+	need := uint64(d.DiskSize)
+	for _, size := range d.ExtraDisks {
+		need += uint64(size)
+	}
+	if need <= free {
+		return nil
+	}
+
+	msg := fmt.Sprintf("The disks need %d MB but %s has %d MB free", need, d.StorePath, free)
+	if d.DiskPreallocation == "falloc" || d.DiskPreallocation == "full" {
+		return fmt.Errorf("%s, lower --kvm-disk-size", msg)
+	}
+	log.Warn(msg)
+	return nil
+}
@@ -0,0 +1,329 @@
+package kvm
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+// cleanupStep removes one kind of resource created for the machine
+type cleanupStep struct {
+	name   string
+	remove func(conn *libvirt.Connect) error
+}
+
+// cleanup removes exactly the resources created for the machine, in the
+// reverse order of their creation. Every step runs even when an earlier one
+// fails, so a partial machine is cleaned up as far as possible.
+func (d *Driver) cleanup(conn *libvirt.Connect) error {
+	steps := []cleanupStep{
+		{"port forwards", func(*libvirt.Connect) error {
+			d.removePortForwards()
+			return nil
+		}},
+		{"domain", d.removeDomain},
+		{"volumes", d.removeVolumes},
+		{"disk encryption secret", d.removeDiskSecret},
+		{"machine files", d.removeMachineFiles},
+		{"DHCP reservation", d.removeStaticHost},
+		{"network", d.removeNetwork},
+	}
+
+	var errs mcnutils.MultiError
+	for _, step := range steps {
+		if err := step.remove(conn); err != nil {
+			errs.Errs = append(errs.Errs, errors.Wrapf(err, "removing %s", step.name))
+		}
+	}
+	if len(errs.Errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// rollback undoes the stages of a failed Create, most recent first. The keep
+// options only apply to machines that were fully created.
+func (d *Driver) rollback(created []cleanupStep) {
+	log.Infof("Creating %s failed, rolling back...", d.MachineName)
+	conn, err := d.getConnection()
+	if err != nil {
+		log.Warnf("Unable to roll back, getting connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	keepDisk, keepNetwork := d.KeepDisk, d.KeepNetwork
+	d.KeepDisk, d.KeepNetwork = false, false
+	defer func() { d.KeepDisk, d.KeepNetwork = keepDisk, keepNetwork }()
+
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := created[i].remove(conn); err != nil {
+			log.Warnf("Unable to roll back %s: %v", created[i].name, err)
+		}
+	}
+}
+
+// Undefine flags of libvirt releases newer than the vendored bindings
+const (
+	domainUndefineCheckpointsMetadata libvirt.DomainUndefineFlagsValues = 1 << 4
+	domainUndefineTPM                 libvirt.DomainUndefineFlagsValues = 1 << 5
+)
+
+// removeDomain destroys and undefines the domain, with its managed save,
+// snapshot and checkpoint metadata, UEFI NVRAM and swtpm state
+func (d *Driver) removeDomain(conn *libvirt.Connect) error {
+	dom, err := conn.LookupDomainByName(d.MachineName)
+	if err != nil {
+		log.Debugf("Domain %s does not exist", d.MachineName)
+		return nil
+	}
+	defer dom.Free()
+
+	desc, err := dom.GetXMLDesc(0)
+	if err != nil {
+		return errors.Wrap(err, "getting domain xml")
+	}
+	if err := d.checkDomainOwner(desc); err != nil {
+		return err
+	}
+
+	log.Infof("Domain %s exists, removing...", d.MachineName)
+	if active, _ := dom.IsActive(); active {
+		if err := libvirtCall("destroy domain "+d.MachineName, dom.Destroy); err != nil {
+			return errors.Wrap(err, "destroying domain")
+		}
+	}
+	flags := libvirt.DOMAIN_UNDEFINE_MANAGED_SAVE | libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA | libvirt.DOMAIN_UNDEFINE_NVRAM
+	err = libvirtCall("undefine domain "+d.MachineName, func() error {
+		return dom.UndefineFlags(flags | domainUndefineCheckpointsMetadata | domainUndefineTPM)
+	})
+	if isUnsupportedFlags(err) {
+		// libvirt before 8.9 rejects the flags it doesn't know
+		log.Debugf("Undefining domain %s without checkpoint and TPM flags", d.MachineName)
+		err = libvirtCall("undefine domain "+d.MachineName, func() error { return dom.UndefineFlags(flags) })
+	}
+	if err != nil {
+		return errors.Wrap(err, "undefining domain")
+	}
+	return nil
+}
+
+// isUnsupportedFlags reports whether err is libvirt rejecting flags it
+// doesn't know
+func isUnsupportedFlags(err error) bool {
+	if err == nil {
+		return false
+	}
+	virErr, ok := errors.Cause(err).(libvirt.Error)
+	return ok && (virErr.Code == libvirt.ERR_INVALID_ARG || virErr.Code == libvirt.ERR_NO_SUPPORT)
+}
+
+// keptDiskDir is where kept disks of machine-owned pools are moved, as
+// docker-machine deletes the machine directory after Remove
+func (d *Driver) keptDiskDir() string {
+	return filepath.Join(d.StorePath, "kvm-kept-disks")
+}
+
+// removeVolumes deletes the volumes created for the machine, and its storage
+// pool if it has its own. With KeepDisk the disks are kept, moving them out
+// of the machine directory when they live there.
+func (d *Driver) removeVolumes(conn *libvirt.Connect) error {
+	pool, err := conn.LookupStoragePoolByName(d.storagePoolName())
+	if err != nil {
+		log.Debugf("Storage pool %s does not exist", d.storagePoolName())
+		return nil
+	}
+	defer pool.Free()
+
+	var disks, names []string
+	if d.DiskDevice == "" {
+		disks = append(disks, d.diskVolumeName())
+	}
+	for i := range d.ExtraDisks {
+		disks = append(disks, d.extraDiskVolumeName(i))
+	}
+	if d.isoInPool() && !d.CloudInit {
+		names = append(names, d.isoVolumeName())
+	}
+	if d.KeepDisk {
+		if err := d.keepDisks(pool, disks); err != nil {
+			return err
+		}
+	} else {
+		names = append(names, disks...)
+	}
+	return d.deleteVolumes(pool, names)
+}
+
+// removeCreatedVolumes rolls back the volumes Create made, and the storage
+// pool of the machine
+func (d *Driver) removeCreatedVolumes(conn *libvirt.Connect) error {
+	pool, err := conn.LookupStoragePoolByName(d.storagePoolName())
+	if err != nil {
+		log.Debugf("Storage pool %s does not exist", d.storagePoolName())
+		return nil
+	}
+	defer pool.Free()
+
+	return d.deleteVolumes(pool, d.createdVolumes)
+}
+
+// deleteVolumes deletes the named volumes of pool, then the pool itself if
+// it is the machine's own
+func (d *Driver) deleteVolumes(pool *libvirt.StoragePool, names []string) error {
+	var errs mcnutils.MultiError
+	for _, name := range names {
+		vol, err := pool.LookupStorageVolByName(name)
+		if err != nil {
+			continue
+		}
+		log.Infof("Volume %s exists, removing...", name)
+		if err := libvirtCall("delete volume "+name, func() error { return vol.Delete(0) }); err != nil {
+			errs.Errs = append(errs.Errs, errors.Wrapf(err, "deleting volume %s", name))
+		}
+		vol.Free()
+	}
+
+	if d.ownsStoragePool() {
+		log.Infof("Removing storage pool %s...", d.storagePoolName())
+		if active, _ := pool.IsActive(); active {
+			pool.Destroy()
+		}
+		if err := libvirtCall("undefine storage pool "+d.storagePoolName(), pool.Undefine); err != nil {
+			errs.Errs = append(errs.Errs, errors.Wrap(err, "undefining storage pool"))
+		}
+	}
+
+	if len(errs.Errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// keepDisks moves the disks of a pool on the machine directory to
+// keptDiskDir; disks of other pools stay where they are
+func (d *Driver) keepDisks(pool *libvirt.StoragePool, disks []string) error {
+	if !d.ownsStoragePool() || d.RBDPool != "" {
+		log.Infof("Keeping disks %v in storage pool %s", disks, d.storagePoolName())
+		return nil
+	}
+
+	if err := os.MkdirAll(d.keptDiskDir(), 0755); err != nil {
+		return errors.Wrap(err, "creating kept disk directory")
+	}
+	for _, name := range disks {
+		vol, err := pool.LookupStorageVolByName(name)
+		if err != nil {
+			continue
+		}
+		path, err := vol.GetPath()
+		vol.Free()
+		if err != nil {
+			return errors.Wrapf(err, "getting path of volume %s", name)
+		}
+		dst := filepath.Join(d.keptDiskDir(), name)
+		log.Infof("Keeping disk %s as %s", name, dst)
+		if err := os.Rename(path, dst); err != nil {
+			return errors.Wrapf(err, "moving disk %s", name)
+		}
+	}
+	return nil
+}
+
+// removeDiskSecret undefines the LUKS secret, unless the encrypted disk is
+// kept
+func (d *Driver) removeDiskSecret(conn *libvirt.Connect) error {
+	if d.DiskSecretUUID == "" {
+		return nil
+	}
+	if d.KeepDisk {
+		log.Infof("Keeping disk encryption secret %s", d.DiskSecretUUID)
+		return nil
+	}
+	secret, err := conn.LookupSecretByUUIDString(d.DiskSecretUUID)
+	if err != nil {
+		return nil
+	}
+	defer secret.Free()
+	log.Infof("Removing disk encryption secret %s...", d.DiskSecretUUID)
+	return secret.Undefine()
+}
+
+// removeMachineFiles deletes the ISO copy and the seed from the machine
+// directory
+func (d *Driver) removeMachineFiles(*libvirt.Connect) error {
+	for _, path := range []string{d.ResolveStorePath("boot2docker.iso"), d.seedISOPath()} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "deleting %s", path)
+		}
+	}
+	return nil
+}
+
+// removeStaticHost deletes the DHCP reservation of the static IP
+func (d *Driver) removeStaticHost(conn *libvirt.Connect) error {
+	if !d.reservesIP() || d.StaticIP == "" {
+		return nil
+	}
+	network, err := conn.LookupNetworkByName(d.NetworkName)
+	if err != nil {
+		return nil
+	}
+	defer network.Free()
+	if err := network.Update(libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1,
+		d.staticHostXML(), libvirt.NETWORK_UPDATE_AFFECT_LIVE|libvirt.NETWORK_UPDATE_AFFECT_CONFIG); err != nil {
+		log.Debugf("Unable to remove DHCP reservation for %s: %v", d.StaticIP, err)
+	}
+	return nil
+}
+
+// removeNetwork tears down the private network after the domain, so it's no
+// longer in use, if the driver created it and no other machine uses it. The
+// last machine of the store using it removes it, whichever created it.
+func (d *Driver) removeNetwork(conn *libvirt.Connect) error {
+	unlock, err := d.lockNetworks()
+	if err != nil {
+		return errors.Wrap(err, "locking networks")
+	}
+	defer unlock()
+
+	network, err := conn.LookupNetworkByName(d.NetworkName)
+	if err != nil {
+		return nil
+	}
+	defer network.Free()
+
+	inUse, err := d.networkInUse(conn)
+	if err != nil {
+		return errors.Wrap(err, "checking if the network is in use")
+	}
+	desc, err := network.GetXMLDesc(0)
+	if err != nil {
+		return errors.Wrap(err, "getting network xml")
+	}
+	owned, err := d.networkOwned(desc)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !owned:
+		log.Debugf("Network %s was not created by the driver for this store, keeping it", d.NetworkName)
+	case d.KeepNetwork:
+		log.Infof("Keeping network %s", d.NetworkName)
+	case inUse:
+		log.Infof("Network %s is used by other machines, keeping it", d.NetworkName)
+	default:
+		log.Infof("Network %s exists, removing...", d.NetworkName)
+		if active, _ := network.IsActive(); active {
+			network.Destroy()
+		}
+		if err := libvirtCall("undefine network "+d.NetworkName, network.Undefine); err != nil {
+			return errors.Wrap(err, "undefining network")
+		}
+	}
+	return nil
+}
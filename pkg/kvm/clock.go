@@ -0,0 +1,73 @@
+package kvm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// timerModes are the values a --kvm-timer may take; tsc also takes a mode
+var timerModes = map[string][]string{
+	"kvmclock":    {"on", "off"},
+	"hypervclock": {"on", "off"},
+	"hpet":        {"on", "off"},
+	"pit":         {"on", "off"},
+	"rtc":         {"on", "off"},
+	"tsc":         {"on", "off", "auto", "native", "emulate", "paravirt", "smpsafe"},
+}
+
+// domainTimer is a timer of the domain clock
+type domainTimer struct {
+	Name string
+	// Present is yes or no, unless Mode is set
+	Present string
+	// Mode is the tsc mode
+	Mode string
+}
+
+// clockTimer parses a NAME=on|off timer setting, or tsc=MODE
+func clockTimer(spec string) (*domainTimer, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) == 2 {
+		for _, value := range timerModes[parts[0]] {
+			if value != parts[1] {
+				continue
+			}
+			switch value {
+			case "on":
+				return &domainTimer{Name: parts[0], Present: "yes"}, nil
+			case "off":
+				return &domainTimer{Name: parts[0], Present: "no"}, nil
+			}
+			return &domainTimer{Name: parts[0], Mode: value}, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid timer %q, expected NAME=on|off with NAME one of kvmclock, hypervclock, hpet, pit, rtc or tsc, or tsc=auto|native|emulate|paravirt|smpsafe", spec)
+}
+
+// clockOffset is the offset of the guest clock, defaulting for machines
+// created before it was configurable
+func (d *Driver) clockOffset() string {
+	if d.ClockOffset == "" {
+		return defaultClockOffset
+	}
+	return d.ClockOffset
+}
+
+// syncClock sets the guest clock to the host time through the guest agent,
+// as it stood still while the machine was paused or saved. Guests without
+// an agent keep their stale clock, with a warning.
+func (d *Driver) syncClock(dom *libvirt.Domain) {
+	if d.NoClockSync {
+		return
+	}
+	now := time.Now()
+	if err := dom.SetTime(now.Unix(), uint(now.Nanosecond()), 0); err != nil {
+		log.Warnf("Unable to set the guest clock, it may be behind: %v", err)
+		return
+	}
+	log.Debugf("Set the guest clock to %s", now.UTC())
+}
@@ -0,0 +1,340 @@
+package kvm
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/docker/machine/libmachine/ssh"
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+// Clone creates the machine name as a copy of the stopped machine d, and
+// starts it. The disks are copied or, with linked, the boot disk is a qcow2
+// overlay of the disk of d, which is then marked as a clone base that can
+// no longer be started, nor removed while clones use it. The clone gets its
+// own MACs, IP and SSH key, and is rolled back if it doesn't start.
+func (d *Driver) Clone(name string, linked bool) (_ *Driver, err error) {
+	switch {
+	case d.DiskDevice != "" || d.RBDPool != "":
+		return nil, errors.New("Only machines with disks in a storage pool can be cloned")
+	case d.DiskSecretUUID != "":
+		return nil, errors.New("Machines with an encrypted disk can't be cloned")
+	case d.IPMode == "static":
+		return nil, errors.New("Machines with a static IP configuration can't be cloned")
+	}
+	s, err := d.GetState()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting state of VM")
+	}
+	if s != state.Stopped {
+		return nil, errors.Errorf("Machine %s is %s, stop it before cloning", d.MachineName, s)
+	}
+
+	c, err := d.cloneConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	if linked {
+		c.LinkedCloneOf = d.MachineName
+	}
+
+	// Like in Create, each stage registers its cleanup before running. A
+	// clone that doesn't start is removed entirely, so it can be retried.
+	var created []cleanupStep
+	defer func() {
+		if err != nil && len(created) > 0 && !c.NoRollback {
+			c.rollback(created)
+		}
+	}()
+
+	created = append(created, cleanupStep{"machine directory", func(*libvirt.Connect) error {
+		return os.RemoveAll(c.ResolveStorePath("."))
+	}})
+	if err := os.MkdirAll(c.ResolveStorePath("."), 0755); err != nil {
+		return nil, errors.Wrap(err, "creating machine directory")
+	}
+	rotateKey := d.SSHKeySource == "" && !d.SSHAgent && d.GetSSHKeyPath() == d.ResolveStorePath("id_rsa")
+	if rotateKey {
+		// The guest only knows the key of d until the clone gets its own
+		for _, suffix := range []string{"", ".pub"} {
+			if err := mcnutils.CopyFile(d.GetSSHKeyPath()+suffix, c.GetSSHKeyPath()+suffix); err != nil {
+				return nil, errors.Wrap(err, "copying ssh key")
+			}
+		}
+	}
+
+	created = append(created, cleanupStep{"volumes", c.removeCreatedVolumes})
+	if err := d.cloneDisks(c, linked); err != nil {
+		return nil, err
+	}
+	if !c.CloudInit {
+		if err := c.prepareISO(); err != nil {
+			return nil, errors.Wrap(err, "copying ISO to machine dir")
+		}
+	}
+	if c.hasSeed() {
+		// A new instance-id and hostname, for cloud-init to set the clone up
+		if err := c.buildSeedISO(); err != nil {
+			return nil, errors.Wrap(err, "building cloud-init seed")
+		}
+		c.chownForQEMU(c.seedISOPath())
+	}
+	if !c.UserNetworking {
+		created = append(created, cleanupStep{"network", c.removeNetwork})
+		if c.reservesIP() {
+			created = append(created, cleanupStep{"DHCP reservation", c.removeStaticHost})
+		}
+		if err := c.setupNetworks(); err != nil {
+			return nil, errors.Wrap(err, "creating network")
+		}
+	}
+
+	log.Infof("Defining domain %s...", c.MachineName)
+	created = append(created, cleanupStep{"domain", c.removeDomain})
+	dom, err := c.createDomain()
+	if err != nil {
+		return nil, errors.Wrap(err, "defining domain")
+	}
+	dom.Free()
+
+	if err := c.Start(); err != nil {
+		return nil, errors.Wrap(err, "starting clone")
+	}
+	created = nil
+	if linked {
+		d.CloneBase = true
+	}
+	if rotateKey {
+		// The clone runs, it is kept with the key of d
+		if err := c.rotateSSHKey(); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// cloneConfig copies the configuration of d for the machine name, dropping
+// what belongs to d alone
+func (d *Driver) cloneConfig(name string) (*Driver, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding driver config")
+	}
+	c := NewDriver(name, d.StorePath)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errors.Wrap(err, "decoding driver config")
+	}
+	c.MachineName = name
+	c.IPAddress = ""
+	c.MAC, c.PrivateMAC = "", ""
+	c.NetworkOwned = false
+	c.CloneBase, c.LinkedCloneOf = false, ""
+	if d.SSHKeyPath == d.ResolveStorePath("id_rsa") {
+		c.SSHKeyPath = ""
+	}
+	if c.StaticIP != "" {
+		log.Infof("The clone gets an IP by DHCP instead of %s", c.StaticIP)
+		c.StaticIP = ""
+	}
+	if c.DHCPHostname {
+		// Its own reservation, for its own name
+		mac, err := randomMAC()
+		if err != nil {
+			return nil, errors.Wrap(err, "generating MAC address for the DHCP reservation")
+		}
+		c.PrivateMAC = mac
+	}
+	if len(c.PortForwards) > 0 {
+		log.Warnf("Port forwards %v are not cloned, their host ports are taken", c.PortForwards)
+		c.PortForwards = nil
+	}
+	if c.PerMachineNetwork && c.NetworkName == fmt.Sprintf("%s-net", d.MachineName) {
+		c.NetworkName = fmt.Sprintf("%s-net", name)
+	}
+
+	c.ISO = c.ResolveStorePath("boot2docker.iso")
+	c.DiskPath = c.ResolveStorePath(c.diskVolumeName())
+	if c.ConsoleLog != "" {
+		c.ConsoleLog = c.ResolveStorePath("console.log")
+	}
+	c.SSHPort = c.guestSSHPort()
+	if err := c.setupSession(); err != nil {
+		return nil, errors.Wrap(err, "setting up session mode")
+	}
+	return c, nil
+}
+
+// cloneDisks creates the volumes of c from those of d. Extra disks are
+// always copied, their raw format leaves no room for an overlay.
+func (d *Driver) cloneDisks(c *Driver, linked bool) error {
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+
+	srcPool, err := d.lookupStoragePool(conn)
+	if err != nil {
+		return err
+	}
+	defer srcPool.Free()
+	dstPool, err := c.lookupStoragePool(conn)
+	if err != nil {
+		return err
+	}
+	defer dstPool.Free()
+
+	src, err := srcPool.LookupStorageVolByName(d.diskVolumeName())
+	if err != nil {
+		return errors.Wrapf(err, "looking up volume %s", d.diskVolumeName())
+	}
+	defer src.Free()
+	if linked {
+		path, err := src.GetPath()
+		if err != nil {
+			return errors.Wrapf(err, "getting path of volume %s", d.diskVolumeName())
+		}
+		vol, err := c.createVolume(conn, volumeConfig{
+			Name:          c.diskVolumeName(),
+			Capacity:      c.DiskSize << 20,
+			Format:        c.diskFormat(),
+			BackingPath:   path,
+			BackingFormat: d.diskFormat(),
+		})
+		if err != nil {
+			return errors.Wrap(err, "creating disk volume")
+		}
+		vol.Free()
+		log.Infof("Created %s as a linked clone of %s", c.diskVolumeName(), path)
+	} else if err := c.copyVolume(dstPool, src, c.diskVolumeName(), c.diskFormat()); err != nil {
+		return err
+	}
+
+	for i := range d.ExtraDisks {
+		src, err := srcPool.LookupStorageVolByName(d.extraDiskVolumeName(i))
+		if err != nil {
+			return errors.Wrapf(err, "looking up volume %s", d.extraDiskVolumeName(i))
+		}
+		err = c.copyVolume(dstPool, src, c.extraDiskVolumeName(i), "raw")
+		src.Free()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// volumeBackingXML is the part of a volume definition naming its backing
+// file
+type volumeBackingXML struct {
+	BackingStore struct {
+		Path string `xml:"path"`
+	} `xml:"backingStore"`
+}
+
+// linkedClones lists the volumes, in any storage pool, that are overlays of
+// the disk of d. Inactive pools can't be listed and are skipped.
+func (d *Driver) linkedClones(conn *libvirt.Connect) ([]string, error) {
+	pool, err := conn.LookupStoragePoolByName(d.storagePoolName())
+	if err != nil {
+		return nil, nil
+	}
+	base, err := pool.LookupStorageVolByName(d.diskVolumeName())
+	pool.Free()
+	if err != nil {
+		// Without its disk, the machine backs nothing
+		return nil, nil
+	}
+	basePath, err := base.GetPath()
+	base.Free()
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting path of volume %s", d.diskVolumeName())
+	}
+
+	pools, err := conn.ListAllStoragePools(libvirt.CONNECT_LIST_STORAGE_POOLS_ACTIVE)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing storage pools")
+	}
+	var clones []string
+	for _, pool := range pools {
+		vols, _ := pool.ListAllStorageVolumes(0)
+		for _, vol := range vols {
+			desc, err := vol.GetXMLDesc(0)
+			if err == nil {
+				var parsed volumeBackingXML
+				if xml.Unmarshal([]byte(desc), &parsed) == nil && parsed.BackingStore.Path == basePath {
+					name, _ := vol.GetName()
+					clones = append(clones, name)
+				}
+			}
+			vol.Free()
+		}
+		pool.Free()
+	}
+	return clones, nil
+}
+
+// copyVolume creates the volume name in pool as a copy of src
+func (d *Driver) copyVolume(pool *libvirt.StoragePool, src *libvirt.StorageVol, name, format string) error {
+	info, err := src.GetInfo()
+	if err != nil {
+		return errors.Wrap(err, "getting volume info")
+	}
+	config := volumeConfig{Name: name, Capacity: int64(info.Capacity), Format: format}
+	if d.RBDPool == "" {
+		config.Owner = d.qemuOwner()
+	}
+	volumeXML, err := renderXML("volume", volumeTmpl, config)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Copying disk to %s...", name)
+	var vol *libvirt.StorageVol
+	err = libvirtCall("clone volume "+name, func() (err error) {
+		vol, err = pool.StorageVolCreateXMLFrom(volumeXML, src, 0)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "copying volume to %s", name)
+	}
+	d.volumeCreated(name)
+	vol.Free()
+	return nil
+}
+
+// rotateSSHKey replaces the key the clone inherited with a new one, in the
+// guest and in the machine directory
+func (d *Driver) rotateSSHKey() error {
+	path := d.GetSSHKeyPath()
+	if err := ssh.GenerateSSHKey(path + ".new"); err != nil {
+		return errors.Wrap(err, "generating ssh key")
+	}
+	pubKey, err := ioutil.ReadFile(path + ".new.pub")
+	if err != nil {
+		return errors.Wrap(err, "reading ssh public key")
+	}
+
+	log.Info("Installing the SSH key of the clone...")
+	// boot2docker restores ~/.ssh from userdata.tar on boot, so it's updated
+	// too
+	cmd := fmt.Sprintf("printf '%%s' '%s' > ~/.ssh/authorized_keys && "+
+		"if [ -f /var/lib/boot2docker/userdata.tar ]; then sudo tar -C ~ -cf /var/lib/boot2docker/userdata.tar .ssh; fi", pubKey)
+	if out, err := drivers.RunSSHCommandFromDriver(d, cmd); err != nil {
+		return errors.Wrapf(err, "installing ssh key: %s", out)
+	}
+	for _, suffix := range []string{"", ".pub"} {
+		if err := os.Rename(path+".new"+suffix, path+suffix); err != nil {
+			return errors.Wrap(err, "replacing ssh key")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package kvm
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"text/template"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// userDataTmpl sets up the SSH user docker-machine provisions the machine as
+const userDataTmpl = `#cloud-config
+users:
+  - name: {{.User}}
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    shell: /bin/bash
+    ssh_authorized_keys:
+{{- range .SSHKeys}}
+      - {{.}}
+{{- end}}
+`
+
+const metaDataTmpl = `instance-id: {{.Hostname}}
+local-hostname: {{.Hostname}}
+`
+
+// networkConfigTmpl configures the static IP of the private interface, found
+// by its MAC address like the interfaces of the domain
+const networkConfigTmpl = `version: 1
+config:
+{{- if not .SingleNetwork}}
+  - type: physical
+    name: eth0
+    mac_address: "{{.MAC}}"
+    subnets:
+      - type: dhcp
+{{- end}}
+{{- with subnet .PrivateNetworkCIDR}}
+  - type: physical
+    name: {{if $.SingleNetwork}}eth0{{else}}eth1{{end}}
+    mac_address: "{{$.PrivateMAC}}"
+    subnets:
+      - type: static
+        address: {{$.StaticIP}}
+        netmask: {{.Netmask}}
+{{- if $.SingleNetwork}}
+        gateway: {{.Gateway}}
+        dns_nameservers: [{{.Gateway}}]
+{{- end}}
+{{- end}}
+`
+
+type cloudInitConfig struct {
+	User     string
+	SSHKeys  []string
+	Hostname string
+}
+
+// seedISOPath is the NoCloud seed attached to cloud-init machines
+func (d *Driver) seedISOPath() string {
+	return d.ResolveStorePath("seed.iso")
+}
+
+// hasSeed is set when the machine gets a NoCloud seed as a second cdrom
+func (d *Driver) hasSeed() bool {
+	return d.CloudInit || d.UserDataFile != ""
+}
+
+// userData is the generated cloud-config, followed as a multipart MIME part
+// by the user-data of --kvm-user-data
+func (d *Driver) userData() ([]byte, error) {
+	pubKeys, err := d.authorizedKeys()
+	if err != nil {
+		return nil, err
+	}
+	generated, err := executeSeedTemplate("user-data", userDataTmpl, cloudInitConfig{
+		User:     d.GetSSHUsername(),
+		SSHKeys:  strings.Split(strings.TrimSpace(string(pubKeys)), "\n"),
+		Hostname: d.MachineName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if d.UserDataFile == "" {
+		return generated, nil
+	}
+
+	custom, err := ioutil.ReadFile(d.UserDataFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading user-data")
+	}
+	contentType := "text/cloud-config"
+	if bytes.HasPrefix(custom, []byte("#!")) {
+		contentType = "text/x-shellscript"
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n", mw.Boundary())
+	for _, part := range []struct {
+		contentType string
+		data        []byte
+	}{{"text/cloud-config", generated}, {contentType, custom}} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		if err != nil {
+			return nil, errors.Wrap(err, "writing user-data part")
+		}
+		w.Write(part.data)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, errors.Wrap(err, "writing user-data")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func executeSeedTemplate(name, src string, data interface{}) ([]byte, error) {
+	tmpl := template.Must(template.New(name).Funcs(templateFuncs).Parse(src))
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, errors.Wrapf(err, "executing %s template", name)
+	}
+	return buf.Bytes(), nil
+}
+
+// buildSeedISO writes the NoCloud seed ISO holding the user-data, meta-data
+// and, for a static IP, network-config of the machine
+func (d *Driver) buildSeedISO() error {
+	files := map[string][]byte{}
+	var err error
+	if files["user-data"], err = d.userData(); err != nil {
+		return err
+	}
+	if files["meta-data"], err = executeSeedTemplate("meta-data", metaDataTmpl, cloudInitConfig{Hostname: d.MachineName}); err != nil {
+		return err
+	}
+	if d.IPMode == "static" {
+		if files["network-config"], err = executeSeedTemplate("network-config", networkConfigTmpl, d); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Building cloud-init seed %s...", d.seedISOPath())
+	if err := writeISO9660(d.seedISOPath(), "cidata", files); err != nil {
+		return errors.Wrap(err, "writing seed ISO")
+	}
+	return nil
+}
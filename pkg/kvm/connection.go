@@ -0,0 +1,220 @@
+package kvm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/machine/libmachine/log"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	keepAliveInterval = 5 // seconds between keepalive messages
+	keepAliveCount    = 3 // unanswered messages before the connection is closed
+)
+
+// connectionManager caches a single libvirt connection per URI, so the many
+// short-lived operations of the driver don't each pay for a new connection.
+// Callers get their own reference and must Close it as with a fresh one.
+type connectionManager struct {
+	mu    sync.Mutex
+	conns map[string]*libvirt.Connect
+
+	eventLoop sync.Once
+}
+
+var connections = &connectionManager{conns: map[string]*libvirt.Connect{}}
+
+// startEventLoop runs the default libvirt event loop, which keepalive
+// messages rely on
+func (m *connectionManager) startEventLoop() {
+	m.eventLoop.Do(func() {
+		if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+			log.Debugf("Unable to register libvirt event loop, keepalive is disabled: %v", err)
+			return
+		}
+		go func() {
+			for {
+				if err := libvirt.EventRunDefaultImpl(); err != nil {
+					log.Debugf("Error running libvirt event loop: %v", err)
+				}
+			}
+		}()
+	})
+}
+
+// get returns a reference to the cached connection for uri, reconnecting if
+// it is missing or dead
+func (m *connectionManager) get(uri string) (*libvirt.Connect, error) {
+	m.startEventLoop()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if conn, ok := m.conns[uri]; ok {
+		if alive, err := conn.IsAlive(); err == nil && alive {
+			if err := conn.Ref(); err == nil {
+				return conn, nil
+			}
+		}
+		log.Debugf("Connection to %s is dead, reconnecting", uri)
+		conn.Close()
+		delete(m.conns, uri)
+	}
+
+	conn, err := libvirt.NewConnect(uri)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetKeepAlive(keepAliveInterval, keepAliveCount); err != nil {
+		log.Debugf("Unable to enable keepalive on %s: %v", uri, err)
+	}
+	m.conns[uri] = conn
+	domainEvents.register(conn)
+
+	if err := conn.Ref(); err != nil {
+		return nil, errors.Wrap(err, "referencing libvirt connection")
+	}
+	return conn, nil
+}
+
+// closeAll drops the cached connections
+func (m *connectionManager) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for uri, conn := range m.conns {
+		if _, err := conn.Close(); err != nil {
+			log.Debugf("Error closing connection to %s: %v", uri, err)
+		}
+		delete(m.conns, uri)
+	}
+}
+
+// CloseConnections closes the libvirt connections cached by the driver. It
+// is meant to be called once the process is done with the driver.
+func CloseConnections() {
+	connections.closeAll()
+}
+
+// isRemote reports whether the hypervisor is on another host, in which case
+// local paths and host devices can't be used
+func (d *Driver) isRemote() bool {
+	if d.ConnectionURI == "" {
+		return false
+	}
+	u, err := url.Parse(d.ConnectionURI)
+	if err != nil {
+		return false
+	}
+	return u.Host != ""
+}
+
+// setupTLS points the connection URI's pkipath at the machine store, where
+// copyTLSCredentials puts the TLS credentials
+func (d *Driver) setupTLS() error {
+	if d.TLSCACert == "" && d.TLSClientCert == "" && d.TLSClientKey == "" {
+		return nil
+	}
+	if d.TLSCACert == "" || d.TLSClientCert == "" || d.TLSClientKey == "" {
+		return fmt.Errorf("--kvm-tls-cacert, --kvm-tls-cert and --kvm-tls-key must be given together")
+	}
+
+	u, err := url.Parse(d.ConnectionURI)
+	if err != nil {
+		return errors.Wrapf(err, "parsing connection URI %s", d.ConnectionURI)
+	}
+	if !strings.HasSuffix(u.Scheme, "+tls") {
+		return fmt.Errorf("TLS credentials need a +tls connection URI, got %s", d.ConnectionURI)
+	}
+
+	q := u.Query()
+	q.Set("pkipath", d.ResolveStorePath("pki"))
+	u.RawQuery = q.Encode()
+	d.ConnectionURI = u.String()
+
+	return nil
+}
+
+// copyTLSCredentials copies the TLS credentials into the machine store under
+// the file names libvirt expects. It runs before the first connection rather
+// than with the flags, so a dry run writes nothing to the store.
+func (d *Driver) copyTLSCredentials() error {
+	if d.TLSCACert == "" {
+		return nil
+	}
+
+	pkiPath := d.ResolveStorePath("pki")
+	if err := os.MkdirAll(pkiPath, 0700); err != nil {
+		return errors.Wrap(err, "creating pki directory")
+	}
+	files := []struct {
+		src, name string
+		mode      os.FileMode
+	}{
+		{d.TLSCACert, "cacert.pem", 0644},
+		{d.TLSClientCert, "clientcert.pem", 0644},
+		{d.TLSClientKey, "clientkey.pem", 0600},
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f.src)
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", f.src)
+		}
+		if err := ioutil.WriteFile(filepath.Join(pkiPath, f.name), data, f.mode); err != nil {
+			return errors.Wrapf(err, "writing %s", f.name)
+		}
+	}
+
+	return nil
+}
+
+// isSession reports whether the driver talks to an unprivileged
+// qemu:///session hypervisor
+func (d *Driver) isSession() bool {
+	u, err := url.Parse(d.ConnectionURI)
+	if err != nil {
+		return false
+	}
+	return u.Path == "/session"
+}
+
+// setupSession switches to user-mode networking when running unprivileged,
+// picking free localhost ports to forward SSH and the Docker engine to
+func (d *Driver) setupSession() error {
+	d.UserNetworking = d.isSession()
+	if !d.UserNetworking {
+		return nil
+	}
+	if d.NetworkMode == "direct" || d.SRIOVVF != "" || len(d.ExtraNetworks) > 0 || d.StaticIP != "" || d.DHCPHostname || len(d.NetBandwidth) > 0 {
+		return errors.New("Direct, SR-IOV, extra network, static IP, DHCP hostname and bandwidth options need root and can't be used with qemu:///session")
+	}
+
+	var err error
+	if d.SSHPort, err = freePort(); err != nil {
+		return errors.Wrap(err, "picking SSH port")
+	}
+	if d.SessionEnginePort, err = freePort(); err != nil {
+		return errors.Wrap(err, "picking engine port")
+	}
+	d.IPAddress = "127.0.0.1"
+
+	return nil
+}
+
+// freePort returns a localhost TCP port that is currently unused
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,102 @@
+package kvm
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+// ConsoleEscape is the byte that detaches from the console, Ctrl-], as
+// with virsh console
+const ConsoleEscape = 0x1d
+
+// Console attaches in and out to the serial console of the running machine
+// until ConsoleEscape is read from in, in is closed or the guest closes the
+// console. With force, a session another client holds on the console is
+// taken over.
+func (d *Driver) Console(in io.Reader, out io.Writer, force bool) error {
+	s, err := d.GetState()
+	if err != nil {
+		return errors.Wrap(err, "getting state of VM")
+	}
+	if s != state.Running {
+		return errors.Errorf("Machine %s is %s, start it to attach to its console", d.MachineName, s)
+	}
+
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return errors.Wrap(err, "getting domain")
+	}
+	defer closeDomain(dom, conn)
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return errors.Wrap(err, "creating console stream")
+	}
+	defer stream.Free()
+
+	flags := libvirt.DOMAIN_CONSOLE_SAFE
+	if force {
+		flags |= libvirt.DOMAIN_CONSOLE_FORCE
+	}
+	if err := dom.OpenConsole("", stream, flags); err != nil {
+		return errors.Wrap(err, "opening console")
+	}
+
+	done := make(chan error, 2)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := stream.Recv(buf)
+			if err != nil || n == 0 {
+				// The guest side hung up, or the console was taken over
+				done <- err
+				return
+			}
+			if _, err := out.Write(buf[:n]); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := in.Read(buf)
+			if n > 0 {
+				data := buf[:n]
+				i := bytes.IndexByte(data, ConsoleEscape)
+				if i >= 0 {
+					data = data[:i]
+				}
+				if len(data) > 0 {
+					if _, sendErr := stream.Send(data); sendErr != nil {
+						done <- sendErr
+						return
+					}
+				}
+				if i >= 0 {
+					done <- nil
+					return
+				}
+			}
+			if err == io.EOF {
+				done <- nil
+				return
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	err = <-done
+	stream.Abort()
+	if err != nil {
+		return errors.Wrap(err, "streaming console")
+	}
+	return nil
+}
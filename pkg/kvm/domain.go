@@ -3,73 +3,381 @@ package kvm
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"strings"
 	"text/template"
 
+	"github.com/docker/machine/libmachine/log"
 	libvirt "github.com/libvirt/libvirt-go"
 	"github.com/pkg/errors"
 )
 
 const domainTmpl = `
-<domain type='kvm'>
+<domain type='{{domainType .}}'{{if .UserNetworking}} xmlns:qemu='http://libvirt.org/schemas/domain/qemu/1.0'{{end}}>
   <name>{{.MachineName}}</name> 
+  {{domainMetadata .}}
   <memory unit='MB'>{{.Memory}}</memory>
-  <vcpu>{{.CPU}}</vcpu>
+  {{if or .MemoryHardLimit .MemorySoftLimit .MemorySwapLimit}}
+  <memtune>
+    {{with .MemoryHardLimit}}<hard_limit unit='MB'>{{.}}</hard_limit>{{end}}
+    {{with .MemorySoftLimit}}<soft_limit unit='MB'>{{.}}</soft_limit>{{end}}
+    {{with .MemorySwapLimit}}<swap_hard_limit unit='MB'>{{.}}</swap_hard_limit>{{end}}
+  </memtune>
+  {{end}}
+  <vcpu{{if gt .MaxCPU .CPU}} current='{{.CPU}}'>{{.MaxCPU}}{{else}}>{{.CPU}}{{end}}</vcpu>
+  {{if .IOThreads}}<iothreads>{{.IOThreads}}</iothreads>{{end}}
+  {{if .CPUModel}}
+  <cpu mode='custom' match='exact'>
+    <model fallback='forbid'>{{.CPUModel}}</model>
+    {{range .CPUFeatures}}{{with cpuFeature .}}<feature policy='{{.Policy}}' name='{{.Name}}'/>
+    {{end}}{{end}}
+    {{if .TSCInvariant}}<feature policy='require' name='invtsc'/>{{end}}
+  </cpu>
+  {{else if .TSCInvariant}}
+  <cpu mode='host-passthrough'>
+    <feature policy='require' name='invtsc'/>
+  </cpu>
+  {{else if and (isAArch64 .) .TCG}}
+  <cpu mode='custom' match='exact'>
+    <model fallback='allow'>cortex-a57</model>
+  </cpu>
+  {{else if isAArch64 .}}
+  <cpu mode='host-passthrough'/>
+  {{end}}
   <features>
-    <acpi/>
-    <apic/>
-    <pae/>
+    {{range domainFeatures .}}{{if eq .Name "hyperv"}}
+    <hyperv>
+      <relaxed state='on'/>
+      <vapic state='on'/>
+      <spinlocks state='on' retries='8191'/>
+    </hyperv>{{else if .State}}
+    <{{.Name}} state='{{.State}}'/>{{else}}
+    <{{.Name}}/>{{end}}{{end}}
+    {{if isAArch64 .}}<gic version='{{if .TCG}}3{{else}}host{{end}}'/>{{end}}
   </features>
+  {{if isAArch64 .}}
+  <os firmware='efi'>
+    <type arch='aarch64' machine='virt'>hvm</type>
+  {{else}}
   <os>
     <type>hvm</type>
-    <boot dev='cdrom'/>
+  {{end}}
+    {{if not .BaseImageURL}}<boot dev='cdrom'/>{{end}}
     <boot dev='hd'/>
     <bootmenu enable='no'/>
   </os>
+  <clock offset='{{clockOffset .}}'>
+    {{range .Timers}}{{with clockTimer .}}<timer name='{{.Name}}'{{if .Mode}} mode='{{.Mode}}'{{else}} present='{{.Present}}'{{end}}/>
+    {{end}}{{end}}
+  </clock>
+  {{with .OnPoweroff}}<on_poweroff>{{.}}</on_poweroff>{{end}}
+  {{with .OnReboot}}<on_reboot>{{.}}</on_reboot>{{end}}
+  {{with .OnCrash}}<on_crash>{{.}}</on_crash>{{end}}
   <devices>
+    {{if .Emulator}}<emulator>{{.Emulator}}</emulator>{{end}}
+    {{if hasSeed .}}
+    <disk type='file' device='cdrom'>
+      <source file='{{seedISO .}}'/>
+      {{if isAArch64 .}}<target dev='sdz' bus='scsi'/>{{else}}<target dev='hdd' bus='ide'/>{{end}}
+      <readonly/>
+    </disk>
+    {{end}}
+    {{if not .CloudInit}}
+    {{if .RBDPool}}
+    <disk type='network' device='cdrom'>
+      <driver name='qemu' type='raw'/>{{rbdSource . (isoVolume .)}}
+    {{else}}
     <disk type='file' device='cdrom'>
       <source file='{{.ISO}}'/>
-      <target dev='hdc' bus='ide'/>
+    {{end}}
+      {{if isAArch64 .}}<target dev='sdy' bus='scsi'/>{{else}}<target dev='hdc' bus='ide'/>{{end}}
       <readonly/>
     </disk>
-    <disk type='file' device='disk'>
-      <driver name='qemu' type='raw' cache='{{.CacheMode}}' io='threads' />
-      <source file='{{.DiskPath}}'/>
-      <target dev='hda' bus='ide'/>
+    {{end}}
+    {{if eq .DiskController "virtio-scsi"}}
+    <controller type='scsi' index='0' model='virtio-scsi'>
+      {{if .IOThreads}}<driver iothread='1'/>{{end}}
+    </controller>
+    {{end}}
+    {{if .DiskDevice}}
+    <disk type='block' device='disk'>
+      <driver name='qemu' type='raw'{{with diskCache .}} cache='{{.}}'{{end}} io='{{diskIO .}}'{{if eq .DiskController "virtio-scsi"}} discard='unmap'{{end}} />
+      <source dev='{{.DiskDevice}}'/>
+    {{else if .RBDPool}}
+    <disk type='network' device='disk'>
+      <driver name='qemu' type='raw'{{with diskCache .}} cache='{{.}}'{{end}}{{if eq .DiskController "virtio-scsi"}} discard='unmap'{{end}} />{{rbdSource . (diskVolume .)}}
+    {{else}}
+    <disk type='volume' device='disk'>
+      <driver name='qemu' type='{{diskFormat .}}'{{with diskCache .}} cache='{{.}}'{{end}} io='{{diskIO .}}'{{if eq .DiskController "virtio-scsi"}} discard='unmap'{{end}} />
+      <source pool='{{storagePool .}}' volume='{{diskVolume .}}'/>
+      {{if .DiskSecretUUID}}
+      <encryption format='luks'>
+        <secret type='passphrase' uuid='{{.DiskSecretUUID}}'/>
+      </encryption>
+      {{end}}
+    {{end}}
+      {{if eq .DiskController "virtio-scsi"}}<target dev='sda' bus='scsi'/>{{else}}<target dev='hda' bus='ide'/>{{end}}
+      {{if or .DiskBytesSec .DiskIOPSSec}}
+      <iotune>
+        {{with .DiskBytesSec}}<total_bytes_sec>{{.}}</total_bytes_sec>{{end}}
+        {{with .DiskIOPSSec}}<total_iops_sec>{{.}}</total_iops_sec>{{end}}
+      </iotune>
+      {{end}}
     </disk>
+    {{range $i, $size := .ExtraDisks}}
+    {{if $.RBDPool}}
+    <disk type='network' device='disk'>
+      <driver name='qemu' type='raw'{{with diskCache $}} cache='{{.}}'{{end}}{{if eq $.DiskController "virtio-scsi"}} discard='unmap'{{else}}{{with iothread $ $i}} iothread='{{.}}'{{end}}{{end}} />{{rbdSource $ (extraDiskVolume $ $i)}}
+    {{else}}
+    <disk type='volume' device='disk'>
+      <driver name='qemu' type='raw'{{with diskCache $}} cache='{{.}}'{{end}} io='{{extraDiskIO $}}'{{if eq $.DiskController "virtio-scsi"}} discard='unmap'{{else}}{{with iothread $ $i}} iothread='{{.}}'{{end}}{{end}} />
+      <source pool='{{storagePool $}}' volume='{{extraDiskVolume $ $i}}'/>
+    {{end}}
+      {{if eq $.DiskController "virtio-scsi"}}<target dev='sd{{extraDiskLetter $i}}' bus='scsi'/>{{else}}<target dev='vd{{extraDiskLetter $i}}' bus='virtio'/>{{end}}
+      {{if or $.DiskBytesSec $.DiskIOPSSec}}
+      <iotune>
+        {{with $.DiskBytesSec}}<total_bytes_sec>{{.}}</total_bytes_sec>{{end}}
+        {{with $.DiskIOPSSec}}<total_iops_sec>{{.}}</total_iops_sec>{{end}}
+      </iotune>
+      {{end}}
+    </disk>
+    {{end}}
+    {{if not .UserNetworking}}
+    {{if not .SingleNetwork}}
     <interface type='network'>
       <source network='default'/>
+      {{if .MAC}}<mac address='{{.MAC}}'/>{{end}}
+      {{if .MTU}}<mtu size='{{.MTU}}'/>{{end}}
+      {{if ne .Vhost "auto"}}<model type='virtio'/>
+      <driver name='{{if eq .Vhost "on"}}vhost{{else}}qemu{{end}}'/>{{end}}
+      {{template "bandwidth" .NetBandwidth}}
     </interface>
+    {{end}}
+    {{if eq .NetworkMode "direct"}}
+    <interface type='direct'>
+      <source dev='{{.DirectDevice}}' mode='{{.DirectMode}}'/>
+    {{else}}
     <interface type='network'>
       <source network='{{.NetworkName}}'/>
+    {{end}}
+      {{if .PrivateMAC}}<mac address='{{.PrivateMAC}}'/>{{end}}
+      {{if .MTU}}<mtu size='{{.MTU}}'/>{{end}}
+      {{if ne .Vhost "auto"}}<model type='virtio'/>
+      <driver name='{{if eq .Vhost "on"}}vhost{{else}}qemu{{end}}'/>{{end}}
+      {{template "bandwidth" .NetBandwidth}}
+    </interface>
+    {{range .ExtraNetworks}}
+    <interface type='network'>
+      <source network='{{.}}'/>
+      {{if $.MTU}}<mtu size='{{$.MTU}}'/>{{end}}
+      {{if ne $.Vhost "auto"}}<model type='virtio'/>
+      <driver name='{{if eq $.Vhost "on"}}vhost{{else}}qemu{{end}}'/>{{end}}
+      {{template "bandwidth" $.NetBandwidth}}
     </interface>
+    {{end}}
+    {{if .SRIOVVF}}
+    <interface type='hostdev' managed='yes'>
+      <source>
+        <address type='pci' {{pciAddress .SRIOVVF}}/>
+      </source>
+    </interface>
+    {{end}}
+    {{end}}
     <serial type='pty'>
-      <source path='/dev/pts/2'/>
+      {{if .ConsoleLog}}<log file='{{.ConsoleLog}}' append='on'/>{{end}}
       <target port='0'/>
     </serial>
-    <console type='pty' tty='/dev/pts/2'>
-      <source path='/dev/pts/2'/>
-      <target port='0'/>
+    <console type='pty'>
+      <target type='serial' port='0'/>
     </console>
+    <channel type='unix'>
+      <target type='virtio' name='org.qemu.guest_agent.0'/>
+    </channel>
+    {{range $i, $spec := .Mounts}}{{with mount $spec}}
+    <filesystem type='mount' accessmode='mapped'>
+      <source dir='{{html .HostDir}}'/>
+      <target dir='{{mountTag $i}}'/>
+    </filesystem>
+    {{end}}{{end}}
+    {{if .Watchdog}}
+    <watchdog model='i6300esb' action='{{.Watchdog}}'/>
+    {{end}}
+    {{if not (isAArch64 .)}}<panic model='isa'/>{{end}}
+    {{if eq .Display "vnc"}}
+    <graphics type='vnc' autoport='yes' listen='127.0.0.1'/>
+    <video>
+      <model type='{{if isAArch64 .}}virtio{{else}}vga{{end}}'/>
+    </video>
+    {{else if eq .Display "spice"}}
+    <graphics type='spice' autoport='yes' listen='127.0.0.1'>
+      <image compression='off'/>
+    </graphics>
+    <video>
+      <model type='{{.VideoModel}}'/>
+    </video>
+    <channel type='spicevmc'>
+      <target type='virtio' name='com.redhat.spice.0'/>
+    </channel>
+    {{end}}
   </devices>
+  {{if eq .SecLabel "none"}}
+  <seclabel type='none'{{if .SecLabelModel}} model='{{.SecLabelModel}}'{{end}}/>
+  {{else if eq .SecLabel "custom"}}
+  <seclabel type='static'{{if .SecLabelModel}} model='{{.SecLabelModel}}'{{end}} relabel='yes'>
+    <label>{{.SecLabelLabel}}</label>
+  </seclabel>
+  {{else if .SecLabelModel}}
+  <seclabel type='dynamic' model='{{.SecLabelModel}}'/>
+  {{end}}
+  {{with qemuOwner .}}
+  <seclabel type='static' model='dac' relabel='yes'>
+    <label>+{{.UID}}:+{{.GID}}</label>
+  </seclabel>
+  {{end}}
+  {{if .UserNetworking}}
+  <qemu:commandline>
+    <qemu:arg value='-netdev'/>
+    <qemu:arg value='user,id=usernet0,hostfwd=tcp:127.0.0.1:{{.SSHPort}}-:{{guestSSHPort .}},hostfwd=tcp:127.0.0.1:{{.SessionEnginePort}}-:{{enginePort .}}{{range .PortForwards}}{{with portForward .}},hostfwd={{.Proto}}::{{.HostPort}}-:{{.GuestPort}}{{end}}{{end}}'/>
+    <qemu:arg value='-device'/>
+    <qemu:arg value='virtio-net-pci,netdev=usernet0'/>
+  </qemu:commandline>
+  {{end}}
 </domain>
-`
+{{define "bandwidth"}}{{with netBandwidth .}}<bandwidth>
+        {{with .Inbound}}<inbound average='{{.Average}}'{{if .Peak}} peak='{{.Peak}}'{{end}}{{if .Burst}} burst='{{.Burst}}'{{end}}/>{{end}}
+        {{with .Outbound}}<outbound average='{{.Average}}'{{if .Peak}} peak='{{.Peak}}'{{end}}{{if .Burst}} burst='{{.Burst}}'{{end}}/>{{end}}
+      </bandwidth>{{end}}{{end}}`
+
+// domainFeatureStates lists the features --kvm-feature toggles, and whether
+// they are rendered with a state attribute rather than present or absent.
+// Those with a state attribute are left to the hypervisor unless toggled.
+var domainFeatureStates = map[string]bool{
+	"acpi":   false,
+	"apic":   false,
+	"pae":    false,
+	"hyperv": false,
+	"smm":    true,
+	"vmport": true,
+}
+
+// domainFeature is an element of the domain features block
+type domainFeature struct {
+	Name string
+	// State is on or off for features with a state attribute
+	State string
+}
+
+// parseFeatureToggle parses a +NAME, -NAME or NAME feature toggle
+func parseFeatureToggle(spec string) (string, bool, error) {
+	name, on := strings.TrimLeft(spec, "+-"), !strings.HasPrefix(spec, "-")
+	if _, ok := domainFeatureStates[name]; !ok || len(spec)-len(name) > 1 {
+		return "", false, fmt.Errorf("Invalid feature %q, expected +NAME or -NAME with NAME one of acpi, apic, pae, hyperv, smm or vmport", spec)
+	}
+	return name, on, nil
+}
+
+// domainFeatures applies the feature toggles to the defaults: acpi on
+// aarch64, and acpi, apic and pae on x86_64
+func (d *Driver) domainFeatures() []domainFeature {
+	enabled := map[string]bool{"acpi": true}
+	if !d.isAArch64() {
+		enabled["apic"], enabled["pae"] = true, true
+	}
+	for _, spec := range d.Features {
+		if name, on, err := parseFeatureToggle(spec); err == nil {
+			enabled[name] = on
+		}
+	}
+
+	var features []domainFeature
+	for _, name := range []string{"acpi", "apic", "pae", "hyperv", "smm", "vmport"} {
+		on, toggled := enabled[name]
+		switch {
+		case domainFeatureStates[name] && toggled && on:
+			features = append(features, domainFeature{Name: name, State: "on"})
+		case domainFeatureStates[name] && toggled:
+			features = append(features, domainFeature{Name: name, State: "off"})
+		case on:
+			features = append(features, domainFeature{Name: name})
+		}
+	}
+	return features
+}
+
+// domainInterfacesXML is the part of the domain xml describing its interfaces
+type domainInterfacesXML struct {
+	Interfaces []struct {
+		Type string `xml:"type,attr"`
+		MAC  struct {
+			Address string `xml:"address,attr"`
+		} `xml:"mac"`
+		Source struct {
+			Network string `xml:"network,attr"`
+			Dev     string `xml:"dev,attr"`
+		} `xml:"source"`
+	} `xml:"devices>interface"`
+}
+
+var templateFuncs = template.FuncMap{
+	"pciAddress":      pciAddressAttrs,
+	"subnet":          subnet,
+	"dnsHost":         dnsHost,
+	"portForward":     parsePortForward,
+	"leaseExpiry":     leaseExpiry,
+	"natPortRange":    natPortRange,
+	"netBandwidth":    netBandwidth,
+	"storagePool":     (*Driver).storagePoolName,
+	"diskVolume":      (*Driver).diskVolumeName,
+	"diskFormat":      (*Driver).diskFormat,
+	"extraDiskVolume": (*Driver).extraDiskVolumeName,
+	"extraDiskLetter": extraDiskLetter,
+	"isoVolume":       (*Driver).isoVolumeName,
+	"rbdSource":       (*Driver).rbdSource,
+	"rbdMonitor":      rbdMonitor,
+	"seedISO":         (*Driver).seedISOPath,
+	"hasSeed":         (*Driver).hasSeed,
+	"mount":           parseMount,
+	"mountTag":        mountTag,
+	"enginePort":      (*Driver).enginePort,
+	"guestSSHPort":    (*Driver).guestSSHPort,
+	"qemuOwner":       (*Driver).qemuOwner,
+	"isAArch64":       (*Driver).isAArch64,
+	"domainType":      (*Driver).domainType,
+	"cpuFeature":      cpuFeature,
+	"domainFeatures":  (*Driver).domainFeatures,
+	"clockTimer":      clockTimer,
+	"iothread":        (*Driver).iothread,
+	"diskCache":       (*Driver).diskCache,
+	"diskIO":          (*Driver).diskIO,
+	"extraDiskIO":     (*Driver).extraDiskIO,
+	"clockOffset":     (*Driver).clockOffset,
+	"metadata":        (*Driver).metadataXML,
+	"domainMetadata":  (*Driver).domainMetadataXML,
+}
 
 func (d *Driver) getDomain() (*libvirt.Domain, *libvirt.Connect, error) {
-	conn, err := getConnection()
+	conn, err := d.getConnection()
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "getting domain")
 	}
 
 	dom, err := conn.LookupDomainByName(d.MachineName)
 	if err != nil {
+		conn.Close()
 		return nil, nil, errors.Wrap(err, "looking up domain")
 	}
 
 	return dom, conn, nil
 }
 
-func getConnection() (*libvirt.Connect, error) {
-	conn, err := libvirt.NewConnect(qemusystem)
+// getConnection returns a reference to the shared libvirt connection to the
+// configured hypervisor, which must be closed once done with
+func (d *Driver) getConnection() (*libvirt.Connect, error) {
+	uri := d.ConnectionURI
+	if uri == "" {
+		uri = qemusystem
+	}
+	conn, err := connections.get(uri)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error connecting to libvirt socket")
 	}
@@ -79,30 +387,78 @@ func getConnection() (*libvirt.Connect, error) {
 
 func closeDomain(dom *libvirt.Domain, conn *libvirt.Connect) error {
 	dom.Free()
-	if res, _ := conn.Close(); res != 0 {
-		return fmt.Errorf("Error closing connection CloseConnection() == %d, expected 0", res)
+	if _, err := conn.Close(); err != nil {
+		return errors.Wrap(err, "closing libvirt connection")
 	}
 	return nil
 }
 
-func (d *Driver) createDomain() (*libvirt.Domain, error) {
-	tmpl := template.Must(template.New("domain").Parse(domainTmpl))
-	var domainXml bytes.Buffer
-	err := tmpl.Execute(&domainXml, d)
-	if err != nil {
-		return nil, errors.Wrap(err, "executing domain xml")
+// renderXML executes one of the xml templates against data
+func renderXML(name, src string, data interface{}) (string, error) {
+	tmpl := template.Must(template.New(name).Funcs(templateFuncs).Parse(src))
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "executing %s xml", name)
 	}
+	return buf.String(), nil
+}
 
-	conn, err := getConnection()
+func (d *Driver) createDomain() (*libvirt.Domain, error) {
+	conn, err := d.getConnection()
 	if err != nil {
 		return nil, errors.Wrap(err, "Error getting libvirt connection")
 	}
 	defer conn.Close()
+	// A redefinition keeps the UUID, libvirt refuses another one for the
+	// same name, and the creation time
+	var uuid string
+	d.domainCreated = ""
+	if existing, err := conn.LookupDomainByName(d.MachineName); err == nil {
+		uuid, err = existing.GetUUIDString()
+		if err != nil {
+			existing.Free()
+			return nil, errors.Wrap(err, "getting domain uuid")
+		}
+		if desc, err := existing.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE); err == nil {
+			d.domainCreated = createdTime(desc)
+		}
+		existing.Free()
+	}
 
-	dom, err := conn.DomainDefineXML(domainXml.String())
+	domainXml, err := renderXML("domain", domainTmpl, d)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error defining domain xml: %s", domainXml.String())
+		return nil, err
+	}
+	if uuid != "" {
+		domainXml = strings.Replace(domainXml, "</name>", "</name>\n  <uuid>"+uuid+"</uuid>", 1)
+	}
+
+	var dom *libvirt.Domain
+	err = libvirtCall("define domain "+d.MachineName, func() (err error) {
+		dom, err = conn.DomainDefineXML(domainXml)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error defining domain xml: %s", domainXml)
 	}
 
 	return dom, nil
 }
+
+// consoleLogTail returns the last n lines of the serial console log, or an
+// empty string if the log can't be read.
+func (d *Driver) consoleLogTail(n int) string {
+	if d.ConsoleLog == "" {
+		return ""
+	}
+	out, err := ioutil.ReadFile(d.ConsoleLog)
+	if err != nil {
+		log.Debugf("Unable to read console log %s: %v", d.ConsoleLog, err)
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
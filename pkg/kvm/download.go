@@ -0,0 +1,164 @@
+package kvm
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/pkg/errors"
+)
+
+const (
+	downloadAttempts = 5
+	downloadBackoff  = 2 * time.Second
+	progressInterval = 5 * time.Second
+)
+
+// downloadClient honours HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+var downloadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	},
+}
+
+// httpStatusError is an unexpected HTTP response status
+type httpStatusError struct {
+	url  string
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("downloading %s: %s", e.url, http.StatusText(e.code))
+}
+
+// transient reports whether a failed download is worth retrying
+func transient(err error) bool {
+	if e, ok := errors.Cause(err).(*httpStatusError); ok {
+		return e.code >= 500 || e.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// downloadFile fetches src, a URL or local path, to dst. HTTP downloads go
+// through dst.part, which a later attempt resumes with a range request, and
+// transient failures are retried with exponential backoff.
+func downloadFile(src, dst string) error {
+	u, err := url.Parse(src)
+	if err != nil {
+		return errors.Wrapf(err, "parsing URL %s", src)
+	}
+	if u.Scheme == "" || u.Scheme == "file" {
+		log.Infof("Copying %s...", u.Path)
+		return mcnutils.CopyFile(u.Path, dst)
+	}
+
+	log.Infof("Downloading %s...", src)
+	part := dst + ".part"
+	backoff := downloadBackoff
+	for attempt := 1; ; attempt++ {
+		err := downloadPart(src, part)
+		if err == nil {
+			break
+		}
+		if !transient(err) || attempt == downloadAttempts {
+			return err
+		}
+		log.Warnf("Download of %s failed, retrying in %s: %v", src, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return os.Rename(part, dst)
+}
+
+// downloadPart fetches what is missing of part from src
+func downloadPart(src, part string) error {
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return errors.Wrapf(err, "building request for %s", src)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	total := resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		log.Infof("Resuming download at %d MB", offset/1024/1024)
+		flags |= os.O_APPEND
+		if total >= 0 {
+			total += offset
+		}
+	case http.StatusOK:
+		// The server ignored the range, start over
+		flags |= os.O_TRUNC
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset > 0 && resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset) {
+			return nil
+		}
+		return &httpStatusError{src, resp.StatusCode}
+	default:
+		return &httpStatusError{src, resp.StatusCode}
+	}
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return errors.Wrap(err, "opening download file")
+	}
+	defer f.Close()
+
+	p := &progressWriter{w: f, done: offset, total: total, last: time.Now()}
+	if _, err := io.Copy(p, resp.Body); err != nil {
+		return err
+	}
+	if total >= 0 && p.done != total {
+		return io.ErrUnexpectedEOF
+	}
+	return f.Sync()
+}
+
+// progressWriter logs how much of a download is done every
+// progressInterval
+type progressWriter struct {
+	w           io.Writer
+	done, total int64
+	last        time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	if time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		if p.total > 0 {
+			log.Infof("Downloaded %d%% (%d/%d MB)", p.done*100/p.total, p.done/1024/1024, p.total/1024/1024)
+		} else {
+			log.Infof("Downloaded %d MB", p.done/1024/1024)
+		}
+	}
+	return n, err
+}
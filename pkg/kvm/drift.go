@@ -0,0 +1,135 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+	"github.com/r2d4/docker-machine-driver-kvm/pkg/version"
+)
+
+// driftIgnored are the config fields that change while the machine lives
+// without touching its domain definition
+var driftIgnored = map[string]bool{
+	"IPAddress":     true,
+	"PortForwardIP": true,
+	"NetworkOwned":  true,
+	"CloneBase":     true,
+	"ConnectionURI": true,
+}
+
+// domainDrift lists how the defined domain differs from the one the
+// machine configuration renders: what adoption checks, the config fields
+// changed since the domain was defined, and another driver version, whose
+// template may differ
+func (d *Driver) domainDrift(desc string) ([]string, error) {
+	drift, err := d.domainMismatches(desc)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := parseMetadata(desc)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading domain metadata")
+	}
+	if meta == nil {
+		return append(drift, "the domain predates the driver metadata"), nil
+	}
+	if meta.Version != version.VERSION {
+		drift = append(drift, fmt.Sprintf("the domain was defined by driver version %s, this is %s", meta.Version, version.VERSION))
+	}
+	if meta.Config == "" {
+		return drift, nil
+	}
+
+	var defined, current map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(meta.Config), &defined); err != nil {
+		return nil, errors.Wrap(err, "decoding driver config of the domain")
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding driver config")
+	}
+	if err := json.Unmarshal(data, &current); err != nil {
+		return nil, errors.Wrap(err, "decoding driver config")
+	}
+	var changed []string
+	// Fields of a newer driver are missing from the old config, the version
+	// difference covers them
+	for field, value := range defined {
+		if now, ok := current[field]; ok && !driftIgnored[field] && !bytes.Equal(value, now) {
+			changed = append(changed, field)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		drift = append(drift, fmt.Sprintf("%s changed", strings.Join(changed, ", ")))
+	}
+	return drift, nil
+}
+
+// checkDrift compares the stopped domain with the machine configuration
+// before a start, redefining it with AutoRedefine or warning otherwise. A
+// domain with a saved state is left alone, the state needs its definition.
+func (d *Driver) checkDrift() error {
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return errors.Wrap(err, "getting connection")
+	}
+	defer closeDomain(dom, conn)
+	if active, err := dom.IsActive(); err != nil || active {
+		return nil
+	}
+	if saved, err := dom.HasManagedSaveImage(0); err != nil || saved {
+		return nil
+	}
+	desc, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return errors.Wrap(err, "getting domain xml")
+	}
+	drift, err := d.domainDrift(desc)
+	if err != nil {
+		log.Debugf("Unable to check domain %s for drift: %v", d.MachineName, err)
+		return nil
+	}
+	if len(drift) == 0 {
+		return nil
+	}
+
+	if !d.AutoRedefine {
+		log.Warnf("Domain %s differs from the machine configuration: %s. Run 'docker-machine-driver-kvm redefine %s' to apply it", d.MachineName, strings.Join(drift, ", "), d.MachineName)
+		return nil
+	}
+	log.Infof("Redefining domain %s: %s", d.MachineName, strings.Join(drift, ", "))
+	redefined, err := d.createDomain()
+	if err != nil {
+		return errors.Wrap(err, "redefining domain")
+	}
+	redefined.Free()
+	return nil
+}
+
+// Redefine replaces the definition of the stopped machine with the one its
+// configuration renders, applying configuration changes and the template of
+// this driver version
+func (d *Driver) Redefine() error {
+	s, err := d.GetState()
+	if err != nil {
+		return errors.Wrap(err, "getting state of VM")
+	}
+	if s != state.Stopped {
+		return errors.Errorf("Machine %s is %s, stop it before redefining it", d.MachineName, s)
+	}
+	log.Infof("Redefining domain %s...", d.MachineName)
+	dom, err := d.createDomain()
+	if err != nil {
+		return errors.Wrap(err, "redefining domain")
+	}
+	dom.Free()
+	return nil
+}
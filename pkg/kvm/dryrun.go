@@ -0,0 +1,33 @@
+package kvm
+
+import (
+	"fmt"
+	"io"
+)
+
+// DryRun writes the domain and network xml the driver would define for the
+// machine, without connecting to libvirt
+func (d *Driver) DryRun(w io.Writer) error {
+	type definition struct {
+		kind, name, src string
+	}
+	var defs []definition
+	if !d.UserNetworking {
+		if !d.SingleNetwork && !d.ExistingDefaultNetwork {
+			defs = append(defs, definition{"network", "default", defaultNetworkTmpl})
+		}
+		if d.NetworkMode != "direct" {
+			defs = append(defs, definition{"network", d.NetworkName, privateNetworkTmpl})
+		}
+	}
+	defs = append(defs, definition{"domain", d.MachineName, domainTmpl})
+
+	for _, def := range defs {
+		xml, err := renderXML(def.kind, def.src, d)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "<!-- %s %s -->%s\n", def.kind, def.name, xml)
+	}
+	return nil
+}
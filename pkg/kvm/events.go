@@ -0,0 +1,241 @@
+package kvm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// domainEventTracker keeps the state of domains up to date from libvirt
+// lifecycle events, so state checks don't need a round trip to libvirtd and
+// waits can wake up as soon as the state changes.
+type domainEventTracker struct {
+	mu       sync.Mutex
+	active   bool
+	states   map[string]state.State
+	watchers map[string][]chan struct{}
+	// crashes are why domains went into the Error state, as events tell
+	crashes map[string]string
+	// poweredOff are the domains the watchdog powered off, whose stop event
+	// looks like any other
+	poweredOff map[string]bool
+}
+
+var domainEvents = &domainEventTracker{
+	states:     map[string]state.State{},
+	watchers:   map[string][]chan struct{}{},
+	crashes:    map[string]string{},
+	poweredOff: map[string]bool{},
+}
+
+// register subscribes to the lifecycle events of every domain on conn.
+// Cached states are dropped since events may have been missed while the
+// previous connection was down.
+func (t *domainEventTracker) register(conn *libvirt.Connect) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.states = map[string]state.State{}
+	if _, err := conn.DomainEventLifecycleRegister(nil, t.lifecycleEvent); err != nil {
+		log.Debugf("Unable to register for domain events, falling back to polling: %v", err)
+		t.active = false
+		return
+	}
+	if _, err := conn.DomainEventWatchdogRegister(nil, t.watchdogEvent); err != nil {
+		log.Debugf("Unable to register for watchdog events: %v", err)
+	}
+	t.active = true
+}
+
+func (t *domainEventTracker) lifecycleEvent(c *libvirt.Connect, dom *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+	name, err := dom.GetName()
+	if err != nil {
+		return
+	}
+	log.Debugf("Domain %s lifecycle event %d, detail %d", name, event.Event, event.Detail)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch event.Event {
+	case libvirt.DOMAIN_EVENT_STARTED:
+		t.states[name] = state.Running
+		delete(t.crashes, name)
+		delete(t.poweredOff, name)
+	case libvirt.DOMAIN_EVENT_RESUMED:
+		t.states[name] = state.Running
+	case libvirt.DOMAIN_EVENT_SUSPENDED:
+		if libvirt.DomainEventSuspendedDetailType(event.Detail) == libvirt.DOMAIN_EVENT_SUSPENDED_WATCHDOG {
+			t.states[name] = state.Error
+		} else {
+			t.states[name] = state.Paused
+		}
+	case libvirt.DOMAIN_EVENT_STOPPED:
+		switch libvirt.DomainEventStoppedDetailType(event.Detail) {
+		case libvirt.DOMAIN_EVENT_STOPPED_SAVED:
+			t.states[name] = state.Saved
+		case libvirt.DOMAIN_EVENT_STOPPED_MIGRATED:
+			// It runs on another hypervisor now
+			delete(t.states, name)
+		case libvirt.DOMAIN_EVENT_STOPPED_CRASHED:
+			// on_crash destroyed it, after the crash event when pvpanic
+			// reported a panic
+			t.states[name] = state.Error
+			if t.crashes[name] == "" {
+				t.crashes[name] = crashReason("crashed")
+			}
+		default:
+			if t.poweredOff[name] {
+				t.states[name] = state.Error
+			} else {
+				t.states[name] = state.Stopped
+			}
+		}
+	case libvirt.DOMAIN_EVENT_PMSUSPENDED:
+		t.states[name] = state.Saved
+	case libvirt.DOMAIN_EVENT_CRASHED:
+		t.states[name] = state.Error
+		if libvirt.DomainEventCrashedDetailType(event.Detail) == libvirt.DOMAIN_EVENT_CRASHED_PANICKED {
+			t.crashes[name] = crashReason("kernel panic")
+		} else {
+			t.crashes[name] = crashReason("crashed")
+		}
+	default:
+		// Shutdown and definition changes don't say what the domain is
+		// doing now, so the next state check asks libvirt
+		delete(t.states, name)
+	}
+	t.notify(name)
+}
+
+// watchdogEvent puts domains the watchdog reset or powered off in the Error
+// state. The pause action shows in lifecycle events already.
+func (t *domainEventTracker) watchdogEvent(c *libvirt.Connect, dom *libvirt.Domain, event *libvirt.DomainEventWatchdog) {
+	name, err := dom.GetName()
+	if err != nil {
+		return
+	}
+	log.Debugf("Domain %s watchdog event, action %d", name, event.Action)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch event.Action {
+	case libvirt.DOMAIN_EVENT_WATCHDOG_RESET:
+		t.crashes[name] = crashReason("reset by the watchdog, the guest was not responding")
+	case libvirt.DOMAIN_EVENT_WATCHDOG_POWEROFF:
+		t.crashes[name] = crashReason("powered off by the watchdog, the guest was not responding")
+		t.poweredOff[name] = true
+	default:
+		return
+	}
+	t.states[name] = state.Error
+	t.notify(name)
+}
+
+// notify signals the watchers of a domain. The caller holds mu.
+func (t *domainEventTracker) notify(name string) {
+	for _, ch := range t.watchers[name] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// cached returns the last state seen for a domain, if events are tracked
+func (t *domainEventTracker) cached(name string) (state.State, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.active {
+		return state.None, false
+	}
+	s, ok := t.states[name]
+	return s, ok
+}
+
+// crashReason describes a crash seen now
+func crashReason(what string) string {
+	return fmt.Sprintf("%s at %s", what, time.Now().Format(time.RFC3339))
+}
+
+// crash returns why the domain went into the Error state, if an event told
+func (t *domainEventTracker) crash(name string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.crashes[name]
+}
+
+// store records a state read from libvirt directly
+func (t *domainEventTracker) store(name string, s state.State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.active {
+		t.states[name] = s
+	}
+}
+
+// watch returns a channel signalled on every event of the domain and a
+// function to stop watching
+func (t *domainEventTracker) watch(name string) (<-chan struct{}, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	t.watchers[name] = append(t.watchers[name], ch)
+
+	return ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		watchers := t.watchers[name]
+		for i, w := range watchers {
+			if w == ch {
+				t.watchers[name] = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (t *domainEventTracker) isActive() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// waitForState waits for the machine to reach want, waking up on lifecycle
+// events. The state is still polled now and then in case events are lost.
+func (d *Driver) waitForState(want state.State, timeout time.Duration) error {
+	events, stop := domainEvents.watch(d.MachineName)
+	defer stop()
+
+	poll := time.Second
+	if domainEvents.isActive() {
+		poll = 5 * time.Second
+	}
+
+	deadline := time.After(timeout)
+	for {
+		s, err := d.GetState()
+		if err != nil {
+			return err
+		}
+		if s == want {
+			return nil
+		}
+		log.Debugf("Waiting for machine to be %s, currently %s", want, s)
+
+		select {
+		case <-events:
+		case <-time.After(poll):
+		case <-deadline:
+			return fmt.Errorf("Machine is still %s after %s, expected %s", s, timeout, want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package kvm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+// exportedDomainXML is the file of an export holding the domain definition
+// of the source host, for reference: Import recreates the domain from the
+// machine configuration, as the paths and networks differ between hosts
+const exportedDomainXML = "domain.xml"
+
+// checkExportable verifies that everything the machine needs lives in its
+// directory, which is what an export carries
+func (d *Driver) checkExportable() error {
+	switch {
+	case d.isRemote():
+		return errors.New("Machines on remote hypervisors can't be exported")
+	case !d.ownsStoragePool() || d.RBDPool != "":
+		return errors.New("Only machines in their own storage pool can be exported")
+	case d.DiskDevice != "":
+		return errors.New("Machines on a host block device can't be exported")
+	case d.DiskSecretUUID != "":
+		return errors.New("Machines with an encrypted disk can't be exported")
+	case d.BaseImageURL != "":
+		return errors.New("Machines whose disk is backed by a base image can't be exported")
+	case d.LinkedCloneOf != "":
+		return errors.Errorf("Linked clones can't be exported, their disk is backed by the disk of %s", d.LinkedCloneOf)
+	}
+	return nil
+}
+
+// Export writes the stopped machine as a gzipped tarball of its directory,
+// with its disks, the driver config and the domain xml, under MachineName/
+func (d *Driver) Export(w io.Writer) error {
+	if err := d.checkExportable(); err != nil {
+		return err
+	}
+	s, err := d.GetState()
+	if err != nil {
+		return errors.Wrap(err, "getting state of VM")
+	}
+	if s != state.Stopped {
+		return errors.Errorf("Machine %s is %s, stop it before exporting", d.MachineName, s)
+	}
+
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return errors.Wrap(err, "getting domain")
+	}
+	domainXML, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	closeDomain(dom, conn)
+	if err != nil {
+		return errors.Wrap(err, "getting domain xml")
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err = tw.WriteHeader(&tar.Header{
+		Name: filepath.Join(d.MachineName, exportedDomainXML),
+		Mode: 0644,
+		Size: int64(len(domainXML)),
+	})
+	if err == nil {
+		_, err = io.WriteString(tw, domainXML)
+	}
+	if err != nil {
+		return errors.Wrap(err, "writing domain xml")
+	}
+
+	dir := d.ResolveStorePath(".")
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == exportedDomainXML {
+			return err
+		}
+		log.Infof("Exporting %s...", rel)
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.Join(d.MachineName, rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "exporting machine directory")
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "writing export")
+	}
+	return gz.Close()
+}
+
+// Import recreates the machine on this host once the export has been
+// unpacked into its directory: the storage pool over the directory, the
+// networks and the domain. The machine is left stopped.
+func (d *Driver) Import() error {
+	if err := d.checkExportable(); err != nil {
+		return err
+	}
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+	if dom, err := conn.LookupDomainByName(d.MachineName); err == nil {
+		dom.Free()
+		return errors.Errorf("Domain %s already exists on this host", d.MachineName)
+	}
+
+	pool, err := d.lookupStoragePool(conn)
+	if err != nil {
+		return err
+	}
+	// Pick up the disks unpacked into the pool directory
+	err = pool.Refresh(0)
+	pool.Free()
+	if err != nil {
+		return errors.Wrap(err, "refreshing storage pool")
+	}
+	paths := []string{d.ResolveStorePath("boot2docker.iso"), d.seedISOPath(), d.ResolveStorePath(d.diskVolumeName())}
+	for i := range d.ExtraDisks {
+		paths = append(paths, d.ResolveStorePath(d.extraDiskVolumeName(i)))
+	}
+	d.chownForQEMU(paths...)
+
+	if !d.UserNetworking {
+		// Ownership of the networks is the source host's
+		d.NetworkOwned = false
+		if err := d.setupNetworks(); err != nil {
+			return errors.Wrap(err, "creating network")
+		}
+	}
+
+	log.Infof("Defining domain %s...", d.MachineName)
+	dom, err := d.createDomain()
+	if err != nil {
+		return errors.Wrap(err, "defining domain")
+	}
+	dom.Free()
+	return nil
+}
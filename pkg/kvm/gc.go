@@ -0,0 +1,282 @@
+package kvm
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+// nvramDir is where libvirt keeps the UEFI variables of local domains
+const nvramDir = "/var/lib/libvirt/qemu/nvram"
+
+// CollectGarbage removes what failed creates and hand-deleted store entries
+// leave behind on the hypervisor at uri: domains and networks tagged for a
+// machine of storePath that is not in machines, the machine storage pools of such
+// machines under storePath with their volumes, and their NVRAM files. With
+// dryRun it only logs what it would remove.
+func CollectGarbage(uri, storePath string, machines []string, dryRun bool) error {
+	known := map[string]bool{}
+	for _, name := range machines {
+		known[name] = true
+	}
+	gc := &garbageCollector{
+		storePath: storePath,
+		uri:       uri,
+		known:     known,
+		orphans:   map[string]bool{},
+		dryRun:    dryRun,
+	}
+
+	conn, err := gc.machine("").getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+
+	var errs mcnutils.MultiError
+	// Domains go first, so the networks and volumes are no longer in use
+	for _, collect := range []func(*libvirt.Connect) error{gc.domains, gc.pools, gc.networks, gc.nvram} {
+		if err := collect(conn); err != nil {
+			errs.Errs = append(errs.Errs, err)
+		}
+	}
+	if len(errs.Errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+type garbageCollector struct {
+	storePath string
+	uri       string
+	known     map[string]bool
+	// orphans are the machines found without a store entry
+	orphans map[string]bool
+	dryRun  bool
+}
+
+// machine is a driver for a machine of the store, to reuse the cleanup of
+// its resources
+func (gc *garbageCollector) machine(name string) *Driver {
+	d := NewDriver(name, gc.storePath)
+	if gc.uri != "" {
+		d.ConnectionURI = gc.uri
+	}
+	return d
+}
+
+// isOrphan reports whether resources of the machine are garbage, recording
+// it for the later steps
+func (gc *garbageCollector) isOrphan(name string) bool {
+	if gc.known[name] {
+		return false
+	}
+	gc.orphans[name] = true
+	return true
+}
+
+// isOrphanTagged is isOrphan for a tagged resource, which must be tagged
+// for this store: other stores, and other users, share the hypervisor
+func (gc *garbageCollector) isOrphanTagged(meta *resourceMetadata) bool {
+	if meta == nil || meta.Store == "" || filepath.Clean(meta.Store) != filepath.Clean(gc.storePath) {
+		return false
+	}
+	return gc.isOrphan(meta.Name)
+}
+
+// domains removes the domains tagged for unknown machines of the store
+func (gc *garbageCollector) domains(conn *libvirt.Connect) error {
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return errors.Wrap(err, "listing domains")
+	}
+	var errs mcnutils.MultiError
+	for _, dom := range doms {
+		desc, err := dom.GetXMLDesc(0)
+		dom.Free()
+		if err != nil {
+			continue
+		}
+		meta, err := parseMetadata(desc)
+		if err != nil || !gc.isOrphanTagged(meta) {
+			continue
+		}
+		if gc.dryRun {
+			log.Infof("Would remove domain %s", meta.Name)
+			continue
+		}
+		if err := gc.machine(meta.Name).removeDomain(conn); err != nil {
+			errs.Errs = append(errs.Errs, errors.Wrapf(err, "removing domain %s", meta.Name))
+		}
+	}
+	if len(errs.Errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// poolXML is the part of a storage pool definition gc needs
+type poolXML struct {
+	Target struct {
+		Path string `xml:"path"`
+	} `xml:"target"`
+}
+
+// pools removes the machine storage pools, and the volumes in them, of
+// unknown machines. Only pools named and placed as the driver creates them
+// in the store are considered.
+func (gc *garbageCollector) pools(conn *libvirt.Connect) error {
+	pools, err := conn.ListAllStoragePools(0)
+	if err != nil {
+		return errors.Wrap(err, "listing storage pools")
+	}
+	var errs mcnutils.MultiError
+	for _, pool := range pools {
+		if err := gc.pool(pool); err != nil {
+			errs.Errs = append(errs.Errs, err)
+		}
+		pool.Free()
+	}
+	if len(errs.Errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (gc *garbageCollector) pool(pool libvirt.StoragePool) error {
+	poolName, err := pool.GetName()
+	if err != nil || !strings.HasSuffix(poolName, "-pool") {
+		return nil
+	}
+	name := strings.TrimSuffix(poolName, "-pool")
+	desc, err := pool.GetXMLDesc(0)
+	if err != nil {
+		return nil
+	}
+	var parsed poolXML
+	if err := xml.Unmarshal([]byte(desc), &parsed); err != nil {
+		return nil
+	}
+	if filepath.Clean(parsed.Target.Path) != gc.machine(name).ResolveStorePath(".") || !gc.isOrphan(name) {
+		return nil
+	}
+	if gc.dryRun {
+		log.Infof("Would remove storage pool %s and its volumes", poolName)
+		return nil
+	}
+
+	log.Infof("Removing storage pool %s...", poolName)
+	if active, _ := pool.IsActive(); active {
+		vols, err := pool.ListAllStorageVolumes(0)
+		if err != nil {
+			return errors.Wrapf(err, "listing volumes of storage pool %s", poolName)
+		}
+		for _, vol := range vols {
+			volName, _ := vol.GetName()
+			if err := libvirtCall("delete volume "+volName, func() error { return vol.Delete(0) }); err != nil {
+				log.Warnf("Unable to delete volume %s: %v", volName, err)
+			}
+			vol.Free()
+		}
+		pool.Destroy()
+	}
+	if err := libvirtCall("undefine storage pool "+poolName, pool.Undefine); err != nil {
+		return errors.Wrapf(err, "undefining storage pool %s", poolName)
+	}
+	return nil
+}
+
+// networks removes the networks tagged for unknown machines of the store
+// once no domain uses them. The default network is shared, and kept.
+func (gc *garbageCollector) networks(conn *libvirt.Connect) error {
+	networks, err := conn.ListAllNetworks(0)
+	if err != nil {
+		return errors.Wrap(err, "listing networks")
+	}
+	var errs mcnutils.MultiError
+	for _, network := range networks {
+		if err := gc.network(conn, network); err != nil {
+			errs.Errs = append(errs.Errs, err)
+		}
+		network.Free()
+	}
+	if len(errs.Errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (gc *garbageCollector) network(conn *libvirt.Connect, network libvirt.Network) error {
+	networkName, err := network.GetName()
+	if err != nil || networkName == "default" {
+		return nil
+	}
+	desc, err := network.GetXMLDesc(0)
+	if err != nil {
+		return nil
+	}
+	meta, err := parseMetadata(desc)
+	if err != nil || !gc.isOrphanTagged(meta) {
+		return nil
+	}
+
+	// An empty machine name counts every domain as another machine's
+	user := gc.machine("")
+	user.NetworkName = networkName
+	inUse, err := user.networkInUse(conn)
+	if err != nil {
+		return errors.Wrapf(err, "checking if network %s is in use", networkName)
+	}
+	switch {
+	case inUse:
+		log.Infof("Network %s of machine %s is used by other machines, keeping it", networkName, meta.Name)
+	case gc.dryRun:
+		log.Infof("Would remove network %s", networkName)
+	default:
+		log.Infof("Removing network %s...", networkName)
+		if active, _ := network.IsActive(); active {
+			network.Destroy()
+		}
+		if err := libvirtCall("undefine network "+networkName, network.Undefine); err != nil {
+			return errors.Wrapf(err, "undefining network %s", networkName)
+		}
+	}
+	return nil
+}
+
+// nvram removes the NVRAM files left by unknown machines whose domain is
+// already gone, on local hypervisors
+func (gc *garbageCollector) nvram(conn *libvirt.Connect) error {
+	if gc.machine("").isRemote() {
+		return nil
+	}
+	var errs mcnutils.MultiError
+	for name := range gc.orphans {
+		path := filepath.Join(nvramDir, name+"_VARS.fd")
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if dom, err := conn.LookupDomainByName(name); err == nil {
+			dom.Free()
+			continue
+		}
+		if gc.dryRun {
+			log.Infof("Would remove %s", path)
+			continue
+		}
+		log.Infof("Removing %s...", path)
+		if err := os.Remove(path); err != nil {
+			errs.Errs = append(errs.Errs, errors.Wrapf(err, "deleting %s", path))
+		}
+	}
+	if len(errs.Errs) > 0 {
+		return errs
+	}
+	return nil
+}
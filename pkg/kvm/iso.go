@@ -0,0 +1,200 @@
+package kvm
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/pkg/errors"
+)
+
+// isoCacheDir holds the ISOs shared by every machine of the host
+func (d *Driver) isoCacheDir() string {
+	if d.ISOCacheDir != "" {
+		return d.ISOCacheDir
+	}
+	return filepath.Join(d.StorePath, "cache", "kvm-iso")
+}
+
+// lockFile takes an exclusive lock on path, so that concurrent creates wait
+// for each other instead of downloading the same file twice
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening lock file")
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "locking")
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// cachedISO returns the cached copy of the ISO, downloading it on first use
+// or when refresh is set. Entries are keyed by the URL and the expected
+// checksum.
+func (d *Driver) cachedISO(refresh bool) (string, error) {
+	dir := d.isoCacheDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "creating ISO cache directory")
+	}
+	name := fmt.Sprintf("%x.iso", sha256.Sum256([]byte(d.IsoURL+"\x00"+d.ISOChecksum)))
+	path := filepath.Join(dir, name)
+
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return "", errors.Wrap(err, "locking ISO cache")
+	}
+	defer unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		if !refresh {
+			log.Debugf("Using cached ISO %s", path)
+			return path, nil
+		}
+		// Machines keep their hardlinks to the old copy
+		if err := os.Remove(path); err != nil {
+			return "", errors.Wrap(err, "removing cached ISO")
+		}
+	}
+
+	if err := downloadFile(d.IsoURL, path); err != nil {
+		return "", errors.Wrapf(err, "downloading ISO %s", d.IsoURL)
+	}
+	if d.ISOChecksum != "" {
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return "", errors.Wrap(err, "computing ISO checksum")
+		}
+		if !strings.EqualFold(sum, d.ISOChecksum) {
+			os.Remove(path)
+			return "", fmt.Errorf("ISO %s has checksum %s, expected %s", d.IsoURL, sum, d.ISOChecksum)
+		}
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		return "", errors.Wrap(err, "setting ISO permissions")
+	}
+
+	return path, nil
+}
+
+// localISOPath returns the path of an ISO given as an absolute path or a
+// file:// URL
+func (d *Driver) localISOPath() (string, bool) {
+	if strings.HasPrefix(d.IsoURL, "file://") {
+		u, err := url.Parse(d.IsoURL)
+		if err == nil {
+			return u.Path, true
+		}
+	}
+	if filepath.IsAbs(d.IsoURL) {
+		return d.IsoURL, true
+	}
+	return "", false
+}
+
+// checkISO verifies that path holds an ISO9660 image
+func checkISO(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening ISO")
+	}
+	defer f.Close()
+	magic := make([]byte, 5)
+	if _, err := f.ReadAt(magic, 16*isoSectorSize+1); err != nil || string(magic) != "CD001" {
+		return fmt.Errorf("%s is not an ISO9660 image", path)
+	}
+	return nil
+}
+
+// checkLocalISO verifies that a local ISO exists, is readable and matches
+// the expected checksum
+func (d *Driver) checkLocalISO() error {
+	path, ok := d.localISOPath()
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening local ISO")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "checking local ISO")
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("ISO %s is not a regular file", path)
+	}
+
+	if d.ISOChecksum != "" {
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return errors.Wrap(err, "computing ISO checksum")
+		}
+		if !strings.EqualFold(sum, d.ISOChecksum) {
+			return fmt.Errorf("ISO %s has checksum %s, expected %s", path, sum, d.ISOChecksum)
+		}
+	}
+
+	return nil
+}
+
+// copyISOToMachineDir hardlinks the ISO into the machine directory, falling
+// back to a copy when it is on another filesystem or goes to the qemu user.
+// Local ISOs are used as is, others go through the cache. The ISO in place
+// is only replaced by a valid one.
+func (d *Driver) copyISOToMachineDir(refresh bool) error {
+	cached, ok := d.localISOPath()
+	if !ok {
+		var err error
+		if cached, err = d.cachedISO(refresh); err != nil {
+			return err
+		}
+	}
+
+	// Checked before the ISO in place is removed, which a bad download
+	// mustn't replace
+	if err := checkISO(cached); err != nil {
+		return err
+	}
+
+	dst := d.ResolveStorePath("boot2docker.iso")
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing old ISO")
+	}
+	if d.qemuOwner() != nil && !d.isRemote() {
+		// The copy is given to the qemu user, a hardlink would give away the
+		// cache entry other machines link to
+		return mcnutils.CopyFile(cached, dst)
+	}
+	if err := os.Link(cached, dst); err != nil {
+		log.Debugf("Unable to hardlink %s, copying it: %v", cached, err)
+		return mcnutils.CopyFile(cached, dst)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The seed ISO is a plain ISO9660 image with every file in the root
+// directory, which is all cloud-init needs to find a NoCloud datasource.
+// Linux lowercases the level 1 names, so "USER-DATA;1" reads as user-data.
+
+const isoSectorSize = 2048
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+// padString fills b with s followed by spaces
+func padString(b []byte, s string) {
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+}
+
+func isoSectors(size int) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+// isoDirRecord builds a directory record for an extent
+func isoDirRecord(id []byte, extent, size uint32, dir bool, t time.Time) []byte {
+	length := 33 + len(id)
+	if length%2 == 1 {
+		length++
+	}
+	r := make([]byte, length)
+	r[0] = byte(length)
+	bothEndian32(r[2:], extent)
+	bothEndian32(r[10:], size)
+	r[18] = byte(t.Year() - 1900)
+	r[19] = byte(t.Month())
+	r[20] = byte(t.Day())
+	r[21] = byte(t.Hour())
+	r[22] = byte(t.Minute())
+	r[23] = byte(t.Second())
+	if dir {
+		r[25] = 2
+	}
+	bothEndian16(r[28:], 1)
+	r[32] = byte(len(id))
+	copy(r[33:], id)
+	return r
+}
+
+// isoDate formats a volume descriptor date
+func isoDate(t time.Time) []byte {
+	return append([]byte(t.Format("20060102150405")+"00"), 0)
+}
+
+// writeISO9660 writes an ISO9660 image labelled volumeID holding files
+func writeISO9660(path, volumeID string, files map[string][]byte) error {
+	t := time.Now().UTC()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Layout: system area, primary descriptor, terminator, L and M path
+	// tables, root directory, then the file extents
+	const (
+		pvdSector   = 16
+		lPathSector = 18
+		mPathSector = 19
+		rootSector  = 20
+	)
+	extent := uint32(rootSector + 1)
+	var records [][]byte
+	for _, name := range names {
+		id := []byte(strings.ToUpper(name) + ";1")
+		records = append(records, isoDirRecord(id, extent, uint32(len(files[name])), false, t))
+		extent += isoSectors(len(files[name]))
+	}
+	totalSectors := extent
+
+	img := make([]byte, int(totalSectors)*isoSectorSize)
+
+	root := img[rootSector*isoSectorSize:]
+	offset := 0
+	for _, r := range append([][]byte{
+		isoDirRecord([]byte{0}, rootSector, isoSectorSize, true, t),
+		isoDirRecord([]byte{1}, rootSector, isoSectorSize, true, t),
+	}, records...) {
+		offset += copy(root[offset:], r)
+	}
+
+	extent = rootSector + 1
+	for _, name := range names {
+		copy(img[extent*isoSectorSize:], files[name])
+		extent += isoSectors(len(files[name]))
+	}
+
+	// The path tables only hold the root directory
+	lPath := img[lPathSector*isoSectorSize:]
+	lPath[0] = 1
+	binary.LittleEndian.PutUint32(lPath[2:], rootSector)
+	binary.LittleEndian.PutUint16(lPath[6:], 1)
+	mPath := img[mPathSector*isoSectorSize:]
+	mPath[0] = 1
+	binary.BigEndian.PutUint32(mPath[2:], rootSector)
+	binary.BigEndian.PutUint16(mPath[6:], 1)
+	const pathTableSize = 10
+
+	pvd := img[pvdSector*isoSectorSize:]
+	pvd[0] = 1
+	copy(pvd[1:], "CD001")
+	pvd[6] = 1
+	padString(pvd[8:40], "LINUX")
+	padString(pvd[40:72], volumeID)
+	bothEndian32(pvd[80:], totalSectors)
+	bothEndian16(pvd[120:], 1)
+	bothEndian16(pvd[124:], 1)
+	bothEndian16(pvd[128:], isoSectorSize)
+	bothEndian32(pvd[132:], pathTableSize)
+	binary.LittleEndian.PutUint32(pvd[140:], lPathSector)
+	binary.BigEndian.PutUint32(pvd[148:], mPathSector)
+	copy(pvd[156:190], isoDirRecord([]byte{0}, rootSector, isoSectorSize, true, t))
+	padString(pvd[190:813], "")
+	copy(pvd[813:], isoDate(t))
+	copy(pvd[830:], isoDate(t))
+	copy(pvd[847:], append([]byte(strings.Repeat("0", 16)), 0))
+	copy(pvd[864:], isoDate(t))
+	pvd[881] = 1
+
+	term := img[(pvdSector+1)*isoSectorSize:]
+	term[0] = 255
+	copy(term[1:], "CD001")
+	term[6] = 1
+
+	return ioutil.WriteFile(path, img, 0644)
+}
@@ -9,31 +9,88 @@ package kvm
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
-	"github.com/docker/machine/libmachine/mcnutils"
 	"github.com/docker/machine/libmachine/state"
 	libvirt "github.com/libvirt/libvirt-go"
 	"github.com/pkg/errors"
 )
 
 const (
-	defaultIsoURL      = "https://storage.googleapis.com/minikube/iso/minikube-v0.20.0.iso"
-	defaultCPU         = 1
-	defaultDiskSize    = 20000
-	defaultMemory      = 2048
-	qemusystem         = "qemu:///system"
-	defaultCacheMode   = "threads"
-	defaultNetworkName = "minikube-net"
+	defaultIsoURL         = "https://storage.googleapis.com/minikube/iso/minikube-v0.20.0.iso"
+	defaultCPU            = 1
+	defaultDiskSize       = 20000
+	defaultMemory         = 2048
+	qemusystem            = "qemu:///system"
+	defaultStoragePool    = "default"
+	defaultDiskCache      = "default"
+	defaultDiskIO         = "threads"
+	defaultDiskController = "ide"
+	defaultPreallocation  = "off"
+	defaultNetworkName    = "minikube-net"
+	defaultNetworkCIDR    = "192.168.39.0/24"
+	// defaultNetworkCIDRPool is where per-machine networks get their subnet
+	defaultNetworkCIDRPool = "192.168.0.0/16"
+	defaultDisplay         = "none"
+	defaultVideoModel      = "qxl"
+	defaultVhost           = "auto"
+	defaultNetworkMode     = "network"
+	defaultDirectMode      = "bridge"
+	defaultIPMode          = "dhcp"
+	defaultForwardMode     = "isolated"
+	defaultStartTimeout    = 120
+	defaultSSHTimeout      = 180
+	defaultStopMethod      = "destroy"
+	defaultStopTimeout     = 60
+	defaultOnPoweroff      = "destroy"
+	defaultOnReboot        = "restart"
+	defaultOnCrash         = "destroy"
+	defaultEnginePort      = 2376
+	defaultSecLabel        = "dynamic"
+	defaultArch            = "x86_64"
+	defaultClockOffset     = "utc"
+	defaultSSHUser         = "docker"
+	defaultSSHPort         = 22
+	vhostNetDevice         = "/dev/vhost-net"
 )
 
 var defaultHostFolder = os.Getenv("HOME")
 
+// Name is the driver name registered with docker-machine and stored in
+// machine configs. It is set at build time with
+// -ldflags "-X github.com/r2d4/docker-machine-driver-kvm/pkg/kvm.Name=kvm2"
+// and overridden by KVM_DRIVER_NAME, so the binary can stand in for the kvm2
+// driver minikube expects.
+var Name = "kvm"
+
+// driverNames are the names the driver can register as
+var driverNames = []string{"kvm", "kvm2"}
+
+func init() {
+	if name := os.Getenv("KVM_DRIVER_NAME"); name != "" {
+		Name = name
+	}
+}
+
+// IsDriverName reports whether a machine config driver name is one this
+// driver can register as
+func IsDriverName(name string) bool {
+	for _, n := range driverNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 type Driver struct {
 	*drivers.BaseDriver
 
@@ -46,7 +103,333 @@ type Driver struct {
 	NetworkName string
 	DiskPath    string
 	ISO         string
-	CacheMode   string
+	// CacheMode is the disk cache mode of machines created before
+	// DiskCache, which mixed in io modes
+	CacheMode  string
+	ConsoleLog string
+
+	// DiskCache is the cache mode of the disks, default for the hypervisor
+	// default
+	DiskCache string
+	// DiskIO is the I/O mode of the disks: threads, native or io_uring
+	DiskIO string
+	// ExtraDiskIO is the I/O mode of the extra disks, when it differs
+	ExtraDiskIO string
+
+	// MemoryHardLimit, MemorySoftLimit and MemorySwapLimit cap the host
+	// memory, and memory plus swap, the qemu process of the machine takes, in
+	// MB. 0 leaves them unlimited.
+	MemoryHardLimit int
+	MemorySoftLimit int
+	MemorySwapLimit int
+	// DiskBytesSec and DiskIOPSSec throttle each disk to a total of bytes
+	// and I/O operations per second, 0 leaves it unthrottled
+	DiskBytesSec int
+	DiskIOPSSec  int
+
+	// Display is the graphics device given to the machine: none, vnc or spice
+	Display    string
+	VideoModel string
+
+	// Watchdog is the action taken by the i6300esb watchdog when the guest
+	// hangs: reset, poweroff or pause. Empty disables the watchdog.
+	Watchdog string
+
+	// SecLabel is how libvirt labels the machine for SELinux or AppArmor:
+	// dynamic (libvirt picks a label), none (no confinement) or custom, using
+	// SecLabelLabel. SecLabelModel picks the security driver, empty for the
+	// host default.
+	SecLabel      string
+	SecLabelModel string
+	SecLabelLabel string
+
+	// QEMUUser is the USER[:GROUP] qemu runs as on hosts with a dedicated
+	// qemu user, resolved to QEMUUID and QEMUGID. The images are owned by
+	// it and the domain gets a matching DAC label.
+	QEMUUser string
+	QEMUUID  int
+	QEMUGID  int
+
+	// CPUModel is a named CPU model, e.g. Skylake-Client, given to the guest
+	// instead of the hypervisor default
+	CPUModel string
+	// CPUFeatures are +FLAG or -FLAG toggles on top of CPUModel
+	CPUFeatures []string
+
+	// Features are +NAME or -NAME toggles of the domain features, e.g.
+	// -pae, +hyperv for Windows guests or -vmport
+	Features []string
+
+	// ClockOffset is utc or localtime, for guests expecting the RTC in
+	// local time
+	ClockOffset string
+	// Timers are NAME=on|off timer settings, or tsc=MODE
+	Timers []string
+	// TSCInvariant exposes an invariant TSC to the guest, for stable
+	// timings. Such machines can't be migrated.
+	TSCInvariant bool
+	// NoClockSync leaves the guest clock alone after a resume or a restore,
+	// instead of setting it to the host time through the guest agent
+	NoClockSync bool
+
+	// Arch is the guest architecture, x86_64 or aarch64. aarch64 guests use
+	// the virt machine type with UEFI firmware and virtio-scsi disks.
+	Arch string
+
+	// AllowTCG falls back to software emulation when the hypervisor can't
+	// run KVM guests, instead of failing
+	AllowTCG bool
+	// TCG is set when the domain was created without KVM acceleration
+	TCG bool
+
+	// Emulator is the qemu binary run for the domain, instead of the one
+	// libvirt picks
+	Emulator string
+
+	// Autostart marks the domain to be started by libvirtd on host boot
+	Autostart bool
+
+	// MAC and PrivateMAC pin the addresses of the default and private
+	// network interfaces. Empty lets libvirt generate one.
+	MAC        string
+	PrivateMAC string
+
+	// MTU of the driver-created networks and interfaces, 0 keeps the default
+	MTU int
+
+	// ForwardMode is how the private network reaches outside the host: nat,
+	// route, open or isolated
+	ForwardMode string
+	// NATPortRange is the START-END range of source ports the NAT networks
+	// the driver creates map connections to
+	NATPortRange string
+
+	// Vhost controls vhost-net acceleration of the interfaces: auto leaves
+	// the choice to libvirt, on forces the vhost backend and off forces the
+	// userspace qemu backend.
+	Vhost string
+
+	// NetBandwidth caps the traffic of the machine interfaces, as
+	// DIRECTION=AVERAGE[:PEAK[:BURST]] entries
+	NetBandwidth []string
+
+	// SRIOVVF is the PCI address of an SR-IOV virtual function passed
+	// through to the machine as an additional interface
+	SRIOVVF string
+
+	// NetworkMode selects how the second interface is attached: network
+	// uses the private libvirt network, direct uses a macvtap interface on
+	// DirectDevice so the machine gets an address on the physical LAN.
+	NetworkMode  string
+	DirectDevice string
+	DirectMode   string
+
+	// ExtraNetworks are existing libvirt networks attached as additional
+	// interfaces after the default and private ones
+	ExtraNetworks []string
+
+	// ExistingDefaultNetwork only uses the libvirt default network if it
+	// already exists instead of defining it. SingleNetwork drops the default
+	// network interface altogether.
+	ExistingDefaultNetwork bool
+	SingleNetwork          bool
+
+	// PrivateNetworkCIDR is the subnet of the private network. When it is
+	// taken, a free /24 is picked from PrivateNetworkCIDRPool if set. With
+	// PerMachineNetwork each machine gets its own <machine>-net network on a
+	// free subnet, which is torn down with the machine.
+	PrivateNetworkCIDR     string
+	PrivateNetworkCIDRPool string
+	PerMachineNetwork      bool
+
+	// StaticIP is reserved for PrivateMAC in the private network's DHCP
+	// server so the machine keeps the same address across restarts
+	StaticIP string
+	// DHCPHostname reserves StaticIP, or a free address when it's not
+	// set, with the machine name as hostname, which the guest receives over
+	// DHCP and dnsmasq resolves
+	DHCPHostname bool
+
+	// IPMode is dhcp, or static to skip DHCP entirely: the private network
+	// is defined without a DHCP server and the StaticIP configuration is
+	// shipped to the guest in the network-config of the cloud-init seed
+	IPMode string
+
+	// DNS settings of the private network: upstream forwarders, a local
+	// domain answered by dnsmasq and extra IP=HOSTNAME[,HOSTNAME] entries
+	DNSForwarders []string
+	DNSDomain     string
+	DNSHosts      []string
+	// DHCPOptions are dnsmasq dhcp-option values the private network pushes
+	// to its guests, such as option:ntp-server,IP
+	DHCPOptions []string
+	// DHCPLeaseTime is the duration of the private network DHCP leases, or
+	// infinite
+	DHCPLeaseTime string
+
+	// PortForwards are HOSTPORT:GUESTPORT[/PROTO] forwards set up with
+	// iptables while the machine runs. PortForwardIP is the guest address
+	// the installed rules point to.
+	PortForwards  []string
+	PortForwardIP string
+
+	// StartTimeout and SSHTimeout bound, in seconds, the waits for the
+	// machine to get an IP and for SSH to come up. URLTimeout, when set,
+	// replaces SSHTimeout in GetURL, which docker-machine ls calls.
+	StartTimeout int
+	SSHTimeout   int
+	URLTimeout   int
+	// AgentTimeout, when set, has Start wait as many seconds for the qemu
+	// guest agent to answer once SSH is up
+	AgentTimeout int
+
+	// NetworkOwned is set when the driver defined the private network. It
+	// only matters for networks without the driver metadata, which older
+	// releases created: the metadata tells which networks Remove may tear
+	// down.
+	NetworkOwned bool
+
+	// ConnectionURI is the libvirt hypervisor to manage, which may be remote
+	// (qemu+ssh://user@host/system), in which case the ISO is uploaded too
+	// and the machine is reached on the LAN through a direct interface.
+	// The disk is a volume of StoragePool, or of a pool of the machine's own
+	// on its store directory when empty.
+	ConnectionURI string
+	StoragePool   string
+
+	// Client certificate, key and CA used with qemu+tls:// URIs. They are
+	// copied into the machine store, which the URI's pkipath points to.
+	TLSCACert     string
+	TLSClientCert string
+	TLSClientKey  string
+
+	// UserNetworking is used on qemu:///session, where bridges can't be
+	// created: the machine gets a user-mode network and is reached through
+	// host forwards of SSHPort and SessionEnginePort on localhost
+	UserNetworking    bool
+	SessionEnginePort int
+
+	// EnginePort is where the Docker daemon, or a proxy in front of it,
+	// listens in the guest
+	EnginePort int
+
+	// GuestSSHPort is where sshd listens in the guest. It is also SSHPort,
+	// unless user-mode networking forwards a localhost port to it. The
+	// SSHUser and SSHKeyPath of the base driver are configurable too.
+	GuestSSHPort int
+
+	// SSHKeySource is an existing private key copied into the machine
+	// directory instead of generating one. With SSHAgent the machine accepts
+	// the keys of the running ssh-agent, which the ssh client then uses.
+	SSHKeySource string
+	SSHAgent     bool
+
+	// BaseImageURL is a qcow2 image cached once on the host, of which the
+	// machine disk is a linked clone (qcow2 overlay)
+	BaseImageURL string
+
+	// ExtraDisks are the sizes in MB of data disks attached as vdb, vdc...
+	ExtraDisks []int
+
+	// DiskController is the bus of the machine disks, ide or virtio-scsi;
+	// virtio-scsi passes guest discards through to the host image
+	DiskController string
+
+	// DiskPreallocation is how much of the disk is allocated up front: off
+	// (sparse), metadata (qcow2 only), falloc or full (raw only)
+	DiskPreallocation string
+
+	// DiskDevice is an existing block device or LV used as the machine disk
+	// instead of a volume
+	DiskDevice string
+
+	// RBDPool is the Ceph pool holding the machine disks, reached through
+	// RBDMonitors and authenticated with RBDUser and the libvirt
+	// secret RBDSecretUUID
+	RBDPool       string
+	RBDMonitors   []string
+	RBDUser       string
+	RBDSecretUUID string
+
+	// DiskEncrypt creates the machine disk LUKS-encrypted, with the
+	// passphrase in the libvirt secret DiskSecretUUID
+	DiskEncrypt    bool
+	DiskSecretUUID string
+
+	// ISOCacheDir is the host-level ISO cache shared by machines, and
+	// ISOChecksum the expected SHA-256 of the ISO
+	ISOCacheDir string
+	ISOChecksum string
+
+	// CloudInit boots BaseImageURL as a generic cloud image, provisioned by
+	// cloud-init from a NoCloud seed instead of the boot2docker ISO
+	CloudInit bool
+
+	// UserDataFile is extra cloud-init user-data, put on a NoCloud seed
+	// together with the generated one
+	UserDataFile string
+
+	// Mounts are HOSTDIR:GUESTDIR shares mounted over 9p when the machine
+	// starts
+	Mounts []string
+
+	// KeepDisk and KeepNetwork leave the disks and the private network in
+	// place when the machine is removed
+	KeepDisk    bool
+	KeepNetwork bool
+
+	// NoRollback leaves the resources of a failed Create in place, for
+	// debugging
+	NoRollback bool
+
+	// SaveState makes Stop save the machine memory to disk (managed save)
+	// instead of shutting it down
+	SaveState bool
+	// StopMethod is how Stop shuts the machine down: acpi or agent for a
+	// clean shutdown of the guest, destroy to terminate qemu. StopTimeout
+	// bounds, in seconds, the wait for the machine to stop, after which a
+	// clean shutdown falls back to destroy.
+	StopMethod  string
+	StopTimeout int
+	// OnPoweroff, OnReboot and OnCrash are what libvirt does when the guest
+	// powers off, reboots or crashes: destroy, restart or preserve
+	OnPoweroff string
+	OnReboot   string
+	OnCrash    string
+	// AutoRestart has the supervise command start the machine again when
+	// it finds it crashed, unless it was stopped since
+	AutoRestart bool
+
+	// MaxCPU is the number of vCPU slots, allowing CPU to be raised up to
+	// it on a running machine
+	MaxCPU int
+
+	// IOThreads is the number of I/O threads of the domain. The virtio-scsi
+	// controller runs on the first one, virtio extra disks are spread over
+	// all of them.
+	IOThreads int
+
+	// AdoptExisting makes Create take over a matching domain of the
+	// machine name instead of failing. Its guest must already accept the
+	// SSH key.
+	AdoptExisting bool
+	// AutoRedefine makes Start redefine a domain that differs from the
+	// machine configuration, instead of warning about it
+	AutoRedefine bool
+
+	// LinkedCloneOf is the machine whose disk backs the disk of this linked
+	// clone
+	LinkedCloneOf string
+	// CloneBase is set on machines with linked clones, which must not be
+	// started: writes to their disk would corrupt the clones
+	CloneBase bool
+
+	// createdVolumes are the volumes Create made, the only ones its rollback
+	// deletes
+	createdVolumes []string
+	// domainCreated is the creation time of the domain being redefined,
+	// which its new metadata keeps
+	domainCreated string
 }
 
 func NewDriver(hostName, storePath string) *Driver {
@@ -55,37 +438,1239 @@ func NewDriver(hostName, storePath string) *Driver {
 			MachineName: hostName,
 			StorePath:   storePath,
 		},
-		IsoURL:      defaultIsoURL,
-		CPU:         defaultCPU,
-		DiskSize:    defaultDiskSize,
-		Memory:      defaultMemory,
-		NetworkName: defaultNetworkName,
-		DiskPath:    storePath,
-		CacheMode:   defaultCacheMode,
+		IsoURL:            defaultIsoURL,
+		CPU:               defaultCPU,
+		DiskSize:          defaultDiskSize,
+		Memory:            defaultMemory,
+		NetworkName:       defaultNetworkName,
+		DiskPath:          storePath,
+		DiskCache:         defaultDiskCache,
+		DiskIO:            defaultDiskIO,
+		DiskController:    defaultDiskController,
+		DiskPreallocation: defaultPreallocation,
+		Display:           defaultDisplay,
+		SecLabel:          defaultSecLabel,
+		Arch:              defaultArch,
+		ClockOffset:       defaultClockOffset,
+		VideoModel:        defaultVideoModel,
+		Vhost:             defaultVhost,
+		NetworkMode:       defaultNetworkMode,
+		DirectMode:        defaultDirectMode,
+
+		OnPoweroff: defaultOnPoweroff,
+		OnReboot:   defaultOnReboot,
+		OnCrash:    defaultOnCrash,
+
+		PrivateNetworkCIDR: defaultNetworkCIDR,
+		IPMode:             defaultIPMode,
+		ForwardMode:        defaultForwardMode,
+		StartTimeout:       defaultStartTimeout,
+		SSHTimeout:         defaultSSHTimeout,
+		StopMethod:         defaultStopMethod,
+		StopTimeout:        defaultStopTimeout,
+		EnginePort:         defaultEnginePort,
+		GuestSSHPort:       defaultSSHPort,
+		ConnectionURI:      qemusystem,
+	}
+}
+
+func (d *Driver) GetCreateFlags() []mcnflag.Flag {
+	return []mcnflag.Flag{
+		mcnflag.IntFlag{
+			Name:   "kvm-memory",
+			Usage:  "Size of memory for host in MB",
+			EnvVar: "KVM_MEMORY",
+			Value:  defaultMemory,
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-memory-hard-limit",
+			Usage:  "Host memory in MB the machine's qemu process can't exceed, leave room above --kvm-memory for qemu itself (0 for no limit)",
+			EnvVar: "KVM_MEMORY_HARD_LIMIT",
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-memory-soft-limit",
+			Usage:  "Host memory in MB the machine's qemu process is pushed back to under memory contention (0 for no limit)",
+			EnvVar: "KVM_MEMORY_SOFT_LIMIT",
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-memory-swap-limit",
+			Usage:  "Host memory plus swap in MB the machine's qemu process can't exceed (0 for no limit)",
+			EnvVar: "KVM_MEMORY_SWAP_LIMIT",
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-cpu-count",
+			Usage:  "Number of CPUs",
+			EnvVar: "KVM_CPU_COUNT",
+			Value:  defaultCPU,
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-disk-size",
+			Usage:  "Size of disk for host in MB",
+			EnvVar: "KVM_DISK_SIZE",
+			Value:  defaultDiskSize,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-iso-url",
+			Usage:  "The URL of the boot2docker image, or a local path or file:// URL",
+			EnvVar: "KVM_ISO_URL",
+			Value:  defaultIsoURL,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-network",
+			Usage:  "Name of the private network to attach",
+			EnvVar: "KVM_NETWORK",
+			Value:  defaultNetworkName,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-cache-mode",
+			Usage:  "Deprecated, use --kvm-disk-cache or --kvm-disk-io",
+			EnvVar: "KVM_CACHE_MODE",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-disk-cache",
+			Usage:  "Disk cache mode: default, none, writethrough, writeback, directsync or unsafe",
+			EnvVar: "KVM_DISK_CACHE",
+			Value:  defaultDiskCache,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-disk-io",
+			Usage:  "Disk I/O mode: threads, native (with --kvm-disk-cache none or directsync) or io_uring (libvirt 6.3 and qemu 5.0)",
+			EnvVar: "KVM_DISK_IO",
+			Value:  defaultDiskIO,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-extra-disk-io",
+			Usage:  "I/O mode of the extra disks, when it differs from --kvm-disk-io",
+			EnvVar: "KVM_EXTRA_DISK_IO",
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-disk-bytes-sec",
+			Usage:  "Throttle each disk to this many bytes per second, read and write together (0 for no limit)",
+			EnvVar: "KVM_DISK_BYTES_SEC",
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-disk-iops-sec",
+			Usage:  "Throttle each disk to this many I/O operations per second, read and write together (0 for no limit)",
+			EnvVar: "KVM_DISK_IOPS_SEC",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-display",
+			Usage:  "Graphics device for the VM: none, vnc or spice",
+			EnvVar: "KVM_DISPLAY",
+			Value:  defaultDisplay,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-video-model",
+			Usage:  "Video device model used with SPICE: qxl or virtio",
+			EnvVar: "KVM_VIDEO_MODEL",
+			Value:  defaultVideoModel,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-watchdog",
+			Usage:  "Add a watchdog device with the given action: reset, poweroff or pause",
+			EnvVar: "KVM_WATCHDOG",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-seclabel",
+			Usage:  "Security labelling of the VM: dynamic, none or custom (with --kvm-seclabel-label)",
+			EnvVar: "KVM_SECLABEL",
+			Value:  defaultSecLabel,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-seclabel-model",
+			Usage:  "Security driver of the label: selinux or apparmor (default: the host's)",
+			EnvVar: "KVM_SECLABEL_MODEL",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-seclabel-label",
+			Usage:  "Static security label of the VM with --kvm-seclabel=custom, e.g. system_u:system_r:svirt_t:s0:c10,c20",
+			EnvVar: "KVM_SECLABEL_LABEL",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-qemu-user",
+			Usage:  "USER[:GROUP] qemu runs as; the images are owned by it (numeric ids on remote hypervisors)",
+			EnvVar: "KVM_QEMU_USER",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-cpu-model",
+			Usage:  "Named CPU model of the guest, e.g. Skylake-Client or EPYC, for the same CPU features on every host",
+			EnvVar: "KVM_CPU_MODEL",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-cpu-feature",
+			Usage:  "CPU feature to require (+FLAG) or disable (-FLAG) on top of --kvm-cpu-model (can be repeated)",
+			EnvVar: "KVM_CPU_FEATURE",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-feature",
+			Usage:  "Domain feature to enable (+NAME) or disable (-NAME): acpi, apic, pae, hyperv, smm or vmport (can be repeated)",
+			EnvVar: "KVM_FEATURE",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-clock-offset",
+			Usage:  "Offset of the guest clock: utc, or localtime",
+			EnvVar: "KVM_CLOCK_OFFSET",
+			Value:  defaultClockOffset,
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-timer",
+			Usage:  "Guest timer as NAME=on|off, NAME one of kvmclock, hypervclock, hpet, pit, rtc or tsc, or tsc=MODE (can be repeated)",
+			EnvVar: "KVM_TIMER",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-tsc-invariant",
+			Usage:  "Expose an invariant TSC to the guest, for stable timings; the machine can't be migrated",
+			EnvVar: "KVM_TSC_INVARIANT",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-no-clock-sync",
+			Usage:  "Don't set the guest clock through the guest agent after a resume or a restore of a saved state",
+			EnvVar: "KVM_NO_CLOCK_SYNC",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-arch",
+			Usage:  "Guest architecture: x86_64, or aarch64 for ARM hosts",
+			EnvVar: "KVM_ARCH",
+			Value:  defaultArch,
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-allow-tcg",
+			Usage:  "Fall back to (slow) software emulation when KVM is not available",
+			EnvVar: "KVM_ALLOW_TCG",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-emulator",
+			Usage:  "Path of the qemu binary on the hypervisor, e.g. /usr/libexec/qemu-kvm",
+			EnvVar: "KVM_EMULATOR",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-autostart",
+			Usage:  "Start the VM automatically when the host boots",
+			EnvVar: "KVM_AUTOSTART",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-mac",
+			Usage:  "MAC address of the interface on the default network",
+			EnvVar: "KVM_MAC",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-private-mac",
+			Usage:  "MAC address of the interface on the private network",
+			EnvVar: "KVM_PRIVATE_MAC",
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-mtu",
+			Usage:  "MTU of the networks and interfaces created by the driver",
+			EnvVar: "KVM_MTU",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-network-forward-mode",
+			Usage:  "Forward mode of the private network: isolated, nat, route, or open for routing without firewall rules. An existing private network must already use it",
+			EnvVar: "KVM_NETWORK_FORWARD_MODE",
+			Value:  defaultForwardMode,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-nat-port-range",
+			Usage:  "Source port range START-END of the NAT networks created by the driver. Existing networks must already use it",
+			EnvVar: "KVM_NAT_PORT_RANGE",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-vhost",
+			Usage:  "vhost-net acceleration of the interfaces: auto, on or off. Use off in nested or unprivileged environments",
+			EnvVar: "KVM_VHOST",
+			Value:  defaultVhost,
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-net-bandwidth",
+			Usage:  "Traffic cap of the machine interfaces, as inbound|outbound=AVERAGE[:PEAK[:BURST]] with rates in KiB/s and burst in KiB (can be repeated)",
+			EnvVar: "KVM_NET_BANDWIDTH",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-sriov-vf",
+			Usage:  "Attach an SR-IOV virtual function, given as a VF PCI address or the host PF interface to pick a free VF from",
+			EnvVar: "KVM_SRIOV_VF",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-network-mode",
+			Usage:  "How to attach the second interface: network (private libvirt network) or direct (macvtap)",
+			EnvVar: "KVM_NETWORK_MODE",
+			Value:  defaultNetworkMode,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-direct-dev",
+			Usage:  "Host interface used by the direct network mode",
+			EnvVar: "KVM_DIRECT_DEV",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-direct-mode",
+			Usage:  "macvtap mode used by the direct network mode: bridge, vepa, private or passthrough",
+			EnvVar: "KVM_DIRECT_MODE",
+			Value:  defaultDirectMode,
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-extra-network",
+			Usage:  "Attach an additional interface to an existing libvirt network (can be repeated)",
+			EnvVar: "KVM_EXTRA_NETWORK",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-existing-default-network",
+			Usage:  "Only use the libvirt default network if it already exists, never define it",
+			EnvVar: "KVM_EXISTING_DEFAULT_NETWORK",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-single-network",
+			Usage:  "Only attach the private network, without an interface on the default network",
+			EnvVar: "KVM_SINGLE_NETWORK",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-network-cidr",
+			Usage:  "Subnet of the private network",
+			EnvVar: "KVM_NETWORK_CIDR",
+			Value:  defaultNetworkCIDR,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-network-cidr-pool",
+			Usage:  "Pick a free /24 from this range when the private network subnet is taken",
+			EnvVar: "KVM_NETWORK_CIDR_POOL",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-per-machine-network",
+			Usage:  "Give the machine its own private network named <machine>-net",
+			EnvVar: "KVM_PER_MACHINE_NETWORK",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-static-ip",
+			Usage:  "Reserve this address for the machine in the private network's DHCP server",
+			EnvVar: "KVM_STATIC_IP",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-dhcp-hostname",
+			Usage:  "Give the machine its name as hostname over DHCP, reserving it an address in the private network",
+			EnvVar: "KVM_DHCP_HOSTNAME",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-ip-mode",
+			Usage:  "How the machine gets its private address: dhcp, or static to configure --kvm-static-ip in the guest without DHCP (needs --kvm-cloud-init)",
+			EnvVar: "KVM_IP_MODE",
+			Value:  defaultIPMode,
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-dns-forwarder",
+			Usage:  "Upstream DNS server used by the private network (can be repeated)",
+			EnvVar: "KVM_DNS_FORWARDER",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-dns-domain",
+			Usage:  "Local DNS domain of the private network",
+			EnvVar: "KVM_DNS_DOMAIN",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-dns-host",
+			Usage:  "DNS host entry of the private network as IP=HOSTNAME[,HOSTNAME...] (can be repeated)",
+			EnvVar: "KVM_DNS_HOST",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-dhcp-option",
+			Usage:  "DHCP option the private network pushes to the guest, as a dnsmasq dhcp-option value such as option:ntp-server,IP (can be repeated, needs libvirt 5.6). An existing private network must already push it",
+			EnvVar: "KVM_DHCP_OPTION",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-dhcp-lease-time",
+			Usage:  "Duration of the private network DHCP leases, such as 12h, or infinite (needs libvirt 6.3). An existing private network must already use it",
+			EnvVar: "KVM_DHCP_LEASE_TIME",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-port-forward",
+			Usage:  "Forward a host port to the machine as HOSTPORT:GUESTPORT[/PROTO] (can be repeated)",
+			EnvVar: "KVM_PORT_FORWARD",
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-start-timeout",
+			Usage:  "Seconds to wait for the machine to get an IP",
+			EnvVar: "KVM_START_TIMEOUT",
+			Value:  defaultStartTimeout,
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-ssh-timeout",
+			Usage:  "Seconds to wait for SSH to be available",
+			EnvVar: "KVM_SSH_TIMEOUT",
+			Value:  defaultSSHTimeout,
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-agent-timeout",
+			Usage:  "Seconds Start waits for the qemu guest agent once SSH is up, 0 doesn't wait for it",
+			EnvVar: "KVM_AGENT_TIMEOUT",
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-url-timeout",
+			Usage:  "Seconds GetURL waits for SSH, defaults to --kvm-ssh-timeout",
+			EnvVar: "KVM_URL_TIMEOUT",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-connection-uri",
+			Usage:  "libvirt URI of the hypervisor, e.g. qemu+ssh://user@host/system; a remote one needs --kvm-network-mode direct",
+			EnvVar: "KVM_CONNECTION_URI",
+			Value:  qemusystem,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-storage-pool",
+			Usage:  "Existing libvirt storage pool for the disk and ISO, instead of a pool on the machine store directory",
+			EnvVar: "KVM_STORAGE_POOL",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-base-image",
+			Usage:  "URL or path of a qcow2 base image; the disk is created as a linked clone of its cached copy (needs --kvm-cloud-init)",
+			EnvVar: "KVM_BASE_IMAGE",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-extra-disk",
+			Usage:  "Size in MB of an additional virtio data disk (can be repeated)",
+			EnvVar: "KVM_EXTRA_DISK",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-disk-controller",
+			Usage:  "Disk controller: ide or virtio-scsi (with discard/unmap)",
+			Value:  defaultDiskController,
+			EnvVar: "KVM_DISK_CONTROLLER",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-disk-preallocation",
+			Usage:  "Disk preallocation: off, metadata, falloc or full",
+			Value:  defaultPreallocation,
+			EnvVar: "KVM_DISK_PREALLOCATION",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-disk-device",
+			Usage:  "Existing block device or LVM logical volume to use as the machine disk; its contents are overwritten",
+			EnvVar: "KVM_DISK_DEVICE",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-rbd-pool",
+			Usage:  "Ceph pool holding the machine disks as RBD images",
+			EnvVar: "KVM_RBD_POOL",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-rbd-monitor",
+			Usage:  "Ceph monitor as HOST[:PORT] (can be repeated)",
+			EnvVar: "KVM_RBD_MONITOR",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-rbd-user",
+			Usage:  "Ceph user for the RBD images",
+			EnvVar: "KVM_RBD_USER",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-rbd-secret",
+			Usage:  "UUID of the libvirt ceph secret holding the key of --kvm-rbd-user",
+			EnvVar: "KVM_RBD_SECRET",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-disk-encrypt",
+			Usage:  "Encrypt the machine disk with LUKS, keeping the passphrase in a libvirt secret (needs --kvm-cloud-init)",
+			EnvVar: "KVM_DISK_ENCRYPT",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-iso-cache-dir",
+			Usage:  "Directory of the ISO cache shared by machines (default: <store>/cache/kvm-iso)",
+			EnvVar: "KVM_ISO_CACHE_DIR",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-iso-checksum",
+			Usage:  "Expected SHA-256 of the ISO",
+			EnvVar: "KVM_ISO_CHECKSUM",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-cloud-init",
+			Usage:  "Boot --kvm-base-image as a cloud image provisioned by cloud-init, instead of the boot2docker ISO",
+			EnvVar: "KVM_CLOUD_INIT",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-user-data",
+			Usage:  "File of cloud-init user-data (cloud-config or script) added to the machine NoCloud seed",
+			EnvVar: "KVM_USER_DATA",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "kvm-mount",
+			Usage:  "Share a host directory with the machine over 9p as HOSTDIR:GUESTDIR (can be repeated)",
+			EnvVar: "KVM_MOUNT",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-keep-disk",
+			Usage:  "Keep the machine disks when the machine is removed",
+			EnvVar: "KVM_KEEP_DISK",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-keep-network",
+			Usage:  "Keep the private network when the machine is removed",
+			EnvVar: "KVM_KEEP_NETWORK",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-no-rollback",
+			Usage:  "Keep the resources of a failed create instead of rolling them back",
+			EnvVar: "KVM_NO_ROLLBACK",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-save-state",
+			Usage:  "Save the machine memory to disk on stop and restore it on start",
+			EnvVar: "KVM_SAVE_STATE",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-stop-method",
+			Usage:  "How to stop the machine: acpi or agent to shut the guest down cleanly, destroy to terminate it",
+			EnvVar: "KVM_STOP_METHOD",
+			Value:  defaultStopMethod,
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-stop-timeout",
+			Usage:  "Seconds to wait for the machine to stop, before destroying it",
+			EnvVar: "KVM_STOP_TIMEOUT",
+			Value:  defaultStopTimeout,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-on-poweroff",
+			Usage:  "What to do when the guest powers off: destroy, restart or preserve",
+			EnvVar: "KVM_ON_POWEROFF",
+			Value:  defaultOnPoweroff,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-on-reboot",
+			Usage:  "What to do when the guest reboots: restart, destroy or preserve",
+			EnvVar: "KVM_ON_REBOOT",
+			Value:  defaultOnReboot,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-on-crash",
+			Usage:  "What to do when the guest crashes: destroy, restart, or preserve to keep it for debugging",
+			EnvVar: "KVM_ON_CRASH",
+			Value:  defaultOnCrash,
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-auto-restart",
+			Usage:  "Start the machine again when the supervise command finds it crashed",
+			EnvVar: "KVM_AUTO_RESTART",
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-iothreads",
+			Usage:  "Number of I/O threads serving the virtio disks, 0 to run disk I/O on the main qemu thread",
+			EnvVar: "KVM_IOTHREADS",
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-max-cpus",
+			Usage:  "Number of vCPU slots, so vCPUs can be hot-added up to it",
+			EnvVar: "KVM_MAX_CPUS",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-adopt-existing",
+			Usage:  "Adopt an existing domain of the machine name when it matches the configuration; its guest must accept --kvm-ssh-key-source or the ssh-agent keys",
+			EnvVar: "KVM_ADOPT_EXISTING",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-auto-redefine",
+			Usage:  "Redefine the domain on start when it differs from the machine configuration or driver version",
+			EnvVar: "KVM_AUTO_REDEFINE",
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-engine-port",
+			Usage:  "Port the Docker daemon listens on in the machine",
+			EnvVar: "KVM_ENGINE_PORT",
+			Value:  defaultEnginePort,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-ssh-user",
+			Usage:  "SSH user of the machine, for cloud images and custom ISOs",
+			EnvVar: "KVM_SSH_USER",
+			Value:  defaultSSHUser,
+		},
+		mcnflag.IntFlag{
+			Name:   "kvm-ssh-port",
+			Usage:  "Port sshd listens on in the machine",
+			EnvVar: "KVM_SSH_PORT",
+			Value:  defaultSSHPort,
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-ssh-key",
+			Usage:  "Private SSH key used to reach the machine, generated there if missing (default: <machine dir>/id_rsa)",
+			EnvVar: "KVM_SSH_KEY",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-ssh-key-source",
+			Usage:  "Existing private SSH key, with its .pub next to it, copied into the machine directory instead of generating one",
+			EnvVar: "KVM_SSH_KEY_SOURCE",
+		},
+		mcnflag.BoolFlag{
+			Name:   "kvm-ssh-agent",
+			Usage:  "Authorize the keys of the running ssh-agent and authenticate with it instead of a key file",
+			EnvVar: "KVM_SSH_AGENT",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-tls-cacert",
+			Usage:  "CA certificate of the libvirtd TLS endpoint, for qemu+tls:// URIs",
+			EnvVar: "KVM_TLS_CACERT",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-tls-cert",
+			Usage:  "Client certificate for qemu+tls:// URIs",
+			EnvVar: "KVM_TLS_CERT",
+		},
+		mcnflag.StringFlag{
+			Name:   "kvm-tls-key",
+			Usage:  "Client key for qemu+tls:// URIs",
+			EnvVar: "KVM_TLS_KEY",
+		},
+	}
+}
+
+func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
+	d.Memory = flags.Int("kvm-memory")
+	d.MemoryHardLimit = flags.Int("kvm-memory-hard-limit")
+	d.MemorySoftLimit = flags.Int("kvm-memory-soft-limit")
+	d.MemorySwapLimit = flags.Int("kvm-memory-swap-limit")
+	d.CPU = flags.Int("kvm-cpu-count")
+	d.DiskSize = int64(flags.Int("kvm-disk-size"))
+	d.IsoURL = flags.String("kvm-iso-url")
+	d.NetworkName = flags.String("kvm-network")
+	d.DiskCache = flags.String("kvm-disk-cache")
+	d.DiskIO = flags.String("kvm-disk-io")
+	d.ExtraDiskIO = flags.String("kvm-extra-disk-io")
+	d.DiskBytesSec = flags.Int("kvm-disk-bytes-sec")
+	d.DiskIOPSSec = flags.Int("kvm-disk-iops-sec")
+	if mode := flags.String("kvm-cache-mode"); mode != "" {
+		log.Warn("--kvm-cache-mode is deprecated, use --kvm-disk-cache or --kvm-disk-io")
+		if isDiskIO(mode) {
+			d.DiskIO = mode
+		} else {
+			d.DiskCache = mode
+		}
+	}
+	d.Display = flags.String("kvm-display")
+	d.VideoModel = flags.String("kvm-video-model")
+	d.Watchdog = flags.String("kvm-watchdog")
+	d.SecLabel = flags.String("kvm-seclabel")
+	d.SecLabelModel = flags.String("kvm-seclabel-model")
+	d.SecLabelLabel = flags.String("kvm-seclabel-label")
+	d.QEMUUser = flags.String("kvm-qemu-user")
+	d.CPUModel = flags.String("kvm-cpu-model")
+	d.CPUFeatures = flags.StringSlice("kvm-cpu-feature")
+	d.Features = flags.StringSlice("kvm-feature")
+	d.ClockOffset = flags.String("kvm-clock-offset")
+	d.Timers = flags.StringSlice("kvm-timer")
+	d.TSCInvariant = flags.Bool("kvm-tsc-invariant")
+	d.NoClockSync = flags.Bool("kvm-no-clock-sync")
+	d.Arch = flags.String("kvm-arch")
+	d.AllowTCG = flags.Bool("kvm-allow-tcg")
+	d.Emulator = flags.String("kvm-emulator")
+	d.Autostart = flags.Bool("kvm-autostart")
+	d.MAC = flags.String("kvm-mac")
+	d.PrivateMAC = flags.String("kvm-private-mac")
+	d.MTU = flags.Int("kvm-mtu")
+	d.ForwardMode = flags.String("kvm-network-forward-mode")
+	d.NATPortRange = flags.String("kvm-nat-port-range")
+	d.Vhost = flags.String("kvm-vhost")
+	d.NetBandwidth = flags.StringSlice("kvm-net-bandwidth")
+	d.SRIOVVF = flags.String("kvm-sriov-vf")
+	d.NetworkMode = flags.String("kvm-network-mode")
+	d.DirectDevice = flags.String("kvm-direct-dev")
+	d.DirectMode = flags.String("kvm-direct-mode")
+	d.ExtraNetworks = flags.StringSlice("kvm-extra-network")
+	d.ExistingDefaultNetwork = flags.Bool("kvm-existing-default-network")
+	d.SingleNetwork = flags.Bool("kvm-single-network")
+	d.PerMachineNetwork = flags.Bool("kvm-per-machine-network")
+	d.PrivateNetworkCIDR = flags.String("kvm-network-cidr")
+	d.PrivateNetworkCIDRPool = flags.String("kvm-network-cidr-pool")
+	d.StaticIP = flags.String("kvm-static-ip")
+	d.DHCPHostname = flags.Bool("kvm-dhcp-hostname")
+	d.IPMode = flags.String("kvm-ip-mode")
+	d.DNSForwarders = flags.StringSlice("kvm-dns-forwarder")
+	d.DNSDomain = flags.String("kvm-dns-domain")
+	d.DNSHosts = flags.StringSlice("kvm-dns-host")
+	d.DHCPOptions = flags.StringSlice("kvm-dhcp-option")
+	d.DHCPLeaseTime = flags.String("kvm-dhcp-lease-time")
+	d.PortForwards = flags.StringSlice("kvm-port-forward")
+	d.StartTimeout = flags.Int("kvm-start-timeout")
+	d.SSHTimeout = flags.Int("kvm-ssh-timeout")
+	d.AgentTimeout = flags.Int("kvm-agent-timeout")
+	d.URLTimeout = flags.Int("kvm-url-timeout")
+	d.ConnectionURI = flags.String("kvm-connection-uri")
+	d.StoragePool = flags.String("kvm-storage-pool")
+	d.BaseImageURL = flags.String("kvm-base-image")
+	d.DiskController = flags.String("kvm-disk-controller")
+	d.DiskPreallocation = flags.String("kvm-disk-preallocation")
+	d.DiskDevice = flags.String("kvm-disk-device")
+	d.DiskEncrypt = flags.Bool("kvm-disk-encrypt")
+	d.ISOCacheDir = flags.String("kvm-iso-cache-dir")
+	d.ISOChecksum = flags.String("kvm-iso-checksum")
+	d.CloudInit = flags.Bool("kvm-cloud-init")
+	d.UserDataFile = flags.String("kvm-user-data")
+	d.Mounts = flags.StringSlice("kvm-mount")
+	d.KeepDisk = flags.Bool("kvm-keep-disk")
+	d.KeepNetwork = flags.Bool("kvm-keep-network")
+	d.NoRollback = flags.Bool("kvm-no-rollback")
+	d.SaveState = flags.Bool("kvm-save-state")
+	d.StopMethod = flags.String("kvm-stop-method")
+	d.StopTimeout = flags.Int("kvm-stop-timeout")
+	d.OnPoweroff = flags.String("kvm-on-poweroff")
+	d.OnReboot = flags.String("kvm-on-reboot")
+	d.OnCrash = flags.String("kvm-on-crash")
+	d.AutoRestart = flags.Bool("kvm-auto-restart")
+	d.MaxCPU = flags.Int("kvm-max-cpus")
+	d.IOThreads = flags.Int("kvm-iothreads")
+	d.AdoptExisting = flags.Bool("kvm-adopt-existing")
+	d.AutoRedefine = flags.Bool("kvm-auto-redefine")
+	d.EnginePort = flags.Int("kvm-engine-port")
+	d.SSHUser = flags.String("kvm-ssh-user")
+	d.GuestSSHPort = flags.Int("kvm-ssh-port")
+	d.SSHPort = d.GuestSSHPort
+	if key := flags.String("kvm-ssh-key"); key != "" {
+		path, err := filepath.Abs(key)
+		if err != nil {
+			return errors.Wrapf(err, "resolving SSH key path %s", key)
+		}
+		d.SSHKeyPath = path
+	}
+	if source := flags.String("kvm-ssh-key-source"); source != "" {
+		path, err := filepath.Abs(source)
+		if err != nil {
+			return errors.Wrapf(err, "resolving SSH key path %s", source)
+		}
+		d.SSHKeySource = path
+	}
+	d.SSHAgent = flags.Bool("kvm-ssh-agent")
+	d.RBDPool = flags.String("kvm-rbd-pool")
+	d.RBDMonitors = flags.StringSlice("kvm-rbd-monitor")
+	d.RBDUser = flags.String("kvm-rbd-user")
+	d.RBDSecretUUID = flags.String("kvm-rbd-secret")
+	for _, size := range flags.StringSlice("kvm-extra-disk") {
+		mb, err := strconv.Atoi(size)
+		if err != nil || mb <= 0 {
+			return fmt.Errorf("Invalid extra disk size %q", size)
+		}
+		d.ExtraDisks = append(d.ExtraDisks, mb)
+	}
+	if len(d.ExtraDisks) > maxExtraDisks {
+		return fmt.Errorf("At most %d extra disks are supported", maxExtraDisks)
+	}
+	d.TLSCACert = flags.String("kvm-tls-cacert")
+	d.TLSClientCert = flags.String("kvm-tls-cert")
+	d.TLSClientKey = flags.String("kvm-tls-key")
+	d.SetSwarmConfigFromFlags(flags)
+
+	if d.PerMachineNetwork && d.NetworkName == defaultNetworkName {
+		d.NetworkName = fmt.Sprintf("%s-net", d.MachineName)
+	}
+
+	d.ISO = d.ResolveStorePath("boot2docker.iso")
+	d.DiskPath = d.ResolveStorePath(fmt.Sprintf("%s.img", d.MachineName))
+	d.ConsoleLog = d.ResolveStorePath("console.log")
+	if err := d.setupSession(); err != nil {
+		return errors.Wrap(err, "setting up session mode")
+	}
+	if err := d.setupTLS(); err != nil {
+		return errors.Wrap(err, "setting up libvirt TLS credentials")
+	}
+	if d.isRemote() {
+		// Paths in the local store don't exist on the hypervisor
+		d.ConsoleLog = ""
+		if d.StoragePool == "" && d.RBDPool == "" {
+			d.StoragePool = defaultStoragePool
+		}
+		if d.BaseImageURL != "" {
+			return errors.New("--kvm-base-image is only supported on a local hypervisor")
+		}
+		if d.DiskDevice != "" {
+			return errors.New("--kvm-disk-device is only supported on a local hypervisor")
+		}
+		if d.UserDataFile != "" {
+			return errors.New("--kvm-user-data is only supported on a local hypervisor")
+		}
+		if len(d.PortForwards) > 0 {
+			return errors.New("--kvm-port-forward is only supported on a local hypervisor")
+		}
+		if d.NetworkMode != "direct" {
+			// The private network is NATed on the hypervisor, out of reach
+			// of this host
+			return errors.New("A remote machine is only reachable on the LAN, it needs --kvm-network-mode direct")
+		}
+		if d.SRIOVVF != "" {
+			// Virtual functions are resolved and checked on this host
+			return errors.New("--kvm-sriov-vf is only supported on a local hypervisor")
+		}
+	}
+
+	switch d.Display {
+	case "none", "vnc", "spice":
+	default:
+		return fmt.Errorf("Invalid display %q, must be one of none, vnc or spice", d.Display)
+	}
+	switch d.VideoModel {
+	case "qxl", "virtio":
+	default:
+		return fmt.Errorf("Invalid video model %q, must be one of qxl or virtio", d.VideoModel)
+	}
+	switch d.Watchdog {
+	case "", "reset", "poweroff", "pause":
+	default:
+		return fmt.Errorf("Invalid watchdog action %q, must be one of reset, poweroff or pause", d.Watchdog)
+	}
+	switch d.SecLabel {
+	case "dynamic", "none":
+		if d.SecLabelLabel != "" {
+			return errors.New("--kvm-seclabel-label requires --kvm-seclabel=custom")
+		}
+	case "custom":
+		if d.SecLabelLabel == "" {
+			return errors.New("--kvm-seclabel=custom requires --kvm-seclabel-label")
+		}
+	default:
+		return fmt.Errorf("Invalid security label mode %q, must be one of dynamic, none or custom", d.SecLabel)
+	}
+	switch d.SecLabelModel {
+	case "", "selinux", "apparmor":
+	default:
+		return fmt.Errorf("Invalid security model %q, must be one of selinux or apparmor", d.SecLabelModel)
+	}
+	if d.QEMUUser != "" {
+		if d.SecLabel == "none" && d.SecLabelModel == "" {
+			return errors.New("--kvm-qemu-user needs the DAC security driver, it can't be used with --kvm-seclabel=none")
+		}
+		owner, err := resolveQEMUUser(d.QEMUUser, d.isRemote())
+		if err != nil {
+			return err
+		}
+		d.QEMUUID, d.QEMUGID = owner.UID, owner.GID
+	}
+	if d.Emulator != "" && !filepath.IsAbs(d.Emulator) {
+		return fmt.Errorf("Invalid emulator %q, must be an absolute path", d.Emulator)
+	}
+	if len(d.CPUFeatures) > 0 && d.CPUModel == "" {
+		return errors.New("--kvm-cpu-feature needs --kvm-cpu-model")
+	}
+	for _, spec := range d.CPUFeatures {
+		if _, err := cpuFeature(spec); err != nil {
+			return err
+		}
+	}
+	for _, spec := range d.Features {
+		name, on, err := parseFeatureToggle(spec)
+		if err != nil {
+			return err
+		}
+		if d.Arch == "aarch64" && name != "acpi" && on {
+			return fmt.Errorf("Feature %s is not available on aarch64", name)
+		}
+	}
+	switch d.ClockOffset {
+	case "utc", "localtime":
+	default:
+		return fmt.Errorf("Invalid clock offset %q, must be one of utc or localtime", d.ClockOffset)
+	}
+	for _, spec := range d.Timers {
+		if _, err := clockTimer(spec); err != nil {
+			return err
+		}
+	}
+	if d.TSCInvariant && d.Arch == "aarch64" {
+		return errors.New("--kvm-tsc-invariant is only available on x86_64")
+	}
+	switch d.Arch {
+	case "x86_64":
+	case "aarch64":
+		if d.IsoURL == defaultIsoURL && !d.CloudInit {
+			return errors.New("The default ISO is x86_64 only, aarch64 machines need an aarch64 ISO as --kvm-iso-url or a cloud image with --kvm-cloud-init")
+		}
+		// The virt machine has no IDE bus nor legacy VGA
+		if d.DiskController == "ide" {
+			log.Debug("Using virtio-scsi disks for aarch64")
+			d.DiskController = "virtio-scsi"
+		}
+		if d.VideoModel == "qxl" {
+			log.Debug("Using the virtio video model for aarch64")
+			d.VideoModel = "virtio"
+		}
+		// The cdroms take the last two scsi targets
+		if len(d.ExtraDisks) > maxExtraDisks-2 {
+			return fmt.Errorf("At most %d extra disks are supported on aarch64", maxExtraDisks-2)
+		}
+	default:
+		return fmt.Errorf("Invalid architecture %q, must be one of x86_64 or aarch64", d.Arch)
+	}
+	if !isDiskCache(d.DiskCache) {
+		return fmt.Errorf("Invalid disk cache mode %q, must be one of default, none, writethrough, writeback, directsync or unsafe", d.DiskCache)
+	}
+	for i, mode := range []string{d.DiskIO, d.ExtraDiskIO} {
+		if i == 1 && mode == "" {
+			// The extra disks share the mode of the boot disk
+			continue
+		}
+		if !isDiskIO(mode) {
+			return fmt.Errorf("Invalid disk I/O mode %q, must be one of threads, native or io_uring", mode)
+		}
+		if mode == "native" && d.DiskCache != "none" && d.DiskCache != "directsync" {
+			return errors.New("The native disk I/O mode bypasses the host page cache, it needs --kvm-disk-cache none or directsync")
+		}
+	}
+	for _, limit := range []int{d.MemoryHardLimit, d.MemorySoftLimit, d.MemorySwapLimit} {
+		if limit < 0 {
+			return fmt.Errorf("Invalid memory limit %d", limit)
+		}
+	}
+	if d.MemoryHardLimit > 0 && d.MemoryHardLimit <= d.Memory {
+		return fmt.Errorf("--kvm-memory-hard-limit %d must exceed --kvm-memory %d, qemu needs memory of its own and the host kills it at the limit", d.MemoryHardLimit, d.Memory)
+	}
+	if d.MemorySoftLimit > 0 && d.MemoryHardLimit > 0 && d.MemorySoftLimit > d.MemoryHardLimit {
+		return errors.New("--kvm-memory-soft-limit can't exceed --kvm-memory-hard-limit")
+	}
+	if d.MemorySwapLimit > 0 && d.MemorySwapLimit < d.MemoryHardLimit {
+		return errors.New("--kvm-memory-swap-limit counts memory too, it can't be below --kvm-memory-hard-limit")
+	}
+	if d.DiskBytesSec < 0 {
+		return fmt.Errorf("Invalid disk throughput limit %d", d.DiskBytesSec)
+	}
+	if d.DiskIOPSSec < 0 {
+		return fmt.Errorf("Invalid disk IOPS limit %d", d.DiskIOPSSec)
+	}
+	if d.IOThreads < 0 {
+		return fmt.Errorf("Invalid number of I/O threads %d", d.IOThreads)
+	}
+	if d.IOThreads > 0 && d.DiskController == "ide" && len(d.ExtraDisks) == 0 {
+		return errors.New("--kvm-iothreads needs virtio disks, use --kvm-disk-controller=virtio-scsi")
+	}
+	switch d.Vhost {
+	case "auto", "on", "off":
+	default:
+		return fmt.Errorf("Invalid vhost mode %q, must be one of auto, on or off", d.Vhost)
+	}
+	if _, err := netBandwidth(d.NetBandwidth); err != nil {
+		return err
+	}
+	switch d.DiskController {
+	case "ide", "virtio-scsi":
+	default:
+		return fmt.Errorf("Invalid disk controller %q, must be one of ide or virtio-scsi", d.DiskController)
+	}
+	if d.DiskDevice != "" && (d.BaseImageURL != "" || d.DiskPreallocation != "off") {
+		return errors.New("--kvm-disk-device cannot be combined with --kvm-base-image or --kvm-disk-preallocation")
+	}
+	if d.RBDPool != "" {
+		if d.StoragePool != "" || d.DiskDevice != "" || d.BaseImageURL != "" || d.DiskPreallocation != "off" {
+			return errors.New("--kvm-rbd-pool cannot be combined with --kvm-storage-pool, --kvm-disk-device, --kvm-base-image or --kvm-disk-preallocation")
+		}
+		if len(d.RBDMonitors) == 0 {
+			return errors.New("--kvm-rbd-pool requires at least one --kvm-rbd-monitor")
+		}
+		for _, monitor := range d.RBDMonitors {
+			if _, err := rbdMonitor(monitor); err != nil {
+				return err
+			}
+		}
+		if (d.RBDUser == "") != (d.RBDSecretUUID == "") {
+			return errors.New("--kvm-rbd-user and --kvm-rbd-secret must be set together")
+		}
+	}
+	if d.DiskEncrypt && (d.DiskDevice != "" || d.RBDPool != "" || d.DiskPreallocation == "full") {
+		return errors.New("--kvm-disk-encrypt cannot be combined with --kvm-disk-device, --kvm-rbd-pool or full preallocation")
+	}
+	if d.DiskEncrypt && !d.CloudInit {
+		// Uploads bypass the encryption, the cert bundle can't be written to
+		// the disk and the SSH key has to come from the cloud-init seed
+		return errors.New("--kvm-disk-encrypt requires --kvm-cloud-init to install the machine SSH key")
+	}
+	if d.CloudInit && d.BaseImageURL == "" {
+		return errors.New("--kvm-cloud-init requires a cloud image as --kvm-base-image")
+	}
+	if d.BaseImageURL != "" && !d.CloudInit {
+		// The cert bundle can't be written into the overlay, the SSH key
+		// only reaches the guest through the cloud-init seed
+		return errors.New("--kvm-base-image requires --kvm-cloud-init to install the machine SSH key")
+	}
+	if d.UserDataFile != "" {
+		if _, err := os.Stat(d.UserDataFile); err != nil {
+			return errors.Wrap(err, "checking user-data file")
+		}
+	}
+	switch d.DiskPreallocation {
+	case "off", "falloc":
+	case "metadata":
+		if d.diskFormat() != "qcow2" {
+			return errors.New("--kvm-disk-preallocation=metadata requires a qcow2 disk (--kvm-base-image)")
+		}
+	case "full":
+		if d.diskFormat() != "raw" {
+			return errors.New("--kvm-disk-preallocation=full requires a raw disk")
+		}
+	default:
+		return fmt.Errorf("Invalid disk preallocation %q, must be one of off, metadata, falloc or full", d.DiskPreallocation)
+	}
+	switch d.NetworkMode {
+	case "network":
+	case "direct":
+		if d.SingleNetwork {
+			return errors.New("The direct network mode needs the default network to reach the machine, it can't be used with --kvm-single-network")
+		}
+		if d.DirectDevice == "" {
+			return errors.New("--kvm-direct-dev is required with the direct network mode")
+		}
+		switch d.DirectMode {
+		case "bridge", "vepa", "private", "passthrough":
+		default:
+			return fmt.Errorf("Invalid direct mode %q, must be one of bridge, vepa, private or passthrough", d.DirectMode)
+		}
+	default:
+		return fmt.Errorf("Invalid network mode %q, must be one of network or direct", d.NetworkMode)
+	}
+	if _, err := subnet(d.PrivateNetworkCIDR); err != nil {
+		return err
+	}
+	if d.PrivateNetworkCIDRPool != "" {
+		if _, err := poolSubnets(d.PrivateNetworkCIDRPool); err != nil {
+			return err
+		}
+	}
+	if d.StartTimeout <= 0 || d.SSHTimeout <= 0 {
+		return errors.New("--kvm-start-timeout and --kvm-ssh-timeout must be positive")
+	}
+	if d.URLTimeout < 0 {
+		return errors.New("--kvm-url-timeout can't be negative")
+	}
+	if d.AgentTimeout < 0 {
+		return errors.New("--kvm-agent-timeout can't be negative")
+	}
+	switch d.StopMethod {
+	case "acpi", "agent", "destroy":
+	default:
+		return fmt.Errorf("Invalid stop method %q, must be one of acpi, agent or destroy", d.StopMethod)
+	}
+	if d.StopTimeout <= 0 {
+		return errors.New("--kvm-stop-timeout must be positive")
+	}
+	for event, action := range map[string]string{"poweroff": d.OnPoweroff, "reboot": d.OnReboot, "crash": d.OnCrash} {
+		switch action {
+		case "destroy", "restart", "preserve":
+		default:
+			return fmt.Errorf("Invalid --kvm-on-%s action %q, must be one of destroy, restart or preserve", event, action)
+		}
+	}
+	if d.AutoRestart && d.OnCrash == "preserve" {
+		return errors.New("--kvm-auto-restart would discard the crashed machine --kvm-on-crash=preserve keeps")
+	}
+
+	if d.EnginePort <= 0 || d.EnginePort > 65535 {
+		return fmt.Errorf("Invalid engine port %d", d.EnginePort)
+	}
+	if d.GuestSSHPort <= 0 || d.GuestSSHPort > 65535 {
+		return fmt.Errorf("Invalid SSH port %d", d.GuestSSHPort)
+	}
+	if d.SSHUser == "" {
+		return errors.New("--kvm-ssh-user can't be empty")
+	}
+	if (d.SSHKeyPath != "" && d.SSHKeySource != "") || (d.SSHAgent && (d.SSHKeyPath != "" || d.SSHKeySource != "")) {
+		return errors.New("--kvm-ssh-key, --kvm-ssh-key-source and --kvm-ssh-agent can't be combined")
+	}
+	if d.SSHKeySource != "" {
+		if _, err := os.Stat(d.SSHKeySource); err != nil {
+			return errors.Wrap(err, "checking SSH key")
+		}
+	}
+	if d.SSHAgent && os.Getenv("SSH_AUTH_SOCK") == "" {
+		return errors.New("--kvm-ssh-agent needs a running ssh-agent, SSH_AUTH_SOCK is not set")
+	}
+	if d.MTU < 0 || d.MTU > 65535 {
+		return fmt.Errorf("Invalid MTU %d", d.MTU)
+	}
+	if d.MaxCPU != 0 && d.MaxCPU < d.CPU {
+		return fmt.Errorf("Invalid max vCPU count %d, lower than the %d vCPUs", d.MaxCPU, d.CPU)
+	}
+	if d.SRIOVVF != "" {
+		vf, err := resolveSRIOVVF(d.SRIOVVF)
+		if err != nil {
+			return errors.Wrap(err, "resolving SR-IOV virtual function")
+		}
+		d.SRIOVVF = vf
+	}
+	switch d.IPMode {
+	case "dhcp":
+	case "static":
+		if d.StaticIP == "" {
+			return errors.New("--kvm-static-ip is required with the static IP mode")
+		}
+		if !d.CloudInit {
+			// boot2docker runs nothing from the cert bundle, only cloud-init
+			// configures the guest network
+			return errors.New("The static IP mode configures the guest through cloud-init, it needs --kvm-cloud-init")
+		}
+	default:
+		return fmt.Errorf("Invalid IP mode %q, must be one of dhcp or static", d.IPMode)
+	}
+	if d.StaticIP != "" {
+		if net.ParseIP(d.StaticIP).To4() == nil {
+			return fmt.Errorf("Invalid static IP %q", d.StaticIP)
+		}
+		if d.NetworkMode == "direct" {
+			return errors.New("--kvm-static-ip needs the private network, it can't be used with the direct network mode")
+		}
+	}
+	if d.DHCPHostname && (d.IPMode != "dhcp" || d.NetworkMode == "direct") {
+		return errors.New("--kvm-dhcp-hostname needs the DHCP server of the private network")
+	}
+	if (d.StaticIP != "" || d.DHCPHostname) && d.PrivateMAC == "" {
+		mac, err := randomMAC()
+		if err != nil {
+			return errors.Wrap(err, "generating MAC address for the DHCP reservation")
+		}
+		d.PrivateMAC = mac
+	}
+	if d.hasSeed() && d.IPMode == "static" && !d.SingleNetwork && d.MAC == "" {
+		// network-config matches the default interface by its MAC too
+		mac, err := randomMAC()
+		if err != nil {
+			return errors.Wrap(err, "generating MAC address for network-config")
+		}
+		d.MAC = mac
+	}
+	switch d.ForwardMode {
+	case "isolated", "nat", "route", "open":
+	default:
+		return fmt.Errorf("Invalid network forward mode %q, must be one of isolated, nat, route or open", d.ForwardMode)
+	}
+	if d.NATPortRange != "" {
+		if _, err := natPortRange(d.NATPortRange); err != nil {
+			return err
+		}
+		if (d.SingleNetwork || d.ExistingDefaultNetwork) && d.ForwardMode != "nat" {
+			return errors.New("--kvm-nat-port-range only applies to networks the driver defines: its default network, or a private network with --kvm-network-forward-mode=nat")
+		}
+	}
+	for _, fwd := range d.DNSForwarders {
+		if net.ParseIP(fwd) == nil {
+			return fmt.Errorf("Invalid DNS forwarder %q", fwd)
+		}
+	}
+	for _, host := range d.DNSHosts {
+		if _, err := dnsHost(host); err != nil {
+			return err
+		}
+	}
+	for _, option := range d.DHCPOptions {
+		if !dhcpOptionRegexp.MatchString(option) {
+			return fmt.Errorf("Invalid DHCP option %q, expected NUMBER,VALUE or option:NAME,VALUE", option)
+		}
+	}
+	if len(d.DHCPOptions) > 0 && d.IPMode != "dhcp" {
+		return errors.New("--kvm-dhcp-option needs the DHCP server of the private network")
+	}
+	if d.DHCPLeaseTime != "" {
+		if _, err := leaseExpiry(d.DHCPLeaseTime); err != nil {
+			return err
+		}
+		if d.IPMode != "dhcp" {
+			return errors.New("--kvm-dhcp-lease-time needs the DHCP server of the private network")
+		}
+	}
+	for _, spec := range d.PortForwards {
+		if _, err := parsePortForward(spec); err != nil {
+			return err
+		}
+	}
+	for _, spec := range d.Mounts {
+		if _, err := parseMount(spec); err != nil {
+			return err
+		}
+	}
+	for _, mac := range []string{d.MAC, d.PrivateMAC} {
+		if mac == "" {
+			continue
+		}
+		if _, err := net.ParseMAC(mac); err != nil {
+			return errors.Wrapf(err, "parsing MAC address %s", mac)
+		}
 	}
-}
-
-//Not implemented yet
-func (d *Driver) GetCreateFlags() []mcnflag.Flag {
-	return nil
-}
 
-//Not implemented yet
-func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	return nil
 }
 
 func (d *Driver) PreCommandCheck() error {
-	conn, err := getConnection()
+	conn, err := d.getConnection()
 	if err != nil {
+		if !d.isRemote() {
+			if groupErr := d.checkLibvirtGroup(); groupErr != nil {
+				return errors.Wrap(err, groupErr.Error())
+			}
+		}
 		return errors.Wrap(err, "Error connecting to libvirt socket.  Have you added yourself to the libvirtd group?")
 	}
+	defer conn.Close()
 	libVersion, err := conn.GetLibVersion()
 	if err != nil {
 		return errors.Wrap(err, "getting libvirt version")
 	}
 	log.Debugf("Using libvirt version %d", libVersion)
 
+	return d.runPreflight(d.libvirtChecks(conn))
+}
+
+func (d *Driver) PreCreateCheck() error {
+	// Host problems go first, since they explain a failing connection
+	if err := d.runPreflight(d.hostChecks()); err != nil {
+		return err
+	}
+
+	if err := d.copyTLSCredentials(); err != nil {
+		return errors.Wrap(err, "setting up libvirt TLS credentials")
+	}
+
+	if err := d.PreCommandCheck(); err != nil {
+		return err
+	}
+
+	if err := d.checkExtraNetworks(); err != nil {
+		return err
+	}
+
+	if err := d.checkStoragePool(); err != nil {
+		return err
+	}
+
+	if err := d.checkHostCapacity(); err != nil {
+		return err
+	}
+
+	if err := d.checkLocalISO(); err != nil {
+		return err
+	}
+
+	if d.isRemote() {
+		// The host device checks below are about the local host
+		return nil
+	}
+
+	if err := d.checkStoreLabels(); err != nil {
+		return err
+	}
+
+	if d.DiskDevice != "" {
+		if err := d.checkDiskDevice(); err != nil {
+			return err
+		}
+	}
+
+	if d.Emulator != "" {
+		if err := checkEmulator(d.Emulator); err != nil {
+			return err
+		}
+	}
+
+	switch d.Vhost {
+	case "on":
+		f, err := os.OpenFile(vhostNetDevice, os.O_RDWR, 0)
+		if err != nil {
+			return errors.Wrapf(err, "vhost-net was requested but %s is not usable, load the vhost_net module or use --kvm-vhost=off", vhostNetDevice)
+		}
+		f.Close()
+	case "auto":
+		if _, err := os.Stat(vhostNetDevice); err != nil {
+			log.Infof("%s is not available, interfaces will fall back to the userspace qemu backend", vhostNetDevice)
+		}
+	}
+
 	return nil
 }
 
@@ -102,31 +1687,52 @@ func (d *Driver) GetURL() (string, error) {
 		return "", nil
 	}
 
-	for {
-		err := drivers.WaitForSSH(d)
-		if err != nil {
-			d.IPAddress = ""
-			time.Sleep(1 * time.Second)
-		} else {
-			break
-		}
+	timeout := d.SSHTimeout
+	if d.URLTimeout > 0 {
+		timeout = d.URLTimeout
+	}
+	if err := d.waitForSSH(time.Duration(timeout) * time.Second); err != nil {
+		d.IPAddress = ""
+		return "", errors.Wrap(err, "getting URL")
 	}
 
-	return fmt.Sprintf("tcp://%s:2376", ip), nil
+	if d.UserNetworking {
+		return fmt.Sprintf("tcp://%s:%d", ip, d.SessionEnginePort), nil
+	}
+	return fmt.Sprintf("tcp://%s:%d", ip, d.enginePort()), nil
+}
+
+// enginePort is the guest port of the Docker daemon, defaulting for
+// machines created before it was configurable
+func (d *Driver) enginePort() int {
+	if d.EnginePort == 0 {
+		return defaultEnginePort
+	}
+	return d.EnginePort
 }
 
 func (d *Driver) GetState() (state.State, error) {
+	if s, ok := domainEvents.cached(d.MachineName); ok {
+		return s, nil
+	}
+
 	dom, conn, err := d.getDomain()
 	if err != nil {
 		return state.None, errors.Wrap(err, "getting connection")
 	}
 	defer closeDomain(dom, conn)
 
-	libvirtState, _, err := dom.GetState() // state, reason, error
+	libvirtState, reason, err := dom.GetState() // state, reason, error
 	if err != nil {
 		return state.None, errors.Wrap(err, "getting domain state")
 	}
 
+	if libvirtState == libvirt.DOMAIN_PAUSED && libvirt.DomainPausedReason(reason) == libvirt.DOMAIN_PAUSED_WATCHDOG {
+		log.Warnf("Machine %s was paused by the watchdog, the guest is not responding", d.MachineName)
+		domainEvents.store(d.MachineName, state.Error)
+		return state.Error, nil
+	}
+
 	stateMap := map[libvirt.DomainState]state.State{
 		libvirt.DOMAIN_NOSTATE:     state.None,
 		libvirt.DOMAIN_RUNNING:     state.Running,
@@ -143,10 +1749,54 @@ func (d *Driver) GetState() (state.State, error) {
 	if !ok {
 		return state.None, nil
 	}
+	switch {
+	case libvirtState == libvirt.DOMAIN_PAUSED && libvirt.DomainPausedReason(reason) == libvirt.DOMAIN_PAUSED_CRASHED:
+		val = state.Error
+	case libvirtState == libvirt.DOMAIN_SHUTOFF && libvirt.DomainShutoffReason(reason) == libvirt.DOMAIN_SHUTOFF_CRASHED:
+		val = state.Error
+	case libvirtState == libvirt.DOMAIN_SHUTOFF:
+		if saved, err := dom.HasManagedSaveImage(0); err == nil && saved {
+			val = state.Saved
+		}
+	}
 
+	domainEvents.store(d.MachineName, val)
 	return val, nil
 }
 
+// StatusDetails describes the state of the machine, with the reason of an
+// Error state when known
+func (d *Driver) StatusDetails() (string, error) {
+	s, err := d.GetState()
+	if err != nil || s != state.Error {
+		return s.String(), err
+	}
+	if crash := domainEvents.crash(d.MachineName); crash != "" {
+		return fmt.Sprintf("%s: %s", s, crash), nil
+	}
+
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return "", errors.Wrap(err, "getting connection")
+	}
+	defer closeDomain(dom, conn)
+	libvirtState, reason, err := dom.GetState()
+	if err != nil {
+		return "", errors.Wrap(err, "getting domain state")
+	}
+	// libvirt only keeps the reason, the time of the crash is lost
+	switch {
+	case libvirtState == libvirt.DOMAIN_CRASHED && libvirt.DomainCrashedReason(reason) == libvirt.DOMAIN_CRASHED_PANICKED,
+		libvirtState == libvirt.DOMAIN_PAUSED && libvirt.DomainPausedReason(reason) == libvirt.DOMAIN_PAUSED_CRASHED:
+		return fmt.Sprintf("%s: kernel panic", s), nil
+	case libvirtState == libvirt.DOMAIN_PAUSED && libvirt.DomainPausedReason(reason) == libvirt.DOMAIN_PAUSED_WATCHDOG:
+		return fmt.Sprintf("%s: paused by the watchdog, the guest is not responding", s), nil
+	case libvirtState == libvirt.DOMAIN_BLOCKED:
+		return fmt.Sprintf("%s: blocked on a resource", s), nil
+	}
+	return fmt.Sprintf("%s: crashed", s), nil
+}
+
 func (d *Driver) GetIP() (string, error) {
 	s, err := d.GetState()
 	if err != nil {
@@ -172,109 +1822,284 @@ func (d *Driver) GetSSHHostname() (string, error) {
 }
 
 func (d *Driver) GetSSHUsername() string {
-	return "docker"
+	if d.SSHUser == "" {
+		return defaultSSHUser
+	}
+	return d.SSHUser
 }
 
+// GetSSHKeyPath is empty with SSHAgent, which makes the ssh client offer
+// the agent keys
 func (d *Driver) GetSSHKeyPath() string {
-	return d.ResolveStorePath("id_rsa")
+	if d.SSHAgent {
+		return ""
+	}
+	if d.SSHKeyPath == "" {
+		return d.ResolveStorePath("id_rsa")
+	}
+	return d.SSHKeyPath
 }
 
 func (d *Driver) GetSSHPort() (int, error) {
 	if d.SSHPort == 0 {
-		d.SSHPort = 22
+		d.SSHPort = defaultSSHPort
 	}
 
 	return d.SSHPort, nil
 }
 
-func (d *Driver) DriverName() string {
+// domainType is the libvirt domain type, qemu for software emulation
+func (d *Driver) domainType() string {
+	if d.TCG {
+		return "qemu"
+	}
 	return "kvm"
 }
 
+// isAArch64 reports whether the guest is an ARM machine
+func (d *Driver) isAArch64() bool {
+	return d.Arch == "aarch64"
+}
+
+// guestSSHPort is the port of sshd in the guest, defaulting for machines
+// created before it was configurable
+func (d *Driver) guestSSHPort() int {
+	if d.GuestSSHPort == 0 {
+		return defaultSSHPort
+	}
+	return d.GuestSSHPort
+}
+
+func (d *Driver) DriverName() string {
+	return Name
+}
+
 func (d *Driver) Kill() error {
+	unlock, err := d.lockMachine()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	d.markStopped(true)
+
 	dom, conn, err := d.getDomain()
 	if err != nil {
 		return errors.Wrap(err, "getting connection")
 	}
 	defer closeDomain(dom, conn)
 
-	return dom.Destroy()
+	d.removePortForwards()
+	if saved, err := dom.HasManagedSaveImage(0); err == nil && saved {
+		log.Info("Discarding saved machine state...")
+		return dom.ManagedSaveRemove(0)
+	}
+	return libvirtCall("destroy domain "+d.MachineName, dom.Destroy)
 }
 
-func (d *Driver) Restart() error {
+// Suspend pauses the vCPUs of the running machine, keeping its memory
+func (d *Driver) Suspend() error {
+	s, err := d.GetState()
+	if err != nil {
+		return errors.Wrap(err, "getting state of VM")
+	}
+	if s != state.Running {
+		return fmt.Errorf("Could not pause VM, current state %s", s.String())
+	}
+
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return errors.Wrap(err, "getting connection")
+	}
+	defer closeDomain(dom, conn)
+
+	if err := dom.Suspend(); err != nil {
+		return errors.Wrap(err, "pausing vm")
+	}
+	return d.waitForState(state.Paused, 30*time.Second)
+}
+
+// Resume continues a machine paused by Suspend
+func (d *Driver) Resume() error {
+	s, err := d.GetState()
+	if err != nil {
+		return errors.Wrap(err, "getting state of VM")
+	}
+	if s != state.Paused {
+		return fmt.Errorf("Could not resume VM, current state %s", s.String())
+	}
+
 	dom, conn, err := d.getDomain()
 	if err != nil {
 		return errors.Wrap(err, "getting connection")
 	}
 	defer closeDomain(dom, conn)
 
-	if err := d.Stop(); err != nil {
+	if err := dom.Resume(); err != nil {
+		return errors.Wrap(err, "resuming vm")
+	}
+	if err := d.waitForState(state.Running, 30*time.Second); err != nil {
+		return err
+	}
+	d.syncClock(dom)
+	return nil
+}
+
+// Restart reboots the guest through ACPI or the guest agent, falling back
+// to a shutdown and start when the guest doesn't come back. A guest reboot
+// that libvirt doesn't turn into a restart is skipped.
+func (d *Driver) Restart() error {
+	s, err := d.GetState()
+	if err != nil {
+		return errors.Wrap(err, "getting state of VM")
+	}
+	if s == state.Running && (d.OnReboot == "" || d.OnReboot == "restart") {
+		err := d.reboot()
+		if err == nil {
+			return nil
+		}
+		log.Warnf("Soft restart failed, stopping and starting the machine: %v", err)
+		if s, err = d.GetState(); err != nil {
+			return errors.Wrap(err, "getting state of VM")
+		}
+	}
+
+	d.IPAddress = ""
+	d.removePortForwards()
+	// A restart is a real shutdown, even with SaveState
+	if err := d.shutdown(s); err != nil {
 		return errors.Wrap(err, "stopping VM:")
 	}
 	return d.Start()
 }
 
+func (d *Driver) reboot() error {
+	bootID, err := d.bootID()
+	if err != nil {
+		return errors.Wrap(err, "getting boot ID")
+	}
+
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return errors.Wrap(err, "getting connection")
+	}
+	defer closeDomain(dom, conn)
+
+	log.Info("Rebooting machine...")
+	if err := libvirtCall("reboot domain "+d.MachineName, func() error {
+		return dom.Reboot(libvirt.DOMAIN_REBOOT_ACPI_POWER_BTN | libvirt.DOMAIN_REBOOT_GUEST_AGENT)
+	}); err != nil {
+		return errors.Wrap(err, "rebooting vm")
+	}
+	if err := d.waitForReboot(bootID, time.Duration(d.StartTimeout+d.SSHTimeout)*time.Second); err != nil {
+		return err
+	}
+
+	return d.mountShares()
+}
+
 func (d *Driver) Start() error {
+	if d.CloneBase {
+		return fmt.Errorf("Machine %s backs linked clones and can't be started, clone it again without --linked instead", d.MachineName)
+	}
+	d.markStopped(false)
+	if s, err := d.GetState(); err == nil && s == state.Paused {
+		log.Info("Machine is paused, resuming it...")
+		return d.Resume()
+	}
+
+	if err := d.checkDrift(); err != nil {
+		return err
+	}
+
 	log.Info("Getting domain xml...")
 	dom, conn, err := d.getDomain()
 	if err != nil {
 		return errors.Wrap(err, "getting connection")
 	}
 	defer closeDomain(dom, conn)
+	restore, _ := dom.HasManagedSaveImage(0)
 
 	log.Info("Creating domain...")
-	if err := dom.Create(); err != nil {
+	if err := libvirtCall("start domain "+d.MachineName, dom.Create); err != nil {
 		return errors.Wrap(err, "Error creating VM")
 	}
 
-	log.Info("Waiting to get IP...")
-	time.Sleep(5 * time.Second)
-	for i := 0; i <= 40; i++ {
-		ip, err := d.GetIP()
-		if err != nil {
-			return errors.Wrap(err, "getting ip during machine start")
-		}
-		if ip == "" {
-			log.Debugf("Waiting for machine to come up %d/%d", i, 40)
-			time.Sleep(3 * time.Second)
-			continue
-		}
-
-		if ip != "" {
-			log.Infof("Found IP for machine: %s", ip)
-			d.IPAddress = ip
-			break
-		}
+	if err := d.waitForState(state.Running, time.Duration(d.StartTimeout)*time.Second); err != nil {
+		return errors.Wrap(err, "waiting for machine to run")
 	}
+	if restore {
+		d.syncClock(dom)
+	}
+
+	return d.setupBooted()
+}
 
-	if d.IPAddress == "" {
-		return errors.New("Machine didn't return an IP after 120 seconds")
+// setupBooted waits for the running machine to be reachable, then sets up
+// its port forwards and shared folders
+func (d *Driver) setupBooted() error {
+	log.Info("Waiting to get IP...")
+	ip, err := d.waitForIP(time.Duration(d.StartTimeout) * time.Second)
+	if err != nil {
+		return errors.Wrap(err, "getting ip during machine start")
 	}
+	log.Infof("Found IP for machine: %s", ip)
+	d.IPAddress = ip
 
 	log.Info("Waiting for SSH to be available...")
-	if err := drivers.WaitForSSH(d); err != nil {
+	if err := d.waitForSSH(time.Duration(d.SSHTimeout) * time.Second); err != nil {
 		d.IPAddress = ""
 		return errors.Wrap(err, "SSH not available after waiting")
 	}
 
+	if d.AgentTimeout > 0 {
+		log.Info("Waiting for the guest agent...")
+		if err := d.waitForAgent(time.Duration(d.AgentTimeout) * time.Second); err != nil {
+			return errors.Wrap(err, "guest agent not available after waiting")
+		}
+	}
+
+	if err := d.addPortForwards(d.IPAddress); err != nil {
+		return errors.Wrap(err, "setting up port forwards")
+	}
+
+	if err := d.mountShares(); err != nil {
+		return errors.Wrap(err, "mounting shared folders")
+	}
+
 	return nil
 }
 
-func (d *Driver) Create() error {
+func (d *Driver) Create() (err error) {
 	log.Info("Creating machine...")
 
-	//TODO(r2d4): rewrite this, not using b2dutils
-	b2dutils := mcnutils.NewB2dUtils(d.StorePath)
-	if err := b2dutils.CopyIsoToMachineDir(d.IsoURL, d.MachineName); err != nil {
-		return errors.Wrap(err, "Error copying ISO to machine dir")
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting connection")
 	}
-
-	log.Info("Creating network...")
-	err := d.createNetworks()
+	exists, err := d.adoptDomain(conn)
+	conn.Close()
 	if err != nil {
-		return errors.Wrap(err, "creating network")
+		return err
+	}
+	if exists {
+		if err := d.checkAdoptedSSHKey(); err != nil {
+			return err
+		}
+		if s, err := d.GetState(); err == nil && s == state.Running {
+			return d.setupBooted()
+		}
+		return d.Start()
 	}
 
+	// Each stage registers the cleanup of what it creates before running,
+	// so a failure undoes partial stages too
+	var created []cleanupStep
+	defer func() {
+		if err != nil && !d.NoRollback {
+			d.rollback(created)
+		}
+	}()
+
 	log.Info("Setting up minikube home directory...")
 	if err := os.MkdirAll(d.ResolveStorePath("."), 0755); err != nil {
 		return errors.Wrap(err, "Error making store path directory")
@@ -293,83 +2118,188 @@ func (d *Driver) Create() error {
 		}
 	}
 
-	log.Info("Building disk image...")
-	err = d.buildDiskImage()
-	if err != nil {
-		return errors.Wrap(err, "Error creating disk")
+	// The ISO, the networks and the disks don't depend on each other and
+	// are set up concurrently
+	var phases []createPhase
+	created = append(created, cleanupStep{"machine files", d.removeMachineFiles})
+	if !d.CloudInit {
+		phases = append(phases, createPhase{"Error copying ISO to machine dir", d.prepareISO})
+	}
+
+	if d.UserNetworking {
+		log.Info("Using user-mode networking, skipping network creation")
+	} else {
+		created = append(created, cleanupStep{"network", d.removeNetwork})
+		if d.reservesIP() {
+			created = append(created, cleanupStep{"DHCP reservation", d.removeStaticHost})
+		}
+		network := createPhase{"creating network", d.setupNetworks}
+		if d.IPMode == "static" {
+			// The network-config of the seed needs the final subnet
+			if err := network.run(); err != nil {
+				return errors.Wrap(err, network.name)
+			}
+		} else {
+			phases = append(phases, network)
+		}
+	}
+
+	// The volumes are rolled back once created: a volume of the same name
+	// that already exists fails the creation and must stay
+	phases = append(phases, createPhase{"Error creating disk", d.setupDisks})
+	phasesErr := runPhases(phases)
+	created = append(created, cleanupStep{"volumes", d.removeCreatedVolumes}, cleanupStep{"disk encryption secret", d.removeDiskSecret})
+	if phasesErr != nil {
+		return phasesErr
 	}
 
 	log.Info("Creating domain...")
+	created = append(created, cleanupStep{"domain", d.removeDomain})
 	dom, err := d.createDomain()
 	if err != nil {
 		return errors.Wrap(err, "creating domain")
 	}
 	defer dom.Free()
 
+	if d.Autostart {
+		log.Info("Setting domain to autostart...")
+		if err := dom.SetAutostart(true); err != nil {
+			return errors.Wrap(err, "setting domain to autostart")
+		}
+	}
+
 	log.Debug("Finished creating machine, now starting machine...")
+	created = append(created, cleanupStep{"port forwards", func(*libvirt.Connect) error {
+		d.removePortForwards()
+		return nil
+	}})
 	return d.Start()
 }
 
+// Stop shuts the machine down, or with SaveState saves its memory to disk
+// for the next Start to restore
 func (d *Driver) Stop() error {
+	unlock, err := d.lockMachine()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	d.markStopped(true)
+
 	d.IPAddress = ""
+	d.removePortForwards()
 	s, err := d.GetState()
 	if err != nil {
 		return errors.Wrap(err, "getting state of VM")
 	}
 
-	if s != state.Stopped {
+	switch {
+	case s == state.Saved:
+		return nil
+	case d.SaveState && s == state.Running:
 		dom, conn, err := d.getDomain()
-		defer closeDomain(dom, conn)
 		if err != nil {
 			return errors.Wrap(err, "getting connection")
 		}
+		defer closeDomain(dom, conn)
+
+		log.Info("Saving machine state...")
+		if err := libvirtCall("save domain "+d.MachineName, func() error { return dom.ManagedSave(0) }); err != nil {
+			return errors.Wrap(err, "saving vm")
+		}
+		return d.waitForState(state.Saved, 120*time.Second)
+	}
+	return d.shutdown(s)
+}
 
-		err = dom.DestroyFlags(libvirt.DOMAIN_DESTROY_GRACEFUL)
+// shutdown stops the machine with its stop method
+func (d *Driver) shutdown(s state.State) error {
+	if s != state.Stopped {
+		dom, conn, err := d.getDomain()
 		if err != nil {
-			return errors.Wrap(err, "stopping vm")
+			return errors.Wrap(err, "getting connection")
+		}
+		defer closeDomain(dom, conn)
+		if active, err := dom.IsActive(); err == nil && !active {
+			// Crashed and destroyed by libvirt already
+			return nil
 		}
 
-		for i := 0; i < 60; i++ {
-			s, err := d.GetState()
-			if err != nil {
-				return errors.Wrap(err, "Error getting state of VM")
+		timeout := time.Duration(d.stopTimeout()) * time.Second
+		var flags libvirt.DomainShutdownFlags
+		switch d.stopMethod() {
+		case "acpi":
+			flags = libvirt.DOMAIN_SHUTDOWN_ACPI_POWER_BTN
+		case "agent":
+			flags = libvirt.DOMAIN_SHUTDOWN_GUEST_AGENT
+		}
+		// A paused guest can't act on a shutdown request
+		if flags != 0 && s == state.Running {
+			log.Infof("Shutting the machine down with %s...", d.stopMethod())
+			err := libvirtCall("shut down domain "+d.MachineName, func() error { return dom.ShutdownFlags(flags) })
+			if err == nil {
+				err = d.waitForState(state.Stopped, timeout)
 			}
-			if s == state.Stopped {
+			if err == nil {
 				return nil
 			}
-			log.Info("Waiting for machine to stop %d/%d", i, 60)
-			time.Sleep(1 * time.Second)
+			log.Warnf("Clean shutdown failed, destroying the machine: %v", err)
+		}
+
+		err = libvirtCall("destroy domain "+d.MachineName, func() error {
+			return dom.DestroyFlags(libvirt.DOMAIN_DESTROY_GRACEFUL)
+		})
+		if err != nil {
+			return errors.Wrap(err, "stopping vm")
 		}
 
+		if err := d.waitForState(state.Stopped, timeout); err != nil {
+			return errors.Wrap(err, "waiting for machine to stop")
+		}
+		return nil
 	}
 
 	return fmt.Errorf("Could not stop VM, current state %s", s.String())
 }
 
+// stopMethod is how the machine is stopped, defaulting for machines
+// created before it was configurable
+func (d *Driver) stopMethod() string {
+	if d.StopMethod == "" {
+		return defaultStopMethod
+	}
+	return d.StopMethod
+}
+
+// stopTimeout is the wait, in seconds, for the machine to stop
+func (d *Driver) stopTimeout() int {
+	if d.StopTimeout == 0 {
+		return defaultStopTimeout
+	}
+	return d.StopTimeout
+}
+
 func (d *Driver) Remove() error {
 	log.Debug("Removing machine...")
-	conn, err := getConnection()
+	conn, err := d.getConnection()
 	if err != nil {
 		return errors.Wrap(err, "getting connection")
 	}
 	defer conn.Close()
-
-	//Tear down network and disk if they exist
-	network, _ := conn.LookupNetworkByName(d.NetworkName)
-	log.Debug("Checking if the network needs to be deleted")
-	if network != nil {
-		log.Infof("Network %s exists, removing...", d.NetworkName)
-		network.Destroy()
-		network.Undefine()
+	unlock, err := d.lockMachine()
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	log.Debug("Checking if the domain needs to be deleted")
-	dom, err := conn.LookupDomainByName(d.MachineName)
-	if dom != nil {
-		log.Infof("Domain %s exists, removing...", d.MachineName)
-		dom.Destroy()
-		dom.Undefine()
+	if d.CloneBase {
+		clones, err := d.linkedClones(conn)
+		if err != nil {
+			return errors.Wrap(err, "looking for linked clones")
+		}
+		if len(clones) > 0 {
+			return fmt.Errorf("Machine %s backs the disks of linked clones (%s), remove them first", d.MachineName, strings.Join(clones, ", "))
+		}
 	}
-
-	return nil
+	return d.cleanup(conn)
 }
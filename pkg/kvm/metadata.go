@@ -0,0 +1,221 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+	"github.com/r2d4/docker-machine-driver-kvm/pkg/version"
+)
+
+// metadataNamespace qualifies the <metadata> element the driver writes into
+// the domains and networks it defines
+const metadataNamespace = "https://github.com/r2d4/docker-machine-driver-kvm"
+
+const metadataTmpl = `<metadata>
+    <kvm:machine xmlns:kvm='{{.Namespace}}'>
+      <kvm:name>{{.Name}}</kvm:name>
+      <kvm:driver>{{.Driver}}</kvm:driver>
+      <kvm:store>{{html .Store}}</kvm:store>
+      <kvm:version>{{.Version}}</kvm:version>
+      <kvm:created>{{.Created}}</kvm:created>{{with .Config}}
+      <kvm:config>{{html .}}</kvm:config>{{end}}
+    </kvm:machine>
+  </metadata>`
+
+// resourceMetadata is what the driver records about a resource it defined
+type resourceMetadata struct {
+	Name   string `xml:"https://github.com/r2d4/docker-machine-driver-kvm name"`
+	Driver string `xml:"https://github.com/r2d4/docker-machine-driver-kvm driver"`
+	// Store is the machine store the resource belongs to, empty for
+	// resources tagged before it was recorded
+	Store   string `xml:"https://github.com/r2d4/docker-machine-driver-kvm store"`
+	Version string `xml:"https://github.com/r2d4/docker-machine-driver-kvm version"`
+	Created string `xml:"https://github.com/r2d4/docker-machine-driver-kvm created"`
+	// Config is the JSON driver configuration, on domains only
+	Config string `xml:"https://github.com/r2d4/docker-machine-driver-kvm config"`
+}
+
+// parseMetadata returns the driver metadata of a domain or network xml,
+// or nil for resources the driver didn't tag
+func parseMetadata(desc string) (*resourceMetadata, error) {
+	var doc struct {
+		Metadata struct {
+			Machine *resourceMetadata `xml:"https://github.com/r2d4/docker-machine-driver-kvm machine"`
+		} `xml:"metadata"`
+	}
+	if err := xml.Unmarshal([]byte(desc), &doc); err != nil {
+		return nil, errors.Wrap(err, "parsing xml")
+	}
+	return doc.Metadata.Machine, nil
+}
+
+// checkDomainOwner refuses to touch a domain tagged for another machine.
+// Domains created before the driver tagged them pass.
+func (d *Driver) checkDomainOwner(desc string) error {
+	meta, err := parseMetadata(desc)
+	if err != nil {
+		return errors.Wrap(err, "reading domain metadata")
+	}
+	if meta != nil && meta.Name != d.MachineName {
+		return fmt.Errorf("Domain %s belongs to machine %s, not %s", d.MachineName, meta.Name, d.MachineName)
+	}
+	return nil
+}
+
+// metadataXML is the <metadata> element tagging a resource the machine
+// defines with its name, the driver and the creation time
+func (d *Driver) metadataXML() (string, error) {
+	return d.renderMetadata("", "")
+}
+
+// domainMetadataXML is the <metadata> element of the domain, which also
+// carries the driver configuration for RecoverDriver. A domain being
+// redefined keeps its creation time.
+func (d *Driver) domainMetadataXML() (string, error) {
+	config, err := json.Marshal(d)
+	if err != nil {
+		return "", errors.Wrap(err, "encoding driver config")
+	}
+	return d.renderMetadata(string(config), d.domainCreated)
+}
+
+// createdTime returns the creation time recorded in the metadata of a domain
+// xml, or an empty string when there is none
+func createdTime(desc string) string {
+	meta, err := parseMetadata(desc)
+	if err != nil || meta == nil {
+		return ""
+	}
+	return meta.Created
+}
+
+// refreshDomainMetadata rewrites the metadata of the defined domain after
+// a command changed the machine in place, for drift checks to compare the
+// domain with the current configuration
+func (d *Driver) refreshDomainMetadata() error {
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return errors.Wrap(err, "getting domain")
+	}
+	defer closeDomain(dom, conn)
+
+	current, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return errors.Wrap(err, "getting domain xml")
+	}
+	d.domainCreated = createdTime(current)
+	desc, err := d.domainMetadataXML()
+	if err != nil {
+		return err
+	}
+	// SetMetadata takes the element inside <metadata>
+	element := strings.TrimSpace(desc)
+	element = strings.TrimSuffix(strings.TrimPrefix(element, "<metadata>"), "</metadata>")
+	flags := libvirt.DOMAIN_AFFECT_CONFIG
+	if active, err := dom.IsActive(); err == nil && active {
+		flags |= libvirt.DOMAIN_AFFECT_LIVE
+	}
+	if err := dom.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, strings.TrimSpace(element), "kvm", metadataNamespace, flags); err != nil {
+		return errors.Wrap(err, "setting domain metadata")
+	}
+	return nil
+}
+
+// renderMetadata renders the <metadata> element, created being now when
+// empty
+func (d *Driver) renderMetadata(config, created string) (string, error) {
+	if created == "" {
+		created = time.Now().UTC().Format(time.RFC3339)
+	}
+	data := struct {
+		resourceMetadata
+		Namespace string
+	}{
+		resourceMetadata{
+			Name:    d.MachineName,
+			Driver:  Name,
+			Store:   d.StorePath,
+			Version: version.VERSION,
+			Created: created,
+			Config:  config,
+		},
+		metadataNamespace,
+	}
+	var buf bytes.Buffer
+	if err := template.Must(template.New("metadata").Parse(metadataTmpl)).Execute(&buf, data); err != nil {
+		return "", errors.Wrap(err, "executing metadata xml")
+	}
+	return buf.String(), nil
+}
+
+// networkOwned reports whether the driver defined a network for a machine
+// of this store, as its metadata tells, so that any machine of the store
+// removes it last. Networks created before the driver tagged them have no
+// metadata at all, and are owned by the machine that recorded creating them.
+func (d *Driver) networkOwned(desc string) (bool, error) {
+	var doc struct {
+		Metadata *struct{} `xml:"metadata"`
+	}
+	if err := xml.Unmarshal([]byte(desc), &doc); err != nil {
+		return false, errors.Wrap(err, "reading network metadata")
+	}
+	if doc.Metadata == nil {
+		return d.NetworkOwned, nil
+	}
+	meta, err := parseMetadata(desc)
+	if err != nil {
+		return false, errors.Wrap(err, "reading network metadata")
+	}
+	if meta == nil || !IsDriverName(meta.Driver) {
+		// Redefined by someone else after the driver created it
+		return false, nil
+	}
+	return meta.Store == "" || filepath.Clean(meta.Store) == filepath.Clean(d.StorePath), nil
+}
+
+// RecoverDriver rebuilds the driver of the machine name from the
+// configuration its domain on the hypervisor at uri carries, for a store
+// that lost the machine. The paths are those of the store the machine was
+// created in.
+func RecoverDriver(uri, storePath, name string) (*Driver, error) {
+	d := NewDriver(name, storePath)
+	if uri != "" {
+		d.ConnectionURI = uri
+	}
+	conn, err := d.getConnection()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+	dom, err := conn.LookupDomainByName(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "looking up domain %s", name)
+	}
+	desc, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	dom.Free()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting domain xml")
+	}
+
+	meta, err := parseMetadata(desc)
+	switch {
+	case err != nil:
+		return nil, errors.Wrap(err, "reading domain metadata")
+	case meta == nil || meta.Config == "":
+		return nil, fmt.Errorf("Domain %s carries no driver configuration, it was defined by an older driver or another tool", name)
+	case meta.Name != name:
+		return nil, fmt.Errorf("Domain %s belongs to machine %s", name, meta.Name)
+	}
+	if err := json.Unmarshal([]byte(meta.Config), d); err != nil {
+		return nil, errors.Wrap(err, "decoding driver config")
+	}
+	return d, nil
+}
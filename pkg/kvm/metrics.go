@@ -0,0 +1,111 @@
+package kvm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// machineStates are the states exported as kvm_machine_state, every machine
+// has one sample per state with the current one set to 1
+var machineStates = []state.State{state.Running, state.Paused, state.Saved, state.Stopped, state.Starting, state.Stopping, state.Error}
+
+// metricFamily is a Prometheus metric with its samples
+type metricFamily struct {
+	name, kind, help string
+	samples          []string
+}
+
+// metricSet collects samples by family, in the order families are first
+// seen, as the text format wants the samples of a family together
+type metricSet struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// add records a sample of the metric name, labels being name, value pairs
+func (m *metricSet) add(name, kind, help string, value float64, labels ...string) {
+	f := m.byName[name]
+	if f == nil {
+		f = &metricFamily{name: name, kind: kind, help: help}
+		m.byName[name] = f
+		m.families = append(m.families, f)
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	f.samples = append(f.samples, fmt.Sprintf("%s{%s} %g", name, strings.Join(pairs, ","), value))
+}
+
+// WriteMetrics writes the state and resource counters of the machines in
+// the Prometheus text format. A machine whose statistics can't be read
+// only gets its state.
+func WriteMetrics(w io.Writer, machines []*Driver) error {
+	m := &metricSet{byName: map[string]*metricFamily{}}
+	for _, d := range machines {
+		name := d.MachineName
+		s, err := d.GetState()
+		if err != nil {
+			log.Debugf("Unable to get state of machine %s: %v", name, err)
+			s = state.Error
+		}
+		up := 0.0
+		if s == state.Running {
+			up = 1
+		}
+		m.add("kvm_machine_up", "gauge", "Whether the machine is running.", up, "machine", name)
+		for _, candidate := range machineStates {
+			value := 0.0
+			if candidate == s {
+				value = 1
+			}
+			m.add("kvm_machine_state", "gauge", "State of the machine, 1 for the current one.", value, "machine", name, "state", candidate.String())
+		}
+		if s != state.Running && s != state.Paused {
+			continue
+		}
+
+		stats, err := d.Stats()
+		if err != nil {
+			log.Debugf("Unable to get statistics of machine %s: %v", name, err)
+			continue
+		}
+		m.add("kvm_machine_cpu_seconds_total", "counter", "CPU time consumed by the machine.", stats.CPUTime.Seconds(), "machine", name)
+		m.add("kvm_machine_vcpus", "gauge", "Online vCPUs of the machine.", float64(stats.VCPUs), "machine", name)
+		m.add("kvm_machine_memory_balloon_bytes", "gauge", "Memory the balloon leaves to the guest.", float64(stats.MemoryBalloon<<10), "machine", name)
+		m.add("kvm_machine_memory_rss_bytes", "gauge", "Memory the machine takes on the host.", float64(stats.MemoryRSS<<10), "machine", name)
+		if stats.MemoryUnused > 0 {
+			m.add("kvm_machine_memory_unused_bytes", "gauge", "Memory the guest leaves unused.", float64(stats.MemoryUnused<<10), "machine", name)
+		}
+		for _, disk := range stats.Disks {
+			labels := []string{"machine", name, "device", disk.Device}
+			m.add("kvm_machine_disk_read_bytes_total", "counter", "Bytes read from the disk.", float64(disk.ReadBytes), labels...)
+			m.add("kvm_machine_disk_read_requests_total", "counter", "Read requests to the disk.", float64(disk.ReadReqs), labels...)
+			m.add("kvm_machine_disk_written_bytes_total", "counter", "Bytes written to the disk.", float64(disk.WriteBytes), labels...)
+			m.add("kvm_machine_disk_write_requests_total", "counter", "Write requests to the disk.", float64(disk.WriteReqs), labels...)
+			m.add("kvm_machine_disk_errors_total", "counter", "Failed requests to the disk.", float64(disk.Errors), labels...)
+		}
+		for _, iface := range stats.Interfaces {
+			labels := []string{"machine", name, "device", iface.Device, "mac", iface.MAC}
+			m.add("kvm_machine_network_receive_bytes_total", "counter", "Bytes received on the interface.", float64(iface.RxBytes), labels...)
+			m.add("kvm_machine_network_receive_packets_total", "counter", "Packets received on the interface.", float64(iface.RxPackets), labels...)
+			m.add("kvm_machine_network_transmit_bytes_total", "counter", "Bytes sent on the interface.", float64(iface.TxBytes), labels...)
+			m.add("kvm_machine_network_transmit_packets_total", "counter", "Packets sent on the interface.", float64(iface.TxPackets), labels...)
+			m.add("kvm_machine_network_drops_total", "counter", "Packets dropped on the interface.", float64(iface.Drops), labels...)
+			m.add("kvm_machine_network_errors_total", "counter", "Errors on the interface.", float64(iface.Errors), labels...)
+		}
+	}
+
+	for _, f := range m.families {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s\n", f.name, f.help, f.name, f.kind, strings.Join(f.samples, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
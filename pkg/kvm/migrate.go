@@ -0,0 +1,146 @@
+package kvm
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+// migrateIPTimeout bounds the wait for the migrated machine to show up in
+// the DHCP leases of the destination
+const migrateIPTimeout = 30 * time.Second
+
+// Migrate live migrates the running machine to the hypervisor at uri, which
+// the source libvirtd connects to directly. The disks are on shared storage
+// unless copyStorage is set, in which case they are created in the same
+// pool of the destination, copied during the migration and deleted from the
+// source. The machine then points at uri.
+func (d *Driver) Migrate(uri string, copyStorage bool) error {
+	u, err := url.Parse(uri)
+	switch {
+	case err != nil:
+		return errors.Wrapf(err, "parsing URI %s", uri)
+	case !d.isRemote() || u.Host == "":
+		return errors.New("Only machines on remote hypervisors can be migrated, to another remote hypervisor")
+	case uri == d.ConnectionURI:
+		return errors.Errorf("Machine %s already runs on %s", d.MachineName, uri)
+	case d.DiskSecretUUID != "":
+		return errors.New("Machines with an encrypted disk can't be migrated")
+	case d.TSCInvariant:
+		return errors.New("Machines with an invariant TSC can't be migrated")
+	case copyStorage && d.RBDPool != "":
+		return errors.New("RBD disks are shared storage, there is nothing to copy")
+	}
+	s, err := d.GetState()
+	if err != nil {
+		return errors.Wrap(err, "getting state of VM")
+	}
+	if s != state.Running {
+		return errors.Errorf("Machine %s is %s, only running machines can be migrated", d.MachineName, s)
+	}
+
+	dst := *d
+	dst.ConnectionURI = uri
+	dst.NetworkOwned = false
+	if err := dst.setupNetworks(); err != nil {
+		return errors.Wrapf(err, "creating network on %s", uri)
+	}
+	if copyStorage {
+		if err := d.prepareMigrationVolumes(&dst); err != nil {
+			return err
+		}
+	}
+
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return errors.Wrap(err, "getting domain")
+	}
+	defer closeDomain(dom, conn)
+
+	flags := libvirt.MIGRATE_LIVE | libvirt.MIGRATE_PEER2PEER | libvirt.MIGRATE_PERSIST_DEST |
+		libvirt.MIGRATE_UNDEFINE_SOURCE | libvirt.MIGRATE_ABORT_ON_ERROR | libvirt.MIGRATE_AUTO_CONVERGE
+	if copyStorage {
+		flags |= libvirt.MIGRATE_NON_SHARED_DISK
+	}
+	log.Infof("Migrating %s to %s...", d.MachineName, uri)
+	if err := libvirtCall("migrate domain "+d.MachineName, func() error { return dom.MigrateToURI(uri, flags, "", 0) }); err != nil {
+		return errors.Wrap(err, "migrating domain")
+	}
+
+	// The domain is gone from the source, clean up what it left there
+	if copyStorage {
+		if err := d.removeVolumes(conn); err != nil {
+			log.Warnf("Unable to delete the disks on the source: %v", err)
+		}
+	}
+	if err := d.removeStaticHost(conn); err != nil {
+		log.Warnf("Unable to remove the DHCP reservation on the source: %v", err)
+	}
+	if err := d.removeNetwork(conn); err != nil {
+		log.Warnf("Unable to remove the network on the source: %v", err)
+	}
+
+	d.ConnectionURI = uri
+	d.NetworkOwned = dst.NetworkOwned
+	d.PrivateNetworkCIDR = dst.PrivateNetworkCIDR
+	// The guest keeps its lease, which the destination only learns about
+	// when it renews
+	if ip, err := d.waitForIP(migrateIPTimeout); err == nil {
+		d.IPAddress = ip
+	} else {
+		log.Warnf("No DHCP lease for %s on %s yet, keeping %s: %v", d.MachineName, uri, d.IPAddress, err)
+	}
+	return nil
+}
+
+// prepareMigrationVolumes creates on dst the volumes the migration copies
+// the disks of d to, and uploads the ISO, which is read-only and not copied
+func (d *Driver) prepareMigrationVolumes(dst *Driver) error {
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+	dstConn, err := dst.getConnection()
+	if err != nil {
+		return errors.Wrapf(err, "connecting to %s", dst.ConnectionURI)
+	}
+	defer dstConn.Close()
+
+	pool, err := d.lookupStoragePool(conn)
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+
+	formats := map[string]string{d.diskVolumeName(): d.diskFormat()}
+	for i := range d.ExtraDisks {
+		formats[d.extraDiskVolumeName(i)] = "raw"
+	}
+	for name, format := range formats {
+		vol, err := pool.LookupStorageVolByName(name)
+		if err != nil {
+			return errors.Wrapf(err, "looking up volume %s", name)
+		}
+		info, err := vol.GetInfo()
+		vol.Free()
+		if err != nil {
+			return errors.Wrapf(err, "getting info of volume %s", name)
+		}
+		dstVol, err := dst.createVolume(dstConn, volumeConfig{Name: name, Capacity: int64(info.Capacity), Format: format})
+		if err != nil {
+			return errors.Wrapf(err, "creating volume %s on %s", name, dst.ConnectionURI)
+		}
+		dstVol.Free()
+	}
+	if !d.CloudInit {
+		if err := dst.uploadISO(dstConn); err != nil {
+			return errors.Wrapf(err, "uploading ISO to %s", dst.ConnectionURI)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package kvm
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// hostMount shares a host directory with the machine over 9p
+type hostMount struct {
+	HostDir  string
+	GuestDir string
+}
+
+// parseMount parses a HOSTDIR:GUESTDIR mount
+func parseMount(spec string) (*hostMount, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || !filepath.IsAbs(parts[0]) || !filepath.IsAbs(parts[1]) {
+		return nil, fmt.Errorf("Malformed mount %q, expected absolute HOSTDIR:GUESTDIR", spec)
+	}
+	return &hostMount{HostDir: parts[0], GuestDir: parts[1]}, nil
+}
+
+// mountTag is the 9p tag of the i-th mount
+func mountTag(i int) string {
+	return fmt.Sprintf("mount%d", i)
+}
+
+// mountShares mounts the 9p shares inside the running machine
+func (d *Driver) mountShares() error {
+	for i, spec := range d.Mounts {
+		m, err := parseMount(spec)
+		if err != nil {
+			return err
+		}
+		log.Infof("Mounting %s on %s...", m.HostDir, m.GuestDir)
+		cmd := fmt.Sprintf("sudo mkdir -p %[2]s && (mountpoint -q %[2]s || sudo mount -t 9p -o trans=virtio,version=9p2000.L %[1]s %[2]s)", mountTag(i), shellQuote(m.GuestDir))
+		if out, err := drivers.RunSSHCommandFromDriver(d, cmd); err != nil {
+			return errors.Wrapf(err, "mounting %s: %s", m.GuestDir, strings.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single word of the guest shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
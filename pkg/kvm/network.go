@@ -2,36 +2,119 @@ package kvm
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/xml"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
-	"text/template"
+	"time"
 
 	"github.com/docker/machine/libmachine/log"
 	libvirt "github.com/libvirt/libvirt-go"
 	"github.com/pkg/errors"
 )
 
-// Replace with hardcoded range with CIDR
-// https://play.golang.org/p/m8TNTtygK0
 const privateNetworkTmpl = `
-<network>
+<network{{if .DHCPOptions}} xmlns:dnsmasq='http://libvirt.org/schemas/network/dnsmasq/1.0'{{end}}>
   <name>{{.NetworkName}}</name>
-  <ip address='192.168.39.1' netmask='255.255.255.0'>
+  {{metadata .}}
+  {{if eq .ForwardMode "nat"}}
+  <forward mode='nat'>
+    {{with natPortRange .NATPortRange}}<nat><port start='{{.Start}}' end='{{.End}}'/></nat>{{end}}
+  </forward>
+  {{else if and .ForwardMode (ne .ForwardMode "isolated")}}<forward mode='{{.ForwardMode}}'/>{{end}}
+  {{if .MTU}}<mtu size='{{.MTU}}'/>{{end}}
+  {{if .DNSDomain}}<domain name='{{.DNSDomain}}' localOnly='yes'/>{{end}}
+  {{if or .DNSForwarders .DNSHosts}}
+  <dns>
+    {{range .DNSForwarders}}<forwarder addr='{{.}}'/>
+    {{end}}
+    {{range .DNSHosts}}{{with dnsHost .}}
+    <host ip='{{.IP}}'>
+      {{range .Hostnames}}<hostname>{{.}}</hostname>
+      {{end}}
+    </host>
+    {{end}}{{end}}
+  </dns>
+  {{end}}
+  {{with subnet .PrivateNetworkCIDR}}
+  <ip address='{{.Gateway}}' netmask='{{.Netmask}}'>
+    {{if ne $.IPMode "static"}}
     <dhcp>
-      <range start='192.168.39.2' end='192.168.39.254'/>
+      <range start='{{.RangeStart}}' end='{{.RangeEnd}}'>
+        {{with $.DHCPLeaseTime}}<lease expiry='{{leaseExpiry .}}' unit='minutes'/>{{end}}
+      </range>
     </dhcp>
+    {{end}}
   </ip>
+  {{end}}
+  {{if .DHCPOptions}}
+  <dnsmasq:options>
+    {{range .DHCPOptions}}<dnsmasq:option value='dhcp-option={{html .}}'/>
+    {{end}}
+  </dnsmasq:options>
+  {{end}}
 </network>
 `
 
+// dhcpOptionRegexp matches a dnsmasq dhcp-option value, optionally tagged,
+// with a numeric or named option
+var dhcpOptionRegexp = regexp.MustCompile(`^(tag:[\w-]+,)*(\d+|option:[\w-]+),[^\n]*$`)
+
+// portRange is a range of NAT source ports
+type portRange struct {
+	Start, End int
+}
+
+// natPortRange parses a START-END port range, returning nil for an empty
+// spec
+func natPortRange(spec string) (*portRange, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) == 2 {
+		start, startErr := strconv.Atoi(parts[0])
+		end, endErr := strconv.Atoi(parts[1])
+		if startErr == nil && endErr == nil && start > 0 && start <= end && end <= 65535 {
+			return &portRange{Start: start, End: end}, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid NAT port range %q, expected START-END with 0 < START <= END <= 65535", spec)
+}
+
+// minLeaseTime is the shortest lease dnsmasq hands out
+const minLeaseTime = 2 * time.Minute
+
+// leaseExpiry parses a DHCP lease duration into the minutes of the libvirt
+// lease expiry, 0 standing for infinite
+func leaseExpiry(spec string) (int, error) {
+	if spec == "infinite" {
+		return 0, nil
+	}
+	lease, err := time.ParseDuration(spec)
+	if err != nil || lease < minLeaseTime || lease%time.Minute != 0 {
+		return 0, fmt.Errorf("Invalid DHCP lease time %q, expected whole minutes of at least 2m, such as 12h, or infinite", spec)
+	}
+	return int(lease / time.Minute), nil
+}
+
+// defaultNetworkTmpl leaves the UUID, MAC and bridge name to libvirt, so it
+// doesn't collide with what the host already uses
 const defaultNetworkTmpl = `
 <network>
   <name>default</name>
-  <uuid>73618f96-1a85-47a8-a809-7edd8ad7899a</uuid>
-  <forward mode='nat'/>
-  <bridge name='virbr0' stp='on' delay='0'/>
-  <mac address='52:54:00:5e:a8:a3'/>
+  {{metadata .}}
+  <forward mode='nat'>
+    {{with natPortRange .NATPortRange}}<nat><port start='{{.Start}}' end='{{.End}}'/></nat>{{end}}
+  </forward>
+  <bridge stp='on' delay='0'/>
+  {{if .MTU}}<mtu size='{{.MTU}}'/>{{end}}
   <ip address='192.168.122.1' netmask='255.255.255.0'>
     <dhcp>
       <range start='192.168.122.2' end='192.168.122.254'/>
@@ -42,59 +125,342 @@ const defaultNetworkTmpl = `
 
 // const networkName = "minikube-net"
 
+// createNetworks defines and starts the networks of the machine. The caller
+// holds lockNetworks.
 func (d *Driver) createNetworks() error {
-	if err := d.createNetwork("default", defaultNetworkTmpl); err != nil {
-		return errors.Wrap(err, "creating default network")
+	switch {
+	case d.SingleNetwork:
+		log.Debug("Single network mode, skipping default network")
+	case d.ExistingDefaultNetwork:
+		if err := d.checkDefaultNetwork(); err != nil {
+			return err
+		}
+	default:
+		if _, err := d.createNetwork("default", defaultNetworkTmpl); err != nil {
+			return errors.Wrap(err, "creating default network")
+		}
+	}
+	if d.NetworkMode == "direct" {
+		log.Debugf("Using direct interface on %s, skipping private network", d.DirectDevice)
+		return nil
+	}
+	if err := d.checkPrivateSubnet(); err != nil {
+		return errors.Wrap(err, "checking private network subnet")
 	}
-	if err := d.createNetwork(d.NetworkName, privateNetworkTmpl); err != nil {
+	created, err := d.createNetwork(d.NetworkName, privateNetworkTmpl)
+	if err != nil {
 		return errors.Wrap(err, "creating private network")
 	}
+	if created {
+		d.NetworkOwned = true
+	}
 
 	return nil
 }
 
-func (d *Driver) createNetwork(networkName, networkTmpl string) error {
+// isNoNetwork reports whether a network lookup failed because the network
+// doesn't exist, rather than for lack of a working connection
+func isNoNetwork(err error) bool {
+	virErr, ok := errors.Cause(err).(libvirt.Error)
+	return ok && virErr.Code == libvirt.ERR_NO_NETWORK
+}
+
+// lockNetworks serializes network changes between driver processes, so
+// concurrent creates don't both define a shared network or pick the same
+// free subnet
+func (d *Driver) lockNetworks() (func(), error) {
+	dir := filepath.Join(d.StorePath, "cache")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "creating cache directory")
+	}
+	return lockFile(filepath.Join(dir, "kvm-network.lock"))
+}
+
+// createNetwork defines and starts networkName from networkTmpl unless it
+// already exists. It reports whether the network was defined by this call.
+func (d *Driver) createNetwork(networkName, networkTmpl string) (bool, error) {
 	log.Infof("Creating network %s...", networkName)
-	conn, err := getConnection()
+	conn, err := d.getConnection()
 	if err != nil {
-		return errors.Wrap(err, "getting libvirt connection")
+		return false, errors.Wrap(err, "getting libvirt connection")
 	}
 	defer conn.Close()
 
-	tmpl := template.Must(template.New("network").Parse(networkTmpl))
-	var networkXML bytes.Buffer
-	err = tmpl.Execute(&networkXML, d)
+	networkXML, err := renderXML("network", networkTmpl, d)
 	if err != nil {
-		return errors.Wrap(err, "executing network template")
+		return false, err
 	}
 
-	//Check if network already exists
+	//Check if network already exists, and leave its configuration alone if so
+	created := false
 	network, err := conn.LookupNetworkByName(networkName)
 	if err != nil {
-		network, err = conn.NetworkDefineXML(networkXML.String())
+		if !isNoNetwork(err) {
+			return false, errors.Wrapf(err, "looking up network %s", networkName)
+		}
+		created = true
+		err = libvirtCall("define network "+networkName, func() (err error) {
+			network, err = conn.NetworkDefineXML(networkXML)
+			return err
+		})
+		if err != nil {
+			return false, errors.Wrapf(err, "defining network from xml: %s", networkXML)
+		}
+
+		err = network.SetAutostart(true)
 		if err != nil {
-			return errors.Wrapf(err, "defining network from xml: %s", networkXML.String())
+			return false, errors.Wrap(err, "setting network to autostart")
+		}
+	} else {
+		log.Debugf("Network %s already exists, using it", networkName)
+	}
+	defer network.Free()
+
+	if !created {
+		if err := d.checkNetworkSettings(network, networkName); err != nil {
+			return false, err
+		}
+	}
+
+	active, err := network.IsActive()
+	if err != nil || !active {
+		err = libvirtCall("start network "+networkName, network.Create)
+		if err != nil {
+			return false, errors.Wrap(err, "creating network")
+		}
+	}
+
+	return created, nil
+}
+
+// networkSettingsXML is the part of a network definition holding the
+// settings machines ask for
+type networkSettingsXML struct {
+	Forward struct {
+		Mode string `xml:"mode,attr"`
+		Port *struct {
+			Start int `xml:"start,attr"`
+			End   int `xml:"end,attr"`
+		} `xml:"nat>port"`
+	} `xml:"forward"`
+	IPs []struct {
+		Ranges []struct {
+			Lease *struct {
+				Expiry int    `xml:"expiry,attr"`
+				Unit   string `xml:"unit,attr"`
+			} `xml:"lease"`
+		} `xml:"dhcp>range"`
+	} `xml:"ip"`
+	DnsmasqOptions struct {
+		Options []struct {
+			Value string `xml:"value,attr"`
+		} `xml:"http://libvirt.org/schemas/network/dnsmasq/1.0 option"`
+	} `xml:"http://libvirt.org/schemas/network/dnsmasq/1.0 options"`
+}
+
+// leaseTime is the lease time of the first DHCP range, in minutes with 0
+// for infinite like leaseExpiry, and whether it's set at all
+func (n *networkSettingsXML) leaseTime() (int, bool) {
+	for _, ip := range n.IPs {
+		for _, r := range ip.Ranges {
+			if r.Lease == nil {
+				continue
+			}
+			switch r.Lease.Unit {
+			case "seconds":
+				return r.Lease.Expiry / 60, true
+			case "hours":
+				return r.Lease.Expiry * 60, true
+			}
+			return r.Lease.Expiry, true
+		}
+	}
+	return 0, false
+}
+
+// checkNetworkSettings fails when the existing network networkName lacks
+// settings the machine asks for: they only apply when the network is
+// defined, and networks are shared between machines
+func (d *Driver) checkNetworkSettings(network *libvirt.Network, networkName string) error {
+	desc, err := network.GetXMLDesc(libvirt.NETWORK_XML_INACTIVE)
+	if err != nil {
+		return errors.Wrapf(err, "getting xml of network %s", networkName)
+	}
+	mismatches, err := d.networkMismatches(networkName, desc)
+	if err != nil {
+		return errors.Wrapf(err, "checking settings of network %s", networkName)
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	if networkName == d.NetworkName {
+		return fmt.Errorf("Network %s already exists with %s; remove it or use --kvm-per-machine-network for a network of the machine's own", networkName, strings.Join(mismatches, ", "))
+	}
+	return fmt.Errorf("Network %s already exists with %s; remove it for the driver to define it again", networkName, strings.Join(mismatches, ", "))
+}
+
+// networkMismatches lists the settings the machine asks for that the
+// network xml desc lacks. Options left to their default are not compared.
+func (d *Driver) networkMismatches(networkName, desc string) ([]string, error) {
+	var existing networkSettingsXML
+	if err := xml.Unmarshal([]byte(desc), &existing); err != nil {
+		return nil, errors.Wrap(err, "parsing network xml")
+	}
+
+	var mismatches []string
+	nat := networkName == "default" || (networkName == d.NetworkName && d.ForwardMode == "nat")
+	if ports, err := natPortRange(d.NATPortRange); err != nil {
+		return nil, err
+	} else if ports != nil && nat {
+		switch port := existing.Forward.Port; {
+		case port == nil:
+			mismatches = append(mismatches, fmt.Sprintf("the default NAT ports instead of %s", d.NATPortRange))
+		case port.Start != ports.Start || port.End != ports.End:
+			mismatches = append(mismatches, fmt.Sprintf("NAT ports %d-%d instead of %s", port.Start, port.End, d.NATPortRange))
 		}
 	}
+	if networkName == d.NetworkName {
+		mode := existing.Forward.Mode
+		if mode == "" {
+			mode = "isolated"
+		}
+		if d.ForwardMode != "" && d.ForwardMode != defaultForwardMode && d.ForwardMode != mode {
+			mismatches = append(mismatches, fmt.Sprintf("forward mode %s instead of %s", mode, d.ForwardMode))
+		}
+		if d.DHCPLeaseTime != "" {
+			want, err := leaseExpiry(d.DHCPLeaseTime)
+			if err != nil {
+				return nil, err
+			}
+			switch lease, set := existing.leaseTime(); {
+			case !set:
+				mismatches = append(mismatches, fmt.Sprintf("the default DHCP lease time instead of %s", d.DHCPLeaseTime))
+			case lease == 0 && want != 0:
+				mismatches = append(mismatches, fmt.Sprintf("infinite DHCP leases instead of %s", d.DHCPLeaseTime))
+			case lease != want:
+				mismatches = append(mismatches, fmt.Sprintf("DHCP lease time %s instead of %s", time.Duration(lease)*time.Minute, d.DHCPLeaseTime))
+			}
+		}
+		options := map[string]bool{}
+		for _, option := range existing.DnsmasqOptions.Options {
+			options[option.Value] = true
+		}
+		for _, option := range d.DHCPOptions {
+			if !options["dhcp-option="+option] {
+				mismatches = append(mismatches, fmt.Sprintf("no DHCP option %s", option))
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// checkDefaultNetwork makes sure the distro-provided default network exists
+// and is active, without ever defining it
+func (d *Driver) checkDefaultNetwork() error {
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
 
-	err = network.SetAutostart(true)
+	network, err := conn.LookupNetworkByName("default")
 	if err != nil {
-		return errors.Wrap(err, "setting network to autostart")
+		return errors.Wrap(err, "looking up the default network, define it or use --kvm-single-network")
 	}
+	defer network.Free()
 
 	active, err := network.IsActive()
 	if err != nil || !active {
-		err = network.Create()
+		log.Info("Starting the default network...")
+		if err := network.Create(); err != nil {
+			return errors.Wrap(err, "starting default network")
+		}
+	}
+
+	return nil
+}
+
+// checkExtraNetworks verifies that every additional network exists, since
+// the driver only attaches them and doesn't define them
+func (d *Driver) checkExtraNetworks() error {
+	if len(d.ExtraNetworks) == 0 {
+		return nil
+	}
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+
+	for _, name := range d.ExtraNetworks {
+		network, err := conn.LookupNetworkByName(name)
 		if err != nil {
-			return errors.Wrap(err, "creating network")
+			return errors.Wrapf(err, "looking up extra network %s", name)
 		}
+		network.Free()
 	}
 
 	return nil
 }
 
+// networkInUse reports whether a domain other than this machine has an
+// interface on the private network
+func (d *Driver) networkInUse(conn *libvirt.Connect) (bool, error) {
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return false, errors.Wrap(err, "listing domains")
+	}
+	defer func() {
+		for _, dom := range doms {
+			dom.Free()
+		}
+	}()
+	for _, dom := range doms {
+		name, err := dom.GetName()
+		if err != nil {
+			return false, errors.Wrap(err, "getting domain name")
+		}
+		if name == d.MachineName {
+			continue
+		}
+		desc, err := dom.GetXMLDesc(0)
+		if err != nil {
+			return false, errors.Wrapf(err, "getting xml of domain %s", name)
+		}
+		var parsed domainInterfacesXML
+		if err := xml.Unmarshal([]byte(desc), &parsed); err != nil {
+			return false, errors.Wrapf(err, "parsing xml of domain %s", name)
+		}
+		for _, iface := range parsed.Interfaces {
+			if iface.Source.Network == d.NetworkName {
+				log.Debugf("Network %s is still used by %s", d.NetworkName, name)
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// ipNetworkName returns the libvirt network whose DHCP leases hold the
+// address used to reach the machine. The host can't talk to a guest through
+// its own macvtap interface, so in direct mode the default network is used.
+func (d *Driver) ipNetworkName() string {
+	if d.NetworkMode == "direct" {
+		return "default"
+	}
+	return d.NetworkName
+}
+
 func (d *Driver) lookupIP() (string, error) {
-	conn, err := getConnection()
+	if d.IPMode == "static" {
+		return d.StaticIP, nil
+	}
+	if d.UserNetworking {
+		return "127.0.0.1", nil
+	}
+
+	conn, err := d.getConnection()
 	if err != nil {
 		return "", errors.Wrap(err, "getting connection and domain")
 	}
@@ -106,28 +472,129 @@ func (d *Driver) lookupIP() (string, error) {
 		return "", errors.Wrap(err, "getting libversion")
 	}
 
+	if d.NetworkMode == "direct" && d.isRemote() {
+		// A remote machine is reached on the LAN through its macvtap
+		// interface, whose address only the guest agent knows
+		mac, err := d.directMAC(conn)
+		if err != nil {
+			return "", errors.Wrap(err, "getting machine MAC address")
+		}
+		return d.lookupIPFromAgent(conn, mac), nil
+	}
+
+	mac, err := d.networkMAC(conn, d.ipNetworkName())
+	if err != nil {
+		return "", errors.Wrap(err, "getting machine MAC address")
+	}
+
+	// The guest agent sees addresses that never show up in the DHCP leases,
+	// so it is asked first when libvirt supports it
+	if libVersion >= 1002014 {
+		if ip := d.lookupIPFromAgent(conn, mac); ip != "" {
+			return ip, nil
+		}
+	}
+
 	// Earlier versions of libvirt don't support getting DHCP address from domains by API
 	if libVersion < 1002006 {
-		return d.lookupIPFromStatusFile()
+		return d.lookupIPFromStatusFile(mac)
 	}
 
-	return d.lookupIPFromNetwork(conn)
+	return d.lookupIPFromNetwork(conn, mac)
 }
 
-func (d *Driver) lookupIPFromNetwork(conn *libvirt.Connect) (string, error) {
-	network, err := conn.LookupNetworkByName(d.NetworkName)
+// networkMAC returns the MAC address of the machine's interface on network
+func (d *Driver) networkMAC(conn *libvirt.Connect, network string) (string, error) {
+	return d.interfaceMAC(conn, func(ifaceType, sourceNetwork, sourceDev string) bool {
+		return ifaceType == "network" && sourceNetwork == network
+	}, fmt.Sprintf("network %s", network))
+}
+
+// directMAC returns the MAC address of the machine's macvtap interface
+func (d *Driver) directMAC(conn *libvirt.Connect) (string, error) {
+	return d.interfaceMAC(conn, func(ifaceType, sourceNetwork, sourceDev string) bool {
+		return ifaceType == "direct" && sourceDev == d.DirectDevice
+	}, fmt.Sprintf("device %s", d.DirectDevice))
+}
+
+func (d *Driver) interfaceMAC(conn *libvirt.Connect, match func(ifaceType, sourceNetwork, sourceDev string) bool, what string) (string, error) {
+	dom, err := conn.LookupDomainByName(d.MachineName)
+	if err != nil {
+		return "", errors.Wrap(err, "looking up domain")
+	}
+	defer dom.Free()
+
+	desc, err := dom.GetXMLDesc(0)
+	if err != nil {
+		return "", errors.Wrap(err, "getting domain xml")
+	}
+	var parsed domainInterfacesXML
+	if err := xml.Unmarshal([]byte(desc), &parsed); err != nil {
+		return "", errors.Wrap(err, "parsing domain xml")
+	}
+	for _, iface := range parsed.Interfaces {
+		if match(iface.Type, iface.Source.Network, iface.Source.Dev) {
+			return strings.ToLower(iface.MAC.Address), nil
+		}
+	}
+
+	return "", fmt.Errorf("Domain %s has no interface on %s", d.MachineName, what)
+}
+
+// lookupIPFromAgent asks the qemu guest agent for the IPv4 address of the
+// interface with mac. It returns an empty string when the agent isn't
+// running in the guest.
+func (d *Driver) lookupIPFromAgent(conn *libvirt.Connect, mac string) string {
+	dom, err := conn.LookupDomainByName(d.MachineName)
+	if err != nil {
+		return ""
+	}
+	defer dom.Free()
+
+	ifaces, err := dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT)
+	if err != nil {
+		log.Debugf("Unable to get addresses from the guest agent: %v", err)
+		return ""
+	}
+	for _, iface := range ifaces {
+		if strings.ToLower(iface.Hwaddr) != mac {
+			continue
+		}
+		for _, addr := range iface.Addrs {
+			if libvirt.IPAddrType(addr.Type) == libvirt.IP_ADDR_TYPE_IPV4 {
+				return addr.Addr
+			}
+		}
+	}
+
+	return ""
+}
+
+// lookupIPFromNetwork returns the address of the newest IPv4 lease held by mac
+func (d *Driver) lookupIPFromNetwork(conn *libvirt.Connect, mac string) (string, error) {
+	network, err := conn.LookupNetworkByName(d.ipNetworkName())
 	if err != nil {
 		return "", errors.Wrap(err, "looking up network by name")
 	}
-	leases, err := network.GetDHCPLeases()
+	defer network.Free()
+	var leases []libvirt.NetworkDHCPLease
+	err = libvirtCall("get DHCP leases of network "+d.ipNetworkName(), func() (err error) {
+		leases, err = network.GetDHCPLeases()
+		return err
+	})
 	if err != nil {
 		return "", errors.Wrap(err, "looking up dhcp leases for network")
 	}
 
 	ip := ""
+	var newest time.Time
 	for _, lease := range leases {
-		if lease.Type == libvirt.IP_ADDR_TYPE_IPV4 {
+		if lease.Type != libvirt.IP_ADDR_TYPE_IPV4 || strings.ToLower(lease.Mac) != mac {
+			continue
+		}
+		if ip == "" || lease.ExpiryTime.After(newest) {
 			ip = lease.IPaddr
+			newest = lease.ExpiryTime
 		}
 	}
 
@@ -135,13 +602,14 @@ func (d *Driver) lookupIPFromNetwork(conn *libvirt.Connect) (string, error) {
 }
 
 // This is for older versions of libvirt that don't support GetDHCPLeases
-func (d *Driver) lookupIPFromStatusFile() (string, error) {
-	leasesFile := fmt.Sprintf("/var/lib/libvirt/dnsmasq/%s.leases", d.NetworkName)
+func (d *Driver) lookupIPFromStatusFile(mac string) (string, error) {
+	leasesFile := fmt.Sprintf("/var/lib/libvirt/dnsmasq/%s.leases", d.ipNetworkName())
 	leases, err := ioutil.ReadFile(leasesFile)
 	if err != nil {
 		return "", errors.Wrap(err, "reading leases file")
 	}
 	ipAddress := ""
+	var newest int64
 	for _, lease := range strings.Split(string(leases), "\n") {
 		if len(lease) == 0 {
 			continue
@@ -152,9 +620,433 @@ func (d *Driver) lookupIPFromStatusFile() (string, error) {
 		if len(entry) != 5 {
 			return "", fmt.Errorf("Malformed leases entry: %s", entry)
 		}
-		if entry[3] == d.MachineName {
+		if strings.ToLower(entry[1]) != mac {
+			continue
+		}
+		expiry, err := strconv.ParseInt(entry[0], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("Malformed lease expiry time: %s", entry[0])
+		}
+		if ipAddress == "" || expiry > newest {
 			ipAddress = entry[2]
+			newest = expiry
 		}
 	}
 	return ipAddress, nil
 }
+
+var pciAddressRegexp = regexp.MustCompile(`^([0-9a-fA-F]{4}):([0-9a-fA-F]{2}):([0-9a-fA-F]{2})\.([0-7])$`)
+
+// resolveSRIOVVF returns the PCI address of the virtual function to attach.
+// vf is either a VF PCI address, or the name of a host PF interface in which
+// case the first VF not already bound to vfio-pci is used.
+func resolveSRIOVVF(vf string) (string, error) {
+	if pciAddressRegexp.MatchString(vf) {
+		return strings.ToLower(vf), nil
+	}
+
+	vfLinks, err := filepath.Glob(fmt.Sprintf("/sys/class/net/%s/device/virtfn*", vf))
+	if err != nil {
+		return "", errors.Wrap(err, "listing virtual functions")
+	}
+	if len(vfLinks) == 0 {
+		return "", fmt.Errorf("%s is neither a PCI address nor an SR-IOV capable interface", vf)
+	}
+
+	for _, link := range vfLinks {
+		target, err := os.Readlink(link)
+		if err != nil {
+			return "", errors.Wrapf(err, "reading virtual function link %s", link)
+		}
+		addr := filepath.Base(target)
+		drv, err := os.Readlink(filepath.Join("/sys/bus/pci/devices", addr, "driver"))
+		if err == nil && filepath.Base(drv) == "vfio-pci" {
+			log.Debugf("Virtual function %s is already assigned, skipping", addr)
+			continue
+		}
+		log.Infof("Using virtual function %s of %s", addr, vf)
+		return addr, nil
+	}
+
+	return "", fmt.Errorf("No free virtual function on %s", vf)
+}
+
+// pciAddressAttrs renders a PCI address as libvirt address attributes
+func pciAddressAttrs(addr string) (string, error) {
+	m := pciAddressRegexp.FindStringSubmatch(addr)
+	if m == nil {
+		return "", fmt.Errorf("Malformed PCI address: %s", addr)
+	}
+	return fmt.Sprintf("domain='0x%s' bus='0x%s' slot='0x%s' function='0x%s'", m[1], m[2], m[3], m[4]), nil
+}
+
+// networkSubnet holds the addresses rendered into a network's <ip> element
+type networkSubnet struct {
+	Gateway    string
+	Netmask    string
+	RangeStart string
+	RangeEnd   string
+}
+
+// subnet splits an IPv4 CIDR into the gateway (first host), netmask and the
+// DHCP range covering the rest of the hosts
+func subnet(cidr string) (*networkSubnet, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing network CIDR %s", cidr)
+	}
+	base := ipnet.IP.To4()
+	if base == nil {
+		return nil, fmt.Errorf("Network CIDR %s is not IPv4", cidr)
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("Network CIDR %s is too small", cidr)
+	}
+
+	nth := func(n uint32) string {
+		v := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+		v += n
+		return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)).String()
+	}
+	size := uint32(1) << uint(bits-ones)
+
+	return &networkSubnet{
+		Gateway:    nth(1),
+		Netmask:    net.IP(ipnet.Mask).String(),
+		RangeStart: nth(2),
+		RangeEnd:   nth(size - 2),
+	}, nil
+}
+
+type networkIPXML struct {
+	IPs []struct {
+		Address string `xml:"address,attr"`
+		Netmask string `xml:"netmask,attr"`
+		Prefix  int    `xml:"prefix,attr"`
+	} `xml:"ip"`
+}
+
+// usedSubnets returns the IPv4 subnets of every defined libvirt network
+func usedSubnets(conn *libvirt.Connect) ([]*net.IPNet, error) {
+	networks, err := conn.ListAllNetworks(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing networks")
+	}
+
+	var subnets []*net.IPNet
+	for _, network := range networks {
+		desc, err := network.GetXMLDesc(0)
+		network.Free()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting network xml")
+		}
+		parsed, err := networkSubnets(desc)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, parsed...)
+	}
+
+	return subnets, nil
+}
+
+// networkSubnets returns the IPv4 subnets of a network xml
+func networkSubnets(desc string) ([]*net.IPNet, error) {
+	var parsed networkIPXML
+	if err := xml.Unmarshal([]byte(desc), &parsed); err != nil {
+		return nil, errors.Wrap(err, "parsing network xml")
+	}
+	var subnets []*net.IPNet
+	for _, ip := range parsed.IPs {
+		addr := net.ParseIP(ip.Address).To4()
+		if addr == nil {
+			continue
+		}
+		mask := net.CIDRMask(ip.Prefix, 32)
+		if ip.Netmask != "" {
+			mask = net.IPMask(net.ParseIP(ip.Netmask).To4())
+		}
+		subnets = append(subnets, &net.IPNet{IP: addr.Mask(mask), Mask: mask})
+	}
+	return subnets, nil
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// hostSubnets returns the IPv4 subnets configured on the host's interfaces
+func hostSubnets() ([]*net.IPNet, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing host interface addresses")
+	}
+
+	var subnets []*net.IPNet
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil || ipnet.IP.IsLoopback() {
+			continue
+		}
+		subnets = append(subnets, &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask})
+	}
+
+	return subnets, nil
+}
+
+// checkPrivateSubnet makes sure the private network's subnet doesn't overlap
+// with another libvirt network or a host interface before it is defined. On
+// conflict a free /24 is picked from PrivateNetworkCIDRPool if one is set,
+// or always for per-machine networks. A private network that is already
+// defined keeps its subnet, which the configuration takes. The interfaces of
+// a remote hypervisor aren't known, only its networks are checked.
+func (d *Driver) checkPrivateSubnet() error {
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+
+	if network, err := conn.LookupNetworkByName(d.NetworkName); err == nil {
+		desc, err := network.GetXMLDesc(0)
+		network.Free()
+		if err != nil {
+			return errors.Wrap(err, "getting network xml")
+		}
+		subnets, err := networkSubnets(desc)
+		if err != nil {
+			return err
+		}
+		if len(subnets) > 0 && subnets[0].String() != d.PrivateNetworkCIDR {
+			log.Infof("Network %s already exists with subnet %s, using it", d.NetworkName, subnets[0])
+			d.PrivateNetworkCIDR = subnets[0].String()
+		}
+		return nil
+	}
+
+	used, err := usedSubnets(conn)
+	if err != nil {
+		return err
+	}
+	if !d.isRemote() {
+		host, err := hostSubnets()
+		if err != nil {
+			return err
+		}
+		used = append(used, host...)
+	}
+
+	_, current, err := net.ParseCIDR(d.PrivateNetworkCIDR)
+	if err != nil {
+		return errors.Wrapf(err, "parsing network CIDR %s", d.PrivateNetworkCIDR)
+	}
+	if freeSubnet([]*net.IPNet{current}, used) != nil {
+		return nil
+	}
+
+	pool := d.PrivateNetworkCIDRPool
+	if pool == "" && d.PerMachineNetwork {
+		pool = defaultNetworkCIDRPool
+	}
+	if pool == "" {
+		return fmt.Errorf("Subnet %s of network %s overlaps with an existing network, use --kvm-network-cidr or --kvm-network-cidr-pool", d.PrivateNetworkCIDR, d.NetworkName)
+	}
+
+	candidates, err := poolSubnets(pool)
+	if err != nil {
+		return err
+	}
+	candidate := freeSubnet(candidates, used)
+	if candidate == nil {
+		return fmt.Errorf("No free /24 subnet in %s for network %s", pool, d.NetworkName)
+	}
+	d.PrivateNetworkCIDR = candidate.String()
+	log.Infof("Using subnet %s for network %s", d.PrivateNetworkCIDR, d.NetworkName)
+	return nil
+}
+
+// freeSubnet returns the first of candidates that overlaps none of used, or
+// nil when they are all taken
+func freeSubnet(candidates, used []*net.IPNet) *net.IPNet {
+	for _, candidate := range candidates {
+		free := true
+		for _, u := range used {
+			if overlaps(candidate, u) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// poolSubnets splits an IPv4 CIDR pool into its /24 subnets
+func poolSubnets(pool string) ([]*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing network CIDR pool %s", pool)
+	}
+	base := ipnet.IP.To4()
+	ones, bits := ipnet.Mask.Size()
+	if base == nil || bits != 32 || ones > 24 {
+		return nil, fmt.Errorf("Network CIDR pool %s must be an IPv4 network of /24 or larger", pool)
+	}
+
+	start := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8
+	var subnets []*net.IPNet
+	for i := uint32(0); i < uint32(1)<<uint(24-ones); i++ {
+		v := start + i<<8
+		subnets = append(subnets, &net.IPNet{
+			IP:   net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), 0).To4(),
+			Mask: net.CIDRMask(24, 32),
+		})
+	}
+
+	return subnets, nil
+}
+
+// randomMAC generates a MAC address in the range used by qemu/kvm
+func randomMAC() (string, error) {
+	buf := make([]byte, 3)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", buf[0], buf[1], buf[2]), nil
+}
+
+// reservesIP reports whether the machine has a DHCP reservation in the
+// private network
+func (d *Driver) reservesIP() bool {
+	return (d.StaticIP != "" || d.DHCPHostname) && d.IPMode == "dhcp"
+}
+
+func (d *Driver) staticHostXML() string {
+	if d.DHCPHostname {
+		return fmt.Sprintf("<host mac='%s' name='%s' ip='%s'/>", d.PrivateMAC, d.MachineName, d.StaticIP)
+	}
+	return fmt.Sprintf("<host mac='%s' ip='%s'/>", d.PrivateMAC, d.StaticIP)
+}
+
+// networkHostsXML is the part of a network definition listing its DHCP
+// reservations
+type networkHostsXML struct {
+	Hosts []struct {
+		IP string `xml:"ip,attr"`
+	} `xml:"ip>dhcp>host"`
+}
+
+// freeHostIP picks an address of the private network DHCP range that is
+// neither reserved nor leased, from the end of the range where dynamic
+// leases are the least likely
+func (d *Driver) freeHostIP() (string, error) {
+	conn, err := d.getConnection()
+	if err != nil {
+		return "", errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+	network, err := conn.LookupNetworkByName(d.NetworkName)
+	if err != nil {
+		return "", errors.Wrap(err, "looking up network by name")
+	}
+	defer network.Free()
+
+	taken := map[string]bool{}
+	desc, err := network.GetXMLDesc(0)
+	if err != nil {
+		return "", errors.Wrap(err, "getting network xml")
+	}
+	var hosts networkHostsXML
+	if err := xml.Unmarshal([]byte(desc), &hosts); err != nil {
+		return "", errors.Wrap(err, "parsing network xml")
+	}
+	for _, host := range hosts.Hosts {
+		taken[host.IP] = true
+	}
+	leases, err := network.GetDHCPLeases()
+	if err != nil {
+		return "", errors.Wrap(err, "getting DHCP leases")
+	}
+	for _, lease := range leases {
+		taken[lease.IPaddr] = true
+	}
+
+	sub, err := subnet(d.PrivateNetworkCIDR)
+	if err != nil {
+		return "", err
+	}
+	start, end := net.ParseIP(sub.RangeStart).To4(), net.ParseIP(sub.RangeEnd).To4()
+	for ip := end; bytes.Compare(ip, start) >= 0; ip = prevIP(ip) {
+		if !taken[ip.String()] {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("No free address left in network %s", d.NetworkName)
+}
+
+// prevIP returns the IPv4 address before ip
+func prevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// addStaticHost adds a DHCP host reservation for StaticIP to the private
+// network, replacing any existing reservation for the same MAC
+func (d *Driver) addStaticHost() error {
+	_, ipnet, err := net.ParseCIDR(d.PrivateNetworkCIDR)
+	if err != nil {
+		return errors.Wrapf(err, "parsing network CIDR %s", d.PrivateNetworkCIDR)
+	}
+	if !ipnet.Contains(net.ParseIP(d.StaticIP)) {
+		return fmt.Errorf("Static IP %s is outside of the private network %s", d.StaticIP, d.PrivateNetworkCIDR)
+	}
+
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+
+	network, err := conn.LookupNetworkByName(d.NetworkName)
+	if err != nil {
+		return errors.Wrap(err, "looking up network by name")
+	}
+	defer network.Free()
+
+	flags := libvirt.NETWORK_UPDATE_AFFECT_LIVE | libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+	err = network.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, d.staticHostXML(), flags)
+	if err != nil {
+		log.Debugf("Adding DHCP host failed, trying to modify an existing one: %v", err)
+		err = network.Update(libvirt.NETWORK_UPDATE_COMMAND_MODIFY, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, d.staticHostXML(), flags)
+		if err != nil {
+			return errors.Wrapf(err, "updating DHCP host %s", d.staticHostXML())
+		}
+	}
+
+	return nil
+}
+
+// networkDNSHost is a static DNS entry of a network
+type networkDNSHost struct {
+	IP        string
+	Hostnames []string
+}
+
+// dnsHost parses an IP=HOSTNAME[,HOSTNAME...] DNS host entry
+func dnsHost(entry string) (*networkDNSHost, error) {
+	parts := strings.SplitN(entry, "=", 2)
+	if len(parts) != 2 || net.ParseIP(parts[0]) == nil || parts[1] == "" {
+		return nil, fmt.Errorf("Malformed DNS host entry %q, expected IP=HOSTNAME[,HOSTNAME...]", entry)
+	}
+	return &networkDNSHost{IP: parts[0], Hostnames: strings.Split(parts[1], ",")}, nil
+}
@@ -0,0 +1,395 @@
+package kvm
+
+import (
+	"encoding/xml"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNATPortRange(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    *portRange
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "1024-65535", want: &portRange{Start: 1024, End: 65535}},
+		{spec: "1-1", want: &portRange{Start: 1, End: 1}},
+		{spec: "0-100", wantErr: true},
+		{spec: "100-65536", wantErr: true},
+		{spec: "200-100", wantErr: true},
+		{spec: "1024", wantErr: true},
+		{spec: "a-b", wantErr: true},
+		{spec: "-1-100", wantErr: true},
+		{spec: "1024-", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := natPortRange(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("natPortRange(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("natPortRange(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    int
+		wantErr bool
+	}{
+		{spec: "infinite", want: 0},
+		{spec: "12h", want: 720},
+		{spec: "1h30m", want: 90},
+		{spec: "2m", want: 2},
+		{spec: "1m", wantErr: true},
+		{spec: "90s", wantErr: true},
+		{spec: "2m30s", wantErr: true},
+		{spec: "-1h", wantErr: true},
+		{spec: "", wantErr: true},
+		{spec: "12", wantErr: true},
+		{spec: "forever", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := leaseExpiry(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("leaseExpiry(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("leaseExpiry(%q) = %d, want %d", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestDNSHost(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    *networkDNSHost
+		wantErr bool
+	}{
+		{entry: "192.168.39.10=registry", want: &networkDNSHost{IP: "192.168.39.10", Hostnames: []string{"registry"}}},
+		{entry: "10.0.0.1=a.example,b.example", want: &networkDNSHost{IP: "10.0.0.1", Hostnames: []string{"a.example", "b.example"}}},
+		{entry: "fd00::1=v6host", want: &networkDNSHost{IP: "fd00::1", Hostnames: []string{"v6host"}}},
+		{entry: "192.168.39.10=", wantErr: true},
+		{entry: "192.168.39.10", wantErr: true},
+		{entry: "registry=192.168.39.10", wantErr: true},
+		{entry: "192.168.39.300=registry", wantErr: true},
+		{entry: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := dnsHost(tt.entry)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("dnsHost(%q) error = %v, wantErr %v", tt.entry, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("dnsHost(%q) = %v, want %v", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		want    *networkSubnet
+		wantErr bool
+	}{
+		{cidr: "192.168.39.0/24", want: &networkSubnet{Gateway: "192.168.39.1", Netmask: "255.255.255.0", RangeStart: "192.168.39.2", RangeEnd: "192.168.39.254"}},
+		{cidr: "10.0.0.0/16", want: &networkSubnet{Gateway: "10.0.0.1", Netmask: "255.255.0.0", RangeStart: "10.0.0.2", RangeEnd: "10.0.255.254"}},
+		{cidr: "192.168.39.77/24", want: &networkSubnet{Gateway: "192.168.39.1", Netmask: "255.255.255.0", RangeStart: "192.168.39.2", RangeEnd: "192.168.39.254"}},
+		{cidr: "192.168.39.4/30", want: &networkSubnet{Gateway: "192.168.39.5", Netmask: "255.255.255.252", RangeStart: "192.168.39.6", RangeEnd: "192.168.39.6"}},
+		{cidr: "192.168.39.0/31", wantErr: true},
+		{cidr: "192.168.39.1/32", wantErr: true},
+		{cidr: "fd00::/64", wantErr: true},
+		{cidr: "192.168.39.0", wantErr: true},
+		{cidr: "192.168.39.0/33", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := subnet(tt.cidr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("subnet(%q) error = %v, wantErr %v", tt.cidr, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("subnet(%q) = %+v, want %+v", tt.cidr, got, tt.want)
+		}
+	}
+}
+
+func TestPoolSubnets(t *testing.T) {
+	tests := []struct {
+		pool    string
+		want    []string
+		wantErr bool
+	}{
+		{pool: "192.168.39.0/24", want: []string{"192.168.39.0/24"}},
+		{pool: "192.168.40.0/22", want: []string{"192.168.40.0/24", "192.168.41.0/24", "192.168.42.0/24", "192.168.43.0/24"}},
+		{pool: "192.168.41.5/23", want: []string{"192.168.40.0/24", "192.168.41.0/24"}},
+		{pool: "192.168.39.0/25", wantErr: true},
+		{pool: "192.168.39.0/32", wantErr: true},
+		{pool: "fd00::/48", wantErr: true},
+		{pool: "pool", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		subnets, err := poolSubnets(tt.pool)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("poolSubnets(%q) error = %v, wantErr %v", tt.pool, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, s := range subnets {
+			got = append(got, s.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("poolSubnets(%q) = %v, want %v", tt.pool, got, tt.want)
+		}
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "192.168.39.0/24", b: "192.168.39.0/24", want: true},
+		{a: "192.168.39.0/24", b: "192.168.0.0/16", want: true},
+		{a: "192.168.0.0/16", b: "192.168.39.0/24", want: true},
+		{a: "192.168.39.0/24", b: "192.168.39.128/25", want: true},
+		{a: "192.168.39.0/24", b: "192.168.39.7/32", want: true},
+		{a: "192.168.39.0/24", b: "192.168.40.0/24", want: false},
+		{a: "192.168.39.0/31", b: "192.168.39.2/31", want: false},
+		{a: "10.0.0.0/8", b: "192.168.39.0/24", want: false},
+	}
+
+	for _, tt := range tests {
+		a, b := mustParseCIDR(t, tt.a), mustParseCIDR(t, tt.b)
+		if got := overlaps(a, b); got != tt.want {
+			t.Errorf("overlaps(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestFreeSubnet(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []string
+		used       []string
+		want       string
+	}{
+		{name: "nothing used", candidates: []string{"192.168.39.0/24", "192.168.40.0/24"}, want: "192.168.39.0/24"},
+		{name: "first taken", candidates: []string{"192.168.39.0/24", "192.168.40.0/24"}, used: []string{"192.168.39.0/24"}, want: "192.168.40.0/24"},
+		{name: "host address in first", candidates: []string{"192.168.39.0/24", "192.168.40.0/24"}, used: []string{"192.168.39.10/32"}, want: "192.168.40.0/24"},
+		{name: "larger network over the pool", candidates: []string{"192.168.39.0/24", "192.168.40.0/24", "192.168.42.0/24"}, used: []string{"192.168.40.0/23", "192.168.39.0/24"}, want: "192.168.42.0/24"},
+		{name: "exhausted", candidates: []string{"192.168.40.0/24", "192.168.41.0/24"}, used: []string{"192.168.40.0/23"}, want: ""},
+		{name: "no candidates", used: []string{"192.168.40.0/23"}, want: ""},
+	}
+
+	for _, tt := range tests {
+		var candidates, used []*net.IPNet
+		for _, c := range tt.candidates {
+			candidates = append(candidates, mustParseCIDR(t, c))
+		}
+		for _, u := range tt.used {
+			used = append(used, mustParseCIDR(t, u))
+		}
+		got := ""
+		if free := freeSubnet(candidates, used); free != nil {
+			got = free.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: freeSubnet() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrevIP(t *testing.T) {
+	tests := []struct {
+		ip, want string
+	}{
+		{ip: "192.168.39.10", want: "192.168.39.9"},
+		{ip: "192.168.39.0", want: "192.168.38.255"},
+		{ip: "192.168.0.0", want: "192.167.255.255"},
+		{ip: "0.0.0.1", want: "0.0.0.0"},
+		{ip: "0.0.0.0", want: "255.255.255.255"},
+	}
+
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip).To4()
+		if got := prevIP(ip).String(); got != tt.want {
+			t.Errorf("prevIP(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+		if ip.String() != tt.ip {
+			t.Errorf("prevIP(%s) modified its argument to %s", tt.ip, ip)
+		}
+	}
+}
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipnet
+}
+
+func TestLeaseTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		desc    string
+		want    int
+		wantSet bool
+	}{
+		{name: "no lease", desc: `<network><ip><dhcp><range start='192.168.39.2' end='192.168.39.254'/></dhcp></ip></network>`},
+		{name: "no dhcp", desc: `<network><ip address='192.168.39.1' netmask='255.255.255.0'/></network>`},
+		{name: "minutes by default", desc: `<network><ip><dhcp><range start='192.168.39.2' end='192.168.39.254'><lease expiry='90'/></range></dhcp></ip></network>`, want: 90, wantSet: true},
+		{name: "hours", desc: `<network><ip><dhcp><range start='192.168.39.2' end='192.168.39.254'><lease expiry='12' unit='hours'/></range></dhcp></ip></network>`, want: 720, wantSet: true},
+		{name: "seconds", desc: `<network><ip><dhcp><range start='192.168.39.2' end='192.168.39.254'><lease expiry='3600' unit='seconds'/></range></dhcp></ip></network>`, want: 60, wantSet: true},
+		{name: "infinite", desc: `<network><ip><dhcp><range start='192.168.39.2' end='192.168.39.254'><lease expiry='0'/></range></dhcp></ip></network>`, want: 0, wantSet: true},
+		{name: "first range with a lease", desc: `<network><ip><dhcp><range start='192.168.39.2' end='192.168.39.99'/></dhcp></ip><ip><dhcp><range start='192.168.40.2' end='192.168.40.254'><lease expiry='2' unit='hours'/></range></dhcp></ip></network>`, want: 120, wantSet: true},
+	}
+
+	for _, tt := range tests {
+		var n networkSettingsXML
+		if err := xml.Unmarshal([]byte(tt.desc), &n); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, set := n.leaseTime()
+		if got != tt.want || set != tt.wantSet {
+			t.Errorf("%s: leaseTime() = %d, %v, want %d, %v", tt.name, got, set, tt.want, tt.wantSet)
+		}
+	}
+}
+
+func TestNetworkMismatches(t *testing.T) {
+	const (
+		isolated = `<network><name>minikube-net</name><ip address='192.168.39.1' netmask='255.255.255.0'><dhcp><range start='192.168.39.2' end='192.168.39.254'/></dhcp></ip></network>`
+		leased   = `<network><name>minikube-net</name><forward mode='nat'><nat><port start='20000' end='30000'/></nat></forward><ip address='192.168.39.1' netmask='255.255.255.0'><dhcp><range start='192.168.39.2' end='192.168.39.254'><lease expiry='12' unit='hours'/></range></dhcp></ip></network>`
+		infinite = `<network><name>minikube-net</name><ip address='192.168.39.1' netmask='255.255.255.0'><dhcp><range start='192.168.39.2' end='192.168.39.254'><lease expiry='0'/></range></dhcp></ip></network>`
+		natted   = `<network><name>default</name><forward mode='nat'/><ip address='192.168.122.1' netmask='255.255.255.0'/></network>`
+	)
+
+	tests := []struct {
+		name        string
+		networkName string
+		desc        string
+		configure   func(d *Driver)
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name: "defaults on an isolated network",
+			desc: isolated,
+		},
+		{
+			name: "matching lease and NAT ports",
+			desc: leased,
+			configure: func(d *Driver) {
+				d.ForwardMode = "nat"
+				d.DHCPLeaseTime = "720m"
+				d.NATPortRange = "20000-30000"
+			},
+		},
+		{
+			name: "matching infinite lease",
+			desc: infinite,
+			configure: func(d *Driver) {
+				d.DHCPLeaseTime = "infinite"
+			},
+		},
+		{
+			name: "no lease setting",
+			desc: isolated,
+			configure: func(d *Driver) {
+				d.DHCPLeaseTime = "12h"
+			},
+			want: []string{"the default DHCP lease time instead of 12h"},
+		},
+		{
+			name: "different lease",
+			desc: leased,
+			configure: func(d *Driver) {
+				d.ForwardMode = "nat"
+				d.DHCPLeaseTime = "1h"
+				d.NATPortRange = "20000-30000"
+			},
+			want: []string{"DHCP lease time 12h0m0s instead of 1h"},
+		},
+		{
+			name: "infinite lease instead of a limited one",
+			desc: infinite,
+			configure: func(d *Driver) {
+				d.DHCPLeaseTime = "1h"
+			},
+			want: []string{"infinite DHCP leases instead of 1h"},
+		},
+		{
+			name: "different forward mode and NAT ports",
+			desc: isolated,
+			configure: func(d *Driver) {
+				d.ForwardMode = "nat"
+				d.NATPortRange = "20000-30000"
+			},
+			want: []string{"the default NAT ports instead of 20000-30000", "forward mode isolated instead of nat"},
+		},
+		{
+			name:        "NAT ports of the default network",
+			networkName: "default",
+			desc:        natted,
+			configure: func(d *Driver) {
+				d.NATPortRange = "20000-30000"
+				d.DHCPLeaseTime = "1h"
+			},
+			want: []string{"the default NAT ports instead of 20000-30000"},
+		},
+		{
+			name: "missing DHCP option",
+			desc: isolated,
+			configure: func(d *Driver) {
+				d.DHCPOptions = []string{"option:ntp-server,10.0.0.1"}
+			},
+			want: []string{"no DHCP option option:ntp-server,10.0.0.1"},
+		},
+		{
+			name: "invalid lease time",
+			desc: isolated,
+			configure: func(d *Driver) {
+				d.DHCPLeaseTime = "1s"
+			},
+			wantErr: true,
+		},
+		{
+			name:    "malformed xml",
+			desc:    "<network>",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		d := NewDriver("default", "/tmp/store")
+		if tt.configure != nil {
+			tt.configure(d)
+		}
+		networkName := tt.networkName
+		if networkName == "" {
+			networkName = d.NetworkName
+		}
+		got, err := d.networkMismatches(networkName, tt.desc)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: networkMismatches() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: networkMismatches() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package kvm
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// fileOwner is the uid and gid qemu runs as
+type fileOwner struct {
+	UID int
+	GID int
+}
+
+// resolveQEMUUser resolves a USER[:GROUP] spec to ids. Names are looked up
+// on this host, so remote hypervisors need numeric ids.
+func resolveQEMUUser(spec string, remote bool) (*fileOwner, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	owner := &fileOwner{}
+
+	uid, err := strconv.Atoi(parts[0])
+	switch {
+	case err == nil:
+		owner.UID, owner.GID = uid, uid
+		if u, err := user.LookupId(parts[0]); err == nil {
+			owner.GID, _ = strconv.Atoi(u.Gid)
+		}
+	case remote:
+		return nil, fmt.Errorf("qemu user %q must be given as UID[:GID] on a remote hypervisor", spec)
+	default:
+		u, err := user.Lookup(parts[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "looking up qemu user %s", parts[0])
+		}
+		owner.UID, _ = strconv.Atoi(u.Uid)
+		owner.GID, _ = strconv.Atoi(u.Gid)
+	}
+
+	if len(parts) == 2 {
+		gid, err := strconv.Atoi(parts[1])
+		switch {
+		case err == nil:
+			owner.GID = gid
+		case remote:
+			return nil, fmt.Errorf("qemu group %q must be given as a GID on a remote hypervisor", parts[1])
+		default:
+			g, err := user.LookupGroup(parts[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "looking up qemu group %s", parts[1])
+			}
+			owner.GID, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return owner, nil
+}
+
+// qemuOwner is who the machine images must belong to, nil to leave them
+// to libvirt
+func (d *Driver) qemuOwner() *fileOwner {
+	if d.QEMUUser == "" {
+		return nil
+	}
+	return &fileOwner{UID: d.QEMUUID, GID: d.QEMUGID}
+}
+
+// chownForQEMU hands files of the machine directory over to the qemu user.
+// Failing is only a warning, as libvirt may still relabel them on start.
+func (d *Driver) chownForQEMU(paths ...string) {
+	owner := d.qemuOwner()
+	if owner == nil || d.isRemote() {
+		return
+	}
+	for _, path := range paths {
+		if err := os.Chown(path, owner.UID, owner.GID); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Unable to give %s to the qemu user: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package kvm
+
+import (
+	"sync"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/pkg/errors"
+)
+
+// createPhase is a stage of Create independent of the others
+type createPhase struct {
+	name string
+	run  func() error
+}
+
+// runPhases runs the phases concurrently and waits for all of them, so
+// every failure is reported and rolled back together
+func runPhases(phases []createPhase) error {
+	errs := make([]error, len(phases))
+	var wg sync.WaitGroup
+	for i, phase := range phases {
+		wg.Add(1)
+		go func(i int, phase createPhase) {
+			defer wg.Done()
+			if err := phase.run(); err != nil {
+				errs[i] = errors.Wrap(err, phase.name)
+			}
+		}(i, phase)
+	}
+	wg.Wait()
+
+	var multi mcnutils.MultiError
+	for _, err := range errs {
+		if err != nil {
+			multi.Errs = append(multi.Errs, err)
+		}
+	}
+	switch len(multi.Errs) {
+	case 0:
+		return nil
+	case 1:
+		return multi.Errs[0]
+	}
+	return multi
+}
+
+// prepareISO puts the ISO in the machine directory, and in the storage
+// pool when libvirt can't read it from there
+func (d *Driver) prepareISO() error {
+	if err := d.copyISOToMachineDir(false); err != nil {
+		return err
+	}
+	d.chownForQEMU(d.ResolveStorePath("boot2docker.iso"))
+	if !d.isoInPool() {
+		return nil
+	}
+
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+	return d.uploadISO(conn)
+}
+
+// setupNetworks creates the networks and reserves the static IP. The lock
+// is held until the reservation is added, so concurrent creates don't pick
+// the same free address.
+func (d *Driver) setupNetworks() error {
+	unlock, err := d.lockNetworks()
+	if err != nil {
+		return errors.Wrap(err, "locking networks")
+	}
+	defer unlock()
+
+	log.Info("Creating network...")
+	if err := d.createNetworks(); err != nil {
+		return err
+	}
+
+	if d.DHCPHostname && d.StaticIP == "" {
+		ip, err := d.freeHostIP()
+		if err != nil {
+			return errors.Wrap(err, "picking an address for the machine")
+		}
+		d.StaticIP = ip
+	}
+	if d.reservesIP() {
+		log.Infof("Reserving %s for the machine...", d.StaticIP)
+		if err := d.addStaticHost(); err != nil {
+			return errors.Wrap(err, "reserving static IP")
+		}
+	}
+	return nil
+}
+
+// setupDisks builds the cloud-init seed and the disk volumes
+func (d *Driver) setupDisks() error {
+	if d.hasSeed() {
+		if err := d.buildSeedISO(); err != nil {
+			return errors.Wrap(err, "building cloud-init seed")
+		}
+		d.chownForQEMU(d.seedISOPath())
+	}
+
+	log.Info("Building disk volume...")
+	return d.buildDiskVolume()
+}
@@ -0,0 +1,122 @@
+package kvm
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// portForward forwards a host port to a port of the machine
+type portForward struct {
+	Proto     string
+	HostPort  int
+	GuestPort int
+}
+
+// parsePortForward parses a HOSTPORT:GUESTPORT[/PROTO] port forward
+func parsePortForward(spec string) (*portForward, error) {
+	pf := &portForward{Proto: "tcp"}
+	if i := strings.Index(spec, "/"); i != -1 {
+		pf.Proto = spec[i+1:]
+		spec = spec[:i]
+	}
+	if pf.Proto != "tcp" && pf.Proto != "udp" {
+		return nil, fmt.Errorf("Invalid port forward protocol %q, must be tcp or udp", pf.Proto)
+	}
+
+	ports := strings.Split(spec, ":")
+	if len(ports) != 2 {
+		return nil, fmt.Errorf("Malformed port forward %q, expected HOSTPORT:GUESTPORT[/PROTO]", spec)
+	}
+	var err error
+	if pf.HostPort, err = parsePort(ports[0]); err != nil {
+		return nil, err
+	}
+	if pf.GuestPort, err = parsePort(ports[1]); err != nil {
+		return nil, err
+	}
+
+	return pf, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("Invalid port %q", s)
+	}
+	return port, nil
+}
+
+// rules returns the iptables rules, without the command, that implement the
+// forward to ip. Every rule carries a comment naming the machine.
+func (pf *portForward) rules(machineName, ip string) [][]string {
+	comment := []string{"-m", "comment", "--comment", fmt.Sprintf("docker-machine-kvm:%s", machineName)}
+	dest := fmt.Sprintf("%s:%d", ip, pf.GuestPort)
+
+	return [][]string{
+		append([]string{"PREROUTING", "-t", "nat", "-p", pf.Proto, "--dport", strconv.Itoa(pf.HostPort),
+			"-j", "DNAT", "--to-destination", dest}, comment...),
+		append([]string{"FORWARD", "-p", pf.Proto, "-d", ip, "--dport", strconv.Itoa(pf.GuestPort),
+			"-j", "ACCEPT"}, comment...),
+	}
+}
+
+func iptables(action string, rule []string) error {
+	args := append([]string{action}, rule...)
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "iptables %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// addPortForwards installs the configured port forwards to ip
+func (d *Driver) addPortForwards(ip string) error {
+	// User-mode networking forwards the ports itself
+	if len(d.PortForwards) == 0 || d.UserNetworking {
+		return nil
+	}
+	// Drop rules left behind by a previous run, e.g. after the host crashed
+	d.removePortForwards()
+
+	for _, spec := range d.PortForwards {
+		pf, err := parsePortForward(spec)
+		if err != nil {
+			return err
+		}
+		log.Infof("Forwarding host port %d to %s:%d/%s...", pf.HostPort, ip, pf.GuestPort, pf.Proto)
+		for _, rule := range pf.rules(d.MachineName, ip) {
+			if err := iptables("-I", rule); err != nil {
+				return errors.Wrap(err, "adding port forward, the driver must be able to run iptables")
+			}
+		}
+	}
+	d.PortForwardIP = ip
+
+	return nil
+}
+
+// removePortForwards deletes the port forwards installed by addPortForwards.
+// Failures are only logged since the rules may already be gone.
+func (d *Driver) removePortForwards() {
+	if len(d.PortForwards) == 0 || d.PortForwardIP == "" {
+		return
+	}
+
+	for _, spec := range d.PortForwards {
+		pf, err := parsePortForward(spec)
+		if err != nil {
+			continue
+		}
+		for _, rule := range pf.rules(d.MachineName, d.PortForwardIP) {
+			if err := iptables("-D", rule); err != nil {
+				log.Debugf("Unable to remove port forward: %v", err)
+			}
+		}
+	}
+	d.PortForwardIP = ""
+}
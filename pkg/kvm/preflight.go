@@ -0,0 +1,289 @@
+package kvm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"runtime"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	kvmDevice     = "/dev/kvm"
+	libvirtSocket = "/var/run/libvirt/libvirt-sock"
+)
+
+// preflightCheck is one host requirement checked before using the driver
+type preflightCheck struct {
+	name  string
+	check func() error
+	// local checks are about this host, and skipped for remote hypervisors
+	local bool
+}
+
+// hostChecks don't need a libvirt connection; they explain why creating
+// the machine would fail. They only run before create, existing machines
+// went through them already.
+func (d *Driver) hostChecks() []preflightCheck {
+	var checks []preflightCheck
+	if !d.AllowTCG {
+		// Without them checkAcceleration falls back to TCG
+		checks = append(checks,
+			preflightCheck{"virtualization extensions", checkVirtExtensions, true},
+			preflightCheck{"kvm device", d.checkKVMDevice, true},
+		)
+	}
+	return append(checks,
+		preflightCheck{"libvirtd", d.checkLibvirtd, true},
+	)
+}
+
+// libvirtChecks need a working connection
+func (d *Driver) libvirtChecks(conn *libvirt.Connect) []preflightCheck {
+	return []preflightCheck{
+		{"qemu-kvm", func() error { return d.checkAcceleration(conn) }, false},
+		{"default network", func() error { return d.checkDefaultNetworkExists(conn) }, false},
+		{"io_uring", func() error { return d.checkIOURing(conn) }, false},
+	}
+}
+
+// runPreflight runs the checks and reports every failure at once
+func (d *Driver) runPreflight(checks []preflightCheck) error {
+	var errs mcnutils.MultiError
+	for _, c := range checks {
+		if c.local && d.isRemote() {
+			continue
+		}
+		log.Debugf("Checking %s...", c.name)
+		if err := c.check(); err != nil {
+			errs.Errs = append(errs.Errs, err)
+		}
+	}
+	if len(errs.Errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func checkVirtExtensions() error {
+	// vmx and svm are x86 flags, ARM hosts only have /dev/kvm to go by
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "386" {
+		return nil
+	}
+	cpuinfo, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return errors.Wrap(err, "reading /proc/cpuinfo")
+	}
+	for _, line := range strings.Split(string(cpuinfo), "\n") {
+		if !strings.HasPrefix(line, "flags") {
+			continue
+		}
+		for _, flag := range strings.Fields(line) {
+			if flag == "vmx" || flag == "svm" {
+				return nil
+			}
+		}
+	}
+	return errors.New("The CPU does not report virtualization extensions (vmx or svm), enable VT-x/AMD-V in the BIOS or nested virtualization on the parent hypervisor")
+}
+
+// checkKVMDevice checks that /dev/kvm exists and, with qemu:///session
+// where qemu runs as the calling user, that it's usable. The system daemon
+// runs qemu as its own user, whose access is not ours to check.
+func (d *Driver) checkKVMDevice() error {
+	if _, err := os.Stat(kvmDevice); os.IsNotExist(err) {
+		return fmt.Errorf("%s does not exist, load the kvm_intel or kvm_amd module", kvmDevice)
+	}
+	if !d.isSession() {
+		return nil
+	}
+	f, err := os.OpenFile(kvmDevice, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("%s is not writable, add yourself to the kvm group: %v", kvmDevice, err)
+	}
+	f.Close()
+	return nil
+}
+
+func (d *Driver) checkLibvirtd() error {
+	if d.isSession() {
+		// qemu:///session starts its own daemon
+		return nil
+	}
+	if _, err := os.Stat(libvirtSocket); err != nil {
+		return fmt.Errorf("libvirtd is not running (no %s), start it with 'systemctl start libvirtd'", libvirtSocket)
+	}
+	return nil
+}
+
+// checkLibvirtGroup explains a refused connection to the system libvirtd;
+// it's not a hard requirement since polkit may grant access otherwise
+func (d *Driver) checkLibvirtGroup() error {
+	if d.isSession() || os.Geteuid() == 0 {
+		return nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return errors.Wrap(err, "getting current user")
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return errors.Wrap(err, "getting groups of the current user")
+	}
+	for _, gid := range gids {
+		g, err := user.LookupGroupId(gid)
+		if err == nil && (g.Name == "libvirt" || g.Name == "libvirtd") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in the libvirt group, run 'sudo usermod -aG libvirt %s' and log in again", u.Username, u.Username)
+}
+
+// checkAcceleration verifies that the hypervisor can run KVM guests or,
+// with AllowTCG, that it can at least emulate the guest; the domain is then
+// created with type qemu
+func (d *Driver) checkAcceleration(conn *libvirt.Connect) error {
+	arch := d.Arch
+	if arch == "" {
+		// Machines created before the arch was configurable are x86_64
+		arch = defaultArch
+	}
+	err := checkKVMCapability(conn, arch)
+	if err == nil || !d.AllowTCG {
+		return err
+	}
+	if tcgErr := checkTCGCapability(conn, arch); tcgErr != nil {
+		return errors.Wrap(tcgErr, err.Error())
+	}
+	if !d.TCG {
+		log.Warnf("%v, falling back to software emulation: the machine will be much slower", err)
+		d.TCG = true
+	}
+	return nil
+}
+
+// capabilitiesXML is the part of the hypervisor capabilities listing the
+// guests it runs
+type capabilitiesXML struct {
+	Guests []struct {
+		Arch struct {
+			Name    string `xml:"name,attr"`
+			Domains []struct {
+				Type string `xml:"type,attr"`
+			} `xml:"domain"`
+		} `xml:"arch"`
+	} `xml:"guest"`
+}
+
+// guestDomainTypes returns the domain types, kvm or qemu, the hypervisor
+// runs guests of each arch with
+func guestDomainTypes(conn *libvirt.Connect) (map[string]map[string]bool, error) {
+	caps, err := conn.GetCapabilities()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting hypervisor capabilities")
+	}
+	var parsed capabilitiesXML
+	if err := xml.Unmarshal([]byte(caps), &parsed); err != nil {
+		return nil, errors.Wrap(err, "parsing hypervisor capabilities")
+	}
+	types := map[string]map[string]bool{}
+	for _, guest := range parsed.Guests {
+		if types[guest.Arch.Name] == nil {
+			types[guest.Arch.Name] = map[string]bool{}
+		}
+		for _, domain := range guest.Arch.Domains {
+			types[guest.Arch.Name][domain.Type] = true
+		}
+	}
+	return types, nil
+}
+
+// checkTCGCapability verifies that the hypervisor can emulate guests of
+// the arch
+func checkTCGCapability(conn *libvirt.Connect, arch string) error {
+	types, err := guestDomainTypes(conn)
+	if err != nil {
+		return err
+	}
+	if !types[arch]["qemu"] {
+		return fmt.Errorf("The hypervisor can't emulate %s guests, install qemu-system-%s", arch, arch)
+	}
+	return nil
+}
+
+// checkKVMCapability verifies that the hypervisor can run KVM guests of
+// the arch, which needs qemu-kvm installed and a host of that arch
+func checkKVMCapability(conn *libvirt.Connect, arch string) error {
+	types, err := guestDomainTypes(conn)
+	if err != nil {
+		return err
+	}
+	if types[arch]["kvm"] {
+		return nil
+	}
+	for _, archTypes := range types {
+		if archTypes["kvm"] {
+			return fmt.Errorf("The hypervisor can't run %s guests with KVM, check --kvm-arch", arch)
+		}
+	}
+	return errors.New("The hypervisor can't run KVM guests, install qemu-kvm")
+}
+
+// checkIOURing verifies that libvirt and qemu are recent enough for the
+// io_uring disk I/O mode
+func (d *Driver) checkIOURing(conn *libvirt.Connect) error {
+	if !d.usesIOURing() {
+		return nil
+	}
+	libVersion, err := conn.GetLibVersion()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt version")
+	}
+	if libVersion < 6003000 {
+		return fmt.Errorf("The io_uring disk I/O mode needs libvirt 6.3 or later, the hypervisor runs %s", formatVersion(libVersion))
+	}
+	qemuVersion, err := conn.GetVersion()
+	if err != nil {
+		return errors.Wrap(err, "getting qemu version")
+	}
+	if qemuVersion < 5000000 {
+		return fmt.Errorf("The io_uring disk I/O mode needs qemu 5.0 or later, the hypervisor runs %s", formatVersion(qemuVersion))
+	}
+	return nil
+}
+
+// formatVersion formats a libvirt encoded version as major.minor.release
+func formatVersion(v uint32) string {
+	return fmt.Sprintf("%d.%d.%d", v/1000000, v/1000%1000, v%1000)
+}
+
+// checkEmulator verifies that the emulator is an executable file
+func checkEmulator(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrap(err, "checking emulator")
+	}
+	if !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("Emulator %s is not an executable file", path)
+	}
+	return nil
+}
+
+func (d *Driver) checkDefaultNetworkExists(conn *libvirt.Connect) error {
+	if !d.ExistingDefaultNetwork || d.SingleNetwork || d.UserNetworking || d.NetworkMode == "direct" {
+		return nil
+	}
+	network, err := conn.LookupNetworkByName("default")
+	if err != nil {
+		return errors.New("--kvm-existing-default-network is set but there is no default network, define it with virsh net-define or drop the flag")
+	}
+	network.Free()
+	return nil
+}
@@ -0,0 +1,71 @@
+package kvm
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// rbdPoolTmpl is the storage pool owned by the machine when its disks live
+// on a Ceph cluster
+const rbdPoolTmpl = `
+<pool type='rbd'>
+  <name>{{storagePool .}}</name>
+  <source>
+    <name>{{.RBDPool}}</name>
+    {{range .RBDMonitors}}{{with rbdMonitor .}}<host name='{{.Host}}'{{if .Port}} port='{{.Port}}'{{end}}/>{{end}}
+    {{end}}
+    {{if .RBDUser}}
+    <auth type='ceph' username='{{.RBDUser}}'>
+      <secret uuid='{{.RBDSecretUUID}}'/>
+    </auth>
+    {{end}}
+  </source>
+</pool>
+`
+
+// rbdSourceTmpl is the auth and source of a disk backed by an RBD image
+const rbdSourceTmpl = `
+      {{if .RBDUser}}
+      <auth username='{{.RBDUser}}'>
+        <secret type='ceph' uuid='{{.RBDSecretUUID}}'/>
+      </auth>
+      {{end}}
+      <source protocol='rbd' name='{{.RBDPool}}/{{.Image}}'>
+        {{range .RBDMonitors}}{{with rbdMonitor .}}<host name='{{.Host}}'{{if .Port}} port='{{.Port}}'{{end}}/>{{end}}
+        {{end}}
+      </source>`
+
+type rbdHost struct {
+	Host string
+	Port string
+}
+
+// rbdMonitor parses a Ceph monitor given as HOST[:PORT]
+func rbdMonitor(monitor string) (*rbdHost, error) {
+	if !strings.Contains(monitor, ":") {
+		return &rbdHost{Host: monitor}, nil
+	}
+	host, port, err := net.SplitHostPort(monitor)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing Ceph monitor %s", monitor)
+	}
+	return &rbdHost{Host: host, Port: port}, nil
+}
+
+// rbdSource renders the domain disk source of the RBD image
+func (d *Driver) rbdSource(image string) (string, error) {
+	tmpl := template.Must(template.New("rbd").Funcs(template.FuncMap{"rbdMonitor": rbdMonitor}).Parse(rbdSourceTmpl))
+	var sourceXML bytes.Buffer
+	data := struct {
+		*Driver
+		Image string
+	}{d, image}
+	if err := tmpl.Execute(&sourceXML, data); err != nil {
+		return "", errors.Wrap(err, "executing rbd source template")
+	}
+	return sourceXML.String(), nil
+}
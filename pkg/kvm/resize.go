@@ -0,0 +1,85 @@
+package kvm
+
+import (
+	"fmt"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+// diskTarget is the guest device of the machine disk, as in domainTmpl
+func (d *Driver) diskTarget() string {
+	if d.DiskController == "virtio-scsi" {
+		return "sda"
+	}
+	return "hda"
+}
+
+// ResizeDisk grows the machine disk to sizeMB. An active machine is resized
+// online, which needs a disk on virtio-scsi for the guest to notice; a
+// stopped machine has its volume resized directly, and a saved one is
+// refused. The guest filesystem is not grown.
+func (d *Driver) ResizeDisk(sizeMB int64) error {
+	if sizeMB <= d.DiskSize {
+		return fmt.Errorf("The disk can only grow, it is already %d MB", d.DiskSize)
+	}
+	if d.DiskDevice != "" {
+		return errors.New("The disk is an existing block device, resize it on the host instead")
+	}
+	capacity := uint64(sizeMB) << 20
+
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return errors.Wrap(err, "getting domain")
+	}
+	defer closeDomain(dom, conn)
+	// qemu holds the image of any active domain, paused or crashed ones too
+	active, err := dom.IsActive()
+	if err != nil {
+		return errors.Wrap(err, "checking if domain is active")
+	}
+
+	if active {
+		if d.DiskController != "virtio-scsi" {
+			return errors.New("IDE disks cannot be resized online, stop the machine first")
+		}
+		log.Infof("Resizing %s of the running machine to %d MB...", d.diskTarget(), sizeMB)
+		if err := dom.BlockResize(d.diskTarget(), capacity, libvirt.DOMAIN_BLOCK_RESIZE_BYTES); err != nil {
+			return errors.Wrap(err, "resizing block device")
+		}
+	} else {
+		s, err := d.GetState()
+		if err != nil {
+			return errors.Wrap(err, "getting domain state")
+		}
+		if s == state.Saved {
+			return errors.New("The saved state of the machine expects the current disk size, start it or discard the state first")
+		}
+
+		pool, err := d.lookupStoragePool(conn)
+		if err != nil {
+			return err
+		}
+		defer pool.Free()
+		vol, err := pool.LookupStorageVolByName(d.diskVolumeName())
+		if err != nil {
+			return errors.Wrapf(err, "looking up volume %s", d.diskVolumeName())
+		}
+		defer vol.Free()
+
+		log.Infof("Resizing volume %s to %d MB...", d.diskVolumeName(), sizeMB)
+		if err := vol.Resize(capacity, 0); err != nil {
+			return errors.Wrap(err, "resizing volume")
+		}
+	}
+
+	d.DiskSize = sizeMB
+	if err := d.refreshDomainMetadata(); err != nil {
+		log.Warnf("Unable to record the disk size in the domain metadata: %v", err)
+	}
+	log.Info("Grow the filesystem inside the machine to use the new space")
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package kvm
+
+import (
+	"os"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+// stoppedMarker, in the machine directory, records that the machine was
+// stopped on purpose, so a crash it still shows is not restarted
+const stoppedMarker = "kvm-stopped"
+
+// lockMachine serializes the restarts of supervise with the commands
+// stopping or removing the machine, which run in other processes
+func (d *Driver) lockMachine() (func(), error) {
+	unlock, err := lockFile(d.ResolveStorePath("kvm-machine.lock"))
+	if err != nil {
+		return nil, errors.Wrap(err, "locking machine")
+	}
+	return unlock, nil
+}
+
+// markStopped records whether the machine was stopped on purpose. Only
+// machines with AutoRestart need to know.
+func (d *Driver) markStopped(stopped bool) {
+	if !d.AutoRestart {
+		return
+	}
+	path := d.ResolveStorePath(stoppedMarker)
+	if !stopped {
+		os.Remove(path)
+		return
+	}
+	if f, err := os.Create(path); err != nil {
+		log.Warnf("Unable to record that machine %s was stopped: %v", d.MachineName, err)
+	} else {
+		f.Close()
+	}
+}
+
+// RestartCrashed starts the machine again, through Start, if it crashed
+// and wasn't stopped or removed since. Other Error states, such as a guest
+// the watchdog paused, are left alone. It reports whether it restarted the
+// machine.
+func (d *Driver) RestartCrashed() (bool, error) {
+	if _, err := os.Stat(d.ResolveStorePath(".")); os.IsNotExist(err) {
+		return false, nil
+	}
+	unlock, err := d.lockMachine()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	// Checked under the lock: stop and rm hold it while they run
+	if _, err := os.Stat(d.ResolveStorePath(stoppedMarker)); err == nil {
+		return false, nil
+	}
+	if _, err := os.Stat(d.ResolveStorePath("config.json")); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	s, err := d.GetState()
+	if err != nil || s != state.Error {
+		return false, err
+	}
+	details, err := d.StatusDetails()
+	if err != nil {
+		return false, err
+	}
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return false, errors.Wrap(err, "getting connection")
+	}
+	defer closeDomain(dom, conn)
+	libvirtState, reason, err := dom.GetState()
+	if err != nil {
+		return false, errors.Wrap(err, "getting domain state")
+	}
+	crashed := libvirtState == libvirt.DOMAIN_CRASHED ||
+		(libvirtState == libvirt.DOMAIN_SHUTOFF && libvirt.DomainShutoffReason(reason) == libvirt.DOMAIN_SHUTOFF_CRASHED) ||
+		(libvirtState == libvirt.DOMAIN_PAUSED && libvirt.DomainPausedReason(reason) == libvirt.DOMAIN_PAUSED_CRASHED)
+	if !crashed {
+		return false, nil
+	}
+
+	log.Warnf("Machine %s crashed, restarting it: %s", d.MachineName, details)
+	if libvirtState != libvirt.DOMAIN_SHUTOFF {
+		if err := libvirtCall("destroy domain "+d.MachineName, dom.Destroy); err != nil {
+			return false, errors.Wrap(err, "destroying crashed vm")
+		}
+	}
+	if err := d.Start(); err != nil {
+		return true, errors.Wrap(err, "restarting crashed vm")
+	}
+	return true, nil
+}
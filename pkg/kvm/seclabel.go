@@ -0,0 +1,56 @@
+package kvm
+
+import (
+	"io/ioutil"
+	"strings"
+	"syscall"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Filesystems on which libvirt can't set security labels
+var unlabeledFilesystems = map[int64]string{
+	0x6969:     "NFS",
+	0x65735546: "FUSE",
+	0xff534d42: "CIFS",
+	0xfe534d42: "SMB2",
+	0x786f4256: "vboxsf",
+	0x01021997: "9p",
+}
+
+// securityDriver returns the host security driver libvirt labels images
+// for, or an empty string when none is enforcing
+func securityDriver() string {
+	if enforce, err := ioutil.ReadFile("/sys/fs/selinux/enforce"); err == nil && strings.TrimSpace(string(enforce)) == "1" {
+		return "selinux"
+	}
+	if enabled, err := ioutil.ReadFile("/sys/module/apparmor/parameters/enabled"); err == nil && strings.TrimSpace(string(enabled)) == "Y" {
+		return "apparmor"
+	}
+	return ""
+}
+
+// checkStoreLabels warns when the machine store is somewhere libvirt can't
+// label for the security driver, which fails with permission denied once
+// qemu opens the disk. It never fails, as the host policy may allow it.
+func (d *Driver) checkStoreLabels() error {
+	if d.SecLabel == "none" {
+		return nil
+	}
+	driver := securityDriver()
+	if driver == "" {
+		return nil
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(d.StorePath, &fs); err == nil {
+		if name, ok := unlabeledFilesystems[int64(fs.Type)]; ok {
+			log.Warnf("The machine store %s is on %s, where libvirt can't set %s labels; move it to a local filesystem or use --kvm-seclabel=none", d.StorePath, name, driver)
+			return nil
+		}
+	}
+	if driver == "selinux" && strings.HasPrefix(d.StorePath, "/home/") {
+		log.Warnf("The machine store %s is in a home directory, which svirt may not be allowed to relabel; if qemu gets permission denied, use --kvm-seclabel=none or a store outside /home", d.StorePath)
+	}
+	return nil
+}
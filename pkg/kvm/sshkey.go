@@ -0,0 +1,77 @@
+package kvm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/ssh"
+	"github.com/pkg/errors"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// authorizedKeys returns the public keys the machine accepts for SSH:
+// those of the ssh-agent, of the imported key pair or of a key generated
+// at GetSSHKeyPath
+func (d *Driver) authorizedKeys() ([]byte, error) {
+	if d.SSHAgent {
+		out, err := exec.Command("ssh-add", "-L").CombinedOutput()
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing ssh-agent keys: %s", strings.TrimSpace(string(out)))
+		}
+		return out, nil
+	}
+
+	if d.SSHKeySource != "" {
+		if err := d.importSSHKey(); err != nil {
+			return nil, err
+		}
+	} else if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
+		return nil, errors.Wrap(err, "generating ssh key")
+	}
+	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return nil, errors.Wrap(err, "reading ssh public key")
+	}
+	return pubKey, nil
+}
+
+// importSSHKey copies the SSHKeySource key pair to GetSSHKeyPath, checking
+// that the private key parses and matches its public key. A missing .pub
+// is derived from the private key.
+func (d *Driver) importSSHKey() error {
+	privKey, err := ioutil.ReadFile(d.SSHKeySource)
+	if err != nil {
+		return errors.Wrap(err, "reading ssh private key")
+	}
+	signer, err := cryptossh.ParsePrivateKey(privKey)
+	if err != nil {
+		return errors.Wrapf(err, "parsing ssh private key %s, use --kvm-ssh-agent for passphrase protected keys", d.SSHKeySource)
+	}
+
+	pubKey := cryptossh.MarshalAuthorizedKey(signer.PublicKey())
+	if data, err := ioutil.ReadFile(d.SSHKeySource + ".pub"); err == nil {
+		key, _, _, _, err := cryptossh.ParseAuthorizedKey(data)
+		if err != nil {
+			return errors.Wrapf(err, "parsing ssh public key %s.pub", d.SSHKeySource)
+		}
+		if !bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+			return errors.Errorf("%s.pub is not the public key of %s", d.SSHKeySource, d.SSHKeySource)
+		}
+		pubKey = data
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "reading ssh public key")
+	}
+
+	log.Infof("Using SSH key %s...", d.SSHKeySource)
+	if err := ioutil.WriteFile(d.GetSSHKeyPath(), privKey, 0600); err != nil {
+		return errors.Wrap(err, "copying ssh private key")
+	}
+	if err := ioutil.WriteFile(d.publicSSHKeyPath(), pubKey, 0644); err != nil {
+		return errors.Wrap(err, "copying ssh public key")
+	}
+	return nil
+}
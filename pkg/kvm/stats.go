@@ -0,0 +1,156 @@
+package kvm
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+// Stats are the resource counters of a running machine, cumulative since
+// it started
+type Stats struct {
+	// CPUTime is the CPU time consumed by the machine, guest and emulator
+	CPUTime time.Duration
+	// VCPUs is the number of online vCPUs
+	VCPUs int
+	// MemoryBalloon is the memory the balloon leaves to the guest, in KiB
+	MemoryBalloon uint64
+	// MemoryRSS is the memory the machine takes on the host, in KiB
+	MemoryRSS uint64
+	// MemoryUnused is the memory the guest leaves unused, in KiB, when the
+	// balloon driver reports it
+	MemoryUnused uint64 `json:",omitempty"`
+	Disks        []DiskStats
+	Interfaces   []InterfaceStats
+}
+
+// DiskStats are the I/O counters of a disk
+type DiskStats struct {
+	Device     string
+	ReadBytes  int64
+	ReadReqs   int64
+	WriteBytes int64
+	WriteReqs  int64
+	Errors     int64
+}
+
+// InterfaceStats are the traffic counters of a network interface, from the
+// guest point of view
+type InterfaceStats struct {
+	Device    string
+	MAC       string
+	RxBytes   int64
+	RxPackets int64
+	TxBytes   int64
+	TxPackets int64
+	Drops     int64
+	Errors    int64
+}
+
+// domainDevicesXML is the part of the domain xml naming the host side of
+// the disks and interfaces
+type domainDevicesXML struct {
+	Disks []struct {
+		Device string `xml:"device,attr"`
+		Target struct {
+			Dev string `xml:"dev,attr"`
+		} `xml:"target"`
+	} `xml:"devices>disk"`
+	Interfaces []struct {
+		MAC struct {
+			Address string `xml:"address,attr"`
+		} `xml:"mac"`
+		Target struct {
+			Dev string `xml:"dev,attr"`
+		} `xml:"target"`
+	} `xml:"devices>interface"`
+}
+
+// Stats returns the resource counters of the running machine
+func (d *Driver) Stats() (*Stats, error) {
+	s, err := d.GetState()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting state of VM")
+	}
+	if s != state.Running && s != state.Paused {
+		return nil, errors.Errorf("Machine %s is %s, it has no statistics", d.MachineName, s)
+	}
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting domain")
+	}
+	defer closeDomain(dom, conn)
+
+	stats := &Stats{}
+	info, err := dom.GetInfo()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting domain info")
+	}
+	stats.VCPUs = int(info.NrVirtCpu)
+	stats.CPUTime = time.Duration(info.CpuTime)
+
+	memStats, err := dom.MemoryStats(uint32(libvirt.DOMAIN_MEMORY_STAT_NR), 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting memory statistics")
+	}
+	for _, stat := range memStats {
+		switch libvirt.DomainMemoryStatTags(stat.Tag) {
+		case libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON:
+			stats.MemoryBalloon = stat.Val
+		case libvirt.DOMAIN_MEMORY_STAT_RSS:
+			stats.MemoryRSS = stat.Val
+		case libvirt.DOMAIN_MEMORY_STAT_UNUSED:
+			stats.MemoryUnused = stat.Val
+		}
+	}
+
+	desc, err := dom.GetXMLDesc(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting domain xml")
+	}
+	var devices domainDevicesXML
+	if err := xml.Unmarshal([]byte(desc), &devices); err != nil {
+		return nil, errors.Wrap(err, "parsing domain xml")
+	}
+	for _, disk := range devices.Disks {
+		if disk.Device != "disk" || disk.Target.Dev == "" {
+			continue
+		}
+		block, err := dom.BlockStats(disk.Target.Dev)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting statistics of disk %s", disk.Target.Dev)
+		}
+		stats.Disks = append(stats.Disks, DiskStats{
+			Device:     disk.Target.Dev,
+			ReadBytes:  block.RdBytes,
+			ReadReqs:   block.RdReq,
+			WriteBytes: block.WrBytes,
+			WriteReqs:  block.WrReq,
+			Errors:     block.Errs,
+		})
+	}
+	for _, iface := range devices.Interfaces {
+		// User networking has no host device to count on
+		if iface.Target.Dev == "" {
+			continue
+		}
+		net, err := dom.InterfaceStats(iface.Target.Dev)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting statistics of interface %s", iface.Target.Dev)
+		}
+		stats.Interfaces = append(stats.Interfaces, InterfaceStats{
+			Device:    iface.Target.Dev,
+			MAC:       iface.MAC.Address,
+			RxBytes:   net.RxBytes,
+			RxPackets: net.RxPackets,
+			TxBytes:   net.TxBytes,
+			TxPackets: net.TxPackets,
+			Drops:     net.RxDrop + net.TxDrop,
+			Errors:    net.RxErrs + net.TxErrs,
+		})
+	}
+	return stats, nil
+}
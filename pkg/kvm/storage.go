@@ -4,60 +4,18 @@ import (
 	"archive/tar"
 	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
 
-	"github.com/docker/machine/libmachine/ssh"
+	"github.com/docker/machine/libmachine/log"
 	"github.com/pkg/errors"
 )
 
-func createRawDiskImage(dest string, size int64) error {
-	f, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
-	if err != nil {
-		if os.IsExist(err) {
-			return nil
-		}
-		return errors.Wrap(err, "opening file for raw disk image")
-	}
-	f.Close()
-
-	if err := os.Truncate(dest, size<<20); err != nil {
-		return errors.Wrap(err, "writing sparse file")
-	}
-
-	return nil
-}
-
-func (d *Driver) buildDiskImage() error {
-	diskPath := d.ResolveStorePath(fmt.Sprintf("%s.img", d.MachineName))
-	err := createRawDiskImage(diskPath, d.DiskSize)
-	if err := createRawDiskImage(diskPath, d.DiskSize); err != nil {
-		return errors.Wrap(err, "creating raw disk image")
-	}
-	tarBuf, err := d.generateCertBundle()
-	if err != nil {
-		return errors.Wrap(err, "generating cert bundle")
-	}
-	f, err := os.OpenFile(d.DiskPath, os.O_WRONLY, 0644)
-	if err != nil {
-		return errors.Wrap(err, "opening raw disk image to write cert bundle")
-	}
-	defer f.Close()
-
-	f.Seek(0, os.SEEK_SET)
-	_, err = f.Write(tarBuf.Bytes())
-	if err != nil {
-		return errors.Wrap(err, "wrting cert bundle to disk image")
-	}
-
-	return nil
-}
-
 func (d *Driver) generateCertBundle() (*bytes.Buffer, error) {
 	magicString := "boot2docker, please format-me"
 
-	if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
-		return nil, errors.Wrap(err, "generating ssh key")
+	pubKey, err := d.authorizedKeys()
+	if err != nil {
+		return nil, err
 	}
 	buf := new(bytes.Buffer)
 	tw := tar.NewWriter(buf)
@@ -74,10 +32,6 @@ func (d *Driver) generateCertBundle() (*bytes.Buffer, error) {
 	if err := tw.WriteHeader(file); err != nil {
 		return nil, errors.Wrap(err, "writing .ssh header to tar")
 	}
-	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
-	if err != nil {
-		return nil, errors.Wrap(err, "reading ssh pub key for tar")
-	}
 	file = &tar.Header{Name: ".ssh/authorized_keys", Size: int64(len(pubKey)), Mode: 0644}
 	if err := tw.WriteHeader(file); err != nil {
 		return nil, errors.Wrap(err, "writing header for authorized_keys to tar")
@@ -96,3 +50,36 @@ func (d *Driver) generateCertBundle() (*bytes.Buffer, error) {
 func (d *Driver) publicSSHKeyPath() string {
 	return d.GetSSHKeyPath() + ".pub"
 }
+
+// checkDiskDevice verifies that the disk device is an existing block device
+func (d *Driver) checkDiskDevice() error {
+	info, err := os.Stat(d.DiskDevice)
+	if err != nil {
+		return errors.Wrap(err, "checking disk device")
+	}
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("%s is not a block device", d.DiskDevice)
+	}
+	return nil
+}
+
+// writeCertBundleToDevice writes the cert bundle at the start of the disk
+// device, where boot2docker looks for it before formatting the disk
+func (d *Driver) writeCertBundleToDevice() error {
+	tarBuf, err := d.generateCertBundle()
+	if err != nil {
+		return errors.Wrap(err, "generating cert bundle")
+	}
+
+	log.Infof("Writing cert bundle to %s...", d.DiskDevice)
+	f, err := os.OpenFile(d.DiskDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, "opening disk device")
+	}
+	defer f.Close()
+	if _, err := f.Write(tarBuf.Bytes()); err != nil {
+		return errors.Wrap(err, "writing cert bundle to disk device")
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,45 @@
+package kvm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// libvirtCallError is a failed libvirt call, reading as the libvirt message
+// instead of the raw error codes, which are logged at debug level
+type libvirtCallError struct {
+	op  string
+	err libvirt.Error
+}
+
+func (e *libvirtCallError) Error() string {
+	return fmt.Sprintf("%s: %s", e.op, e.err.Message)
+}
+
+// Cause returns the libvirt error, for errors.Cause
+func (e *libvirtCallError) Cause() error {
+	return e.err
+}
+
+// libvirtCall runs call, logging the operation, its duration and, when it
+// fails, the libvirt error code and domain at debug level
+func libvirtCall(op string, call func() error) error {
+	start := time.Now()
+	err := call()
+	elapsed := time.Since(start)
+	if err == nil {
+		log.Debugf("libvirt: %s (%s)", op, elapsed)
+		return nil
+	}
+
+	virErr, ok := err.(libvirt.Error)
+	if !ok {
+		log.Debugf("libvirt: %s failed (%s): %v", op, elapsed, err)
+		return err
+	}
+	log.Debugf("libvirt: %s failed (%s): code=%d domain=%d level=%d: %s", op, elapsed, virErr.Code, virErr.Domain, virErr.Level, virErr.Message)
+	return &libvirtCallError{op: op, err: virErr}
+}
@@ -0,0 +1,87 @@
+package kvm
+
+import (
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/pkg/errors"
+)
+
+// Upgrade swaps in a fresh download of the ISO, or of isoURL when given, and
+// restarts the machine on it. The data disk is kept.
+func (d *Driver) Upgrade(isoURL string) error {
+	if d.CloudInit {
+		return errors.New("The machine boots a cloud image, there is no ISO to upgrade")
+	}
+	if isoURL != "" {
+		d.IsoURL = isoURL
+	}
+
+	s, err := d.GetState()
+	if err != nil {
+		return errors.Wrap(err, "getting state of VM")
+	}
+	switch s {
+	case state.Stopped:
+	case state.Saved:
+		// The saved memory belongs to the old ISO
+		if err := d.Kill(); err != nil {
+			return errors.Wrap(err, "discarding saved state")
+		}
+	default:
+		// Paused and crashed domains are still active, and would keep the
+		// old ISO until their next cold boot
+		d.IPAddress = ""
+		d.removePortForwards()
+		if err := d.shutdown(s); err != nil {
+			return errors.Wrap(err, "stopping VM")
+		}
+	}
+	if err := d.checkLocalISO(); err != nil {
+		return err
+	}
+
+	log.Infof("Downloading %s...", d.IsoURL)
+	if err := d.copyISOToMachineDir(true); err != nil {
+		return errors.Wrap(err, "copying ISO to machine dir")
+	}
+	d.chownForQEMU(d.ResolveStorePath("boot2docker.iso"))
+
+	if d.isoInPool() {
+		if err := d.replaceISOVolume(); err != nil {
+			return err
+		}
+	}
+
+	// Redefine the domain so the cdrom points at the new ISO
+	dom, err := d.createDomain()
+	if err != nil {
+		return errors.Wrap(err, "redefining domain")
+	}
+	dom.Free()
+
+	return d.Start()
+}
+
+// replaceISOVolume uploads the new ISO in place of the ISO volume
+func (d *Driver) replaceISOVolume() error {
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+
+	pool, err := d.lookupStoragePool(conn)
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+	if vol, err := pool.LookupStorageVolByName(d.isoVolumeName()); err == nil {
+		err := vol.Delete(0)
+		vol.Free()
+		if err != nil {
+			return errors.Wrap(err, "deleting old ISO volume")
+		}
+	}
+
+	return d.uploadISO(conn)
+}
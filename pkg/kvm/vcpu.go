@@ -0,0 +1,73 @@
+package kvm
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+var cpuFeatureRegexp = regexp.MustCompile(`^([+-])([a-z0-9_.-]+)$`)
+
+// domainCPUFeature is a CPU feature required or disabled on top of the
+// CPU model
+type domainCPUFeature struct {
+	Policy string
+	Name   string
+}
+
+// cpuFeature parses a +FLAG or -FLAG CPU feature toggle
+func cpuFeature(spec string) (*domainCPUFeature, error) {
+	m := cpuFeatureRegexp.FindStringSubmatch(spec)
+	if m == nil {
+		return nil, fmt.Errorf("Malformed CPU feature %q, expected +FLAG or -FLAG", spec)
+	}
+	if m[1] == "+" {
+		return &domainCPUFeature{Policy: "require", Name: m[2]}, nil
+	}
+	return &domainCPUFeature{Policy: "disable", Name: m[2]}, nil
+}
+
+// maxCPUs is the number of vCPU slots of the domain
+func (d *Driver) maxCPUs() int {
+	if d.MaxCPU > d.CPU {
+		return d.MaxCPU
+	}
+	return d.CPU
+}
+
+// SetCPUCount changes the number of vCPUs, hotplugging them into a running
+// machine. Growing beyond the current count needs --kvm-max-cpus slots.
+func (d *Driver) SetCPUCount(cpus int) error {
+	if cpus < 1 || cpus > d.maxCPUs() {
+		return fmt.Errorf("Invalid vCPU count %d, the machine has %d vCPU slots", cpus, d.maxCPUs())
+	}
+
+	s, err := d.GetState()
+	if err != nil {
+		return errors.Wrap(err, "getting domain state")
+	}
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return errors.Wrap(err, "getting domain")
+	}
+	defer closeDomain(dom, conn)
+
+	flags := libvirt.DOMAIN_VCPU_CONFIG
+	if s == state.Running {
+		flags |= libvirt.DOMAIN_VCPU_LIVE
+	}
+	log.Infof("Setting the vCPU count to %d...", cpus)
+	if err := dom.SetVcpusFlags(uint(cpus), flags); err != nil {
+		return errors.Wrap(err, "setting vCPU count")
+	}
+
+	d.CPU = cpus
+	if err := d.refreshDomainMetadata(); err != nil {
+		log.Warnf("Unable to record the vCPU count in the domain metadata: %v", err)
+	}
+	return nil
+}
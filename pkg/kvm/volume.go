@@ -0,0 +1,505 @@
+package kvm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/template"
+
+	"github.com/docker/machine/libmachine/log"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+const storagePoolTmpl = `
+<pool type='dir'>
+  <name>{{.PoolName}}</name>
+  <target>
+    <path>{{.Path}}</path>
+  </target>
+</pool>
+`
+
+const diskSecretTmpl = `
+<secret ephemeral='no' private='yes'>
+  <description>LUKS passphrase of {{diskVolume .}}</description>
+</secret>
+`
+
+const volumeTmpl = `
+<volume>
+  <name>{{.Name}}</name>
+  <capacity unit='bytes'>{{.Capacity}}</capacity>
+  <allocation unit='bytes'>{{.Allocation}}</allocation>
+  <target>
+    <format type='{{.Format}}'/>
+    {{with .Owner}}
+    <permissions>
+      <owner>{{.UID}}</owner>
+      <group>{{.GID}}</group>
+      <mode>0660</mode>
+    </permissions>
+    {{end}}
+    {{if .SecretUUID}}
+    <encryption format='luks'>
+      <secret type='passphrase' uuid='{{.SecretUUID}}'/>
+    </encryption>
+    {{end}}
+  </target>
+  {{if .BackingPath}}
+  <backingStore>
+    <path>{{.BackingPath}}</path>
+    <format type='{{or .BackingFormat "qcow2"}}'/>
+  </backingStore>
+  {{end}}
+</volume>
+`
+
+type storagePoolConfig struct {
+	PoolName string
+	Path     string
+}
+
+type volumeConfig struct {
+	Name        string
+	Capacity    int64
+	Allocation  int64
+	Format      string
+	BackingPath string
+	// BackingFormat defaults to qcow2
+	BackingFormat string
+	SecretUUID    string
+	// Owner is set when the volume must belong to the qemu user
+	Owner *fileOwner
+	// Preallocation is one of off, metadata, falloc or full
+	Preallocation string
+}
+
+// maxExtraDisks keeps extra disk targets within b..z
+const maxExtraDisks = 25
+
+func (d *Driver) isoVolumeName() string {
+	return fmt.Sprintf("%s.iso", d.MachineName)
+}
+
+func (d *Driver) diskVolumeName() string {
+	return fmt.Sprintf("%s.img", d.MachineName)
+}
+
+// ownsStoragePool reports whether the machine lives in its own storage pool
+// on the machine store directory, rather than in an existing pool
+func (d *Driver) ownsStoragePool() bool {
+	return d.StoragePool == ""
+}
+
+func (d *Driver) storagePoolName() string {
+	if d.ownsStoragePool() {
+		return fmt.Sprintf("%s-pool", d.MachineName)
+	}
+	return d.StoragePool
+}
+
+var storagePoolMu sync.Mutex
+
+// createdVolumesMu guards the createdVolumes of the ISO and disk phases
+var createdVolumesMu sync.Mutex
+
+// lookupStoragePool returns the pool holding the machine's volumes, defining
+// and starting the machine's own pool if needed
+func (d *Driver) lookupStoragePool(conn *libvirt.Connect) (*libvirt.StoragePool, error) {
+	// The ISO and the disks are created concurrently, only one may define
+	// the pool
+	storagePoolMu.Lock()
+	defer storagePoolMu.Unlock()
+
+	pool, err := conn.LookupStoragePoolByName(d.storagePoolName())
+	if err != nil {
+		if !d.ownsStoragePool() {
+			return nil, errors.Wrapf(err, "looking up storage pool %s", d.storagePoolName())
+		}
+
+		var poolXML bytes.Buffer
+		if d.RBDPool != "" {
+			tmpl := template.Must(template.New("pool").Funcs(templateFuncs).Parse(rbdPoolTmpl))
+			if err := tmpl.Execute(&poolXML, d); err != nil {
+				return nil, errors.Wrap(err, "executing rbd storage pool template")
+			}
+		} else {
+			tmpl := template.Must(template.New("pool").Parse(storagePoolTmpl))
+			if err := tmpl.Execute(&poolXML, storagePoolConfig{PoolName: d.storagePoolName(), Path: d.ResolveStorePath(".")}); err != nil {
+				return nil, errors.Wrap(err, "executing storage pool template")
+			}
+		}
+		log.Infof("Creating storage pool %s...", d.storagePoolName())
+		err = libvirtCall("define storage pool "+d.storagePoolName(), func() (err error) {
+			pool, err = conn.StoragePoolDefineXML(poolXML.String(), 0)
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "defining storage pool from xml: %s", poolXML.String())
+		}
+		if err := pool.SetAutostart(true); err != nil {
+			return nil, errors.Wrap(err, "setting storage pool to autostart")
+		}
+	}
+
+	active, err := pool.IsActive()
+	if err != nil || !active {
+		if err := libvirtCall("start storage pool "+d.storagePoolName(), func() error { return pool.Create(0) }); err != nil {
+			pool.Free()
+			return nil, errors.Wrap(err, "starting storage pool")
+		}
+	}
+
+	return pool, nil
+}
+
+// checkStoragePool makes sure an existing storage pool is usable and has
+// room for the disk
+func (d *Driver) checkStoragePool() error {
+	if d.ownsStoragePool() {
+		return nil
+	}
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+
+	pool, err := conn.LookupStoragePoolByName(d.StoragePool)
+	if err != nil {
+		return errors.Wrapf(err, "looking up storage pool %s", d.StoragePool)
+	}
+	defer pool.Free()
+
+	active, err := pool.IsActive()
+	if err != nil {
+		return errors.Wrap(err, "checking if the storage pool is active")
+	}
+	if !active {
+		return fmt.Errorf("Storage pool %s is not active, start it with virsh pool-start %s", d.StoragePool, d.StoragePool)
+	}
+
+	info, err := pool.GetInfo()
+	if err != nil {
+		return errors.Wrap(err, "getting storage pool info")
+	}
+	if need := uint64(d.DiskSize) << 20; info.Available < need {
+		return fmt.Errorf("Storage pool %s has %d MB available, the disk needs %d MB", d.StoragePool, info.Available>>20, d.DiskSize)
+	}
+
+	return nil
+}
+
+func (d *Driver) extraDiskVolumeName(i int) string {
+	return fmt.Sprintf("%s-data%d.img", d.MachineName, i)
+}
+
+// isDiskCache reports whether mode is a libvirt disk cache mode
+func isDiskCache(mode string) bool {
+	switch mode {
+	case "default", "none", "writethrough", "writeback", "directsync", "unsafe":
+		return true
+	}
+	return false
+}
+
+// isDiskIO reports whether mode is a supported disk I/O mode
+func isDiskIO(mode string) bool {
+	return mode == "threads" || mode == "native" || mode == "io_uring"
+}
+
+// diskCache is the cache attribute of the disks, empty for the hypervisor
+// default. Machines created before DiskCache keep a valid CacheMode.
+func (d *Driver) diskCache() string {
+	mode := d.DiskCache
+	if mode == "" && isDiskCache(d.CacheMode) {
+		mode = d.CacheMode
+	}
+	if mode == "default" {
+		return ""
+	}
+	return mode
+}
+
+// diskIO is the io attribute of the disks, defaulting for machines created
+// before it was configurable
+func (d *Driver) diskIO() string {
+	if d.DiskIO == "" {
+		return defaultDiskIO
+	}
+	return d.DiskIO
+}
+
+// extraDiskIO is the io attribute of the extra disks
+func (d *Driver) extraDiskIO() string {
+	if d.ExtraDiskIO == "" {
+		return d.diskIO()
+	}
+	return d.ExtraDiskIO
+}
+
+// usesIOURing reports whether a disk of the machine uses io_uring
+func (d *Driver) usesIOURing() bool {
+	return d.diskIO() == "io_uring" || (len(d.ExtraDisks) > 0 && d.extraDiskIO() == "io_uring")
+}
+
+// iothread is the I/O thread serving the i-th extra disk, when it is a
+// virtio disk, or 0 for none
+func (d *Driver) iothread(i int) int {
+	if d.IOThreads == 0 {
+		return 0
+	}
+	return i%d.IOThreads + 1
+}
+
+// extraDiskLetter is the drive letter of the i-th extra disk, starting at b
+// so the boot disk keeps a
+func extraDiskLetter(i int) string {
+	return string('b' + rune(i))
+}
+
+// createVolume creates a volume in the storage pool
+func (d *Driver) createVolume(conn *libvirt.Connect, config volumeConfig) (*libvirt.StorageVol, error) {
+	pool, err := d.lookupStoragePool(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Free()
+
+	// libvirt preallocates when the allocation matches the capacity; a full
+	// preallocation is then completed by the caller writing zeros
+	var flags libvirt.StorageVolCreateFlags
+	switch config.Preallocation {
+	case "metadata":
+		flags = libvirt.STORAGE_VOL_CREATE_PREALLOC_METADATA
+	case "falloc", "full":
+		config.Allocation = config.Capacity
+	}
+
+	if d.RBDPool == "" {
+		config.Owner = d.qemuOwner()
+	}
+
+	tmpl := template.Must(template.New("volume").Parse(volumeTmpl))
+	var volumeXML bytes.Buffer
+	if err := tmpl.Execute(&volumeXML, config); err != nil {
+		return nil, errors.Wrap(err, "executing volume template")
+	}
+
+	var vol *libvirt.StorageVol
+	err = libvirtCall("create volume "+config.Name, func() (err error) {
+		vol, err = pool.StorageVolCreateXML(volumeXML.String(), flags)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating volume from xml: %s", volumeXML.String())
+	}
+	d.volumeCreated(config.Name)
+
+	return vol, nil
+}
+
+// volumeCreated records a volume created for the machine, for a rollback to
+// delete
+func (d *Driver) volumeCreated(name string) {
+	createdVolumesMu.Lock()
+	defer createdVolumesMu.Unlock()
+	d.createdVolumes = append(d.createdVolumes, name)
+}
+
+// createDiskSecret defines a libvirt secret holding a random LUKS passphrase
+// for the machine disk and returns its UUID
+func (d *Driver) createDiskSecret(conn *libvirt.Connect) (string, error) {
+	tmpl := template.Must(template.New("secret").Funcs(templateFuncs).Parse(diskSecretTmpl))
+	var secretXML bytes.Buffer
+	if err := tmpl.Execute(&secretXML, d); err != nil {
+		return "", errors.Wrap(err, "executing secret template")
+	}
+	secret, err := conn.SecretDefineXML(secretXML.String(), 0)
+	if err != nil {
+		return "", errors.Wrapf(err, "defining secret from xml: %s", secretXML.String())
+	}
+	defer secret.Free()
+	if d.DiskSecretUUID, err = secret.GetUUIDString(); err != nil {
+		return "", errors.Wrap(err, "getting secret UUID")
+	}
+
+	passphrase := make([]byte, 32)
+	if _, err := rand.Read(passphrase); err != nil {
+		return "", errors.Wrap(err, "generating passphrase")
+	}
+	if err := secret.SetValue([]byte(hex.EncodeToString(passphrase)), 0); err != nil {
+		return "", errors.Wrap(err, "setting secret value")
+	}
+
+	return d.DiskSecretUUID, nil
+}
+
+// zeroReader is an endless source of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// uploadToVolume streams length bytes of r to the start of vol
+func uploadToVolume(conn *libvirt.Connect, vol *libvirt.StorageVol, r io.Reader, length int64) error {
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return errors.Wrap(err, "creating stream")
+	}
+	defer stream.Free()
+
+	if err := vol.Upload(stream, 0, uint64(length), 0); err != nil {
+		return errors.Wrap(err, "starting volume upload")
+	}
+
+	buf := make([]byte, 1<<20)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			for written := 0; written < n; {
+				sent, err := stream.Send(buf[written:n])
+				if err != nil {
+					stream.Abort()
+					return errors.Wrap(err, "sending data to volume")
+				}
+				written += sent
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stream.Abort()
+			return errors.Wrap(err, "reading data to upload")
+		}
+	}
+
+	return stream.Finish()
+}
+
+// isoInPool reports whether the ISO is uploaded to the storage pool, which
+// is the case for an existing pool or a remote hypervisor that can't read
+// the local store
+func (d *Driver) isoInPool() bool {
+	return d.isRemote() || !d.ownsStoragePool() || d.RBDPool != ""
+}
+
+// uploadISO copies the ISO from the local store to a volume of the pool
+func (d *Driver) uploadISO(conn *libvirt.Connect) error {
+	iso, err := os.Open(d.ResolveStorePath("boot2docker.iso"))
+	if err != nil {
+		return errors.Wrap(err, "opening ISO")
+	}
+	defer iso.Close()
+	info, err := iso.Stat()
+	if err != nil {
+		return errors.Wrap(err, "getting ISO size")
+	}
+
+	isoVol, err := d.createVolume(conn, volumeConfig{Name: d.isoVolumeName(), Capacity: info.Size(), Format: "raw"})
+	if err != nil {
+		return errors.Wrap(err, "creating ISO volume")
+	}
+	defer isoVol.Free()
+	log.Infof("Uploading ISO to volume %s...", d.isoVolumeName())
+	if err := uploadToVolume(conn, isoVol, iso, info.Size()); err != nil {
+		return errors.Wrap(err, "uploading ISO")
+	}
+	if d.ISO, err = isoVol.GetPath(); err != nil {
+		return errors.Wrap(err, "getting ISO volume path")
+	}
+
+	return nil
+}
+
+// buildDiskVolume creates the machine disk as a volume of the storage pool,
+// with the cert bundle written at its start
+func (d *Driver) buildDiskVolume() error {
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting libvirt connection")
+	}
+	defer conn.Close()
+
+	if d.DiskDevice != "" {
+		if err := d.writeCertBundleToDevice(); err != nil {
+			return err
+		}
+		d.DiskPath = d.DiskDevice
+	} else if err := d.createDiskVolume(conn); err != nil {
+		return err
+	}
+
+	for i, size := range d.ExtraDisks {
+		vol, err := d.createVolume(conn, volumeConfig{Name: d.extraDiskVolumeName(i), Capacity: int64(size) << 20, Format: "raw"})
+		if err != nil {
+			return errors.Wrapf(err, "creating extra disk %s", d.extraDiskVolumeName(i))
+		}
+		vol.Free()
+	}
+
+	return nil
+}
+
+// createDiskVolume creates the machine disk volume and injects the cert bundle
+func (d *Driver) createDiskVolume(conn *libvirt.Connect) error {
+	var err error
+	config := volumeConfig{
+		Name:          d.diskVolumeName(),
+		Capacity:      d.DiskSize << 20,
+		Format:        d.diskFormat(),
+		Preallocation: d.DiskPreallocation,
+	}
+	if d.BaseImageURL != "" {
+		if config.BackingPath, err = d.cachedBaseImage(); err != nil {
+			return errors.Wrap(err, "getting base image")
+		}
+	}
+	if d.DiskEncrypt {
+		if config.SecretUUID, err = d.createDiskSecret(conn); err != nil {
+			return errors.Wrap(err, "creating disk encryption secret")
+		}
+	}
+	diskVol, err := d.createVolume(conn, config)
+	if err != nil {
+		return errors.Wrap(err, "creating disk volume")
+	}
+	defer diskVol.Free()
+
+	switch {
+	case d.BaseImageURL != "":
+		// The cert bundle is raw data at the start of the disk, which would
+		// corrupt the qcow2 overlay. Encrypted disks are overlays too, cloud
+		// images being required for them.
+		log.Infof("Created %s as a linked clone of %s", d.diskVolumeName(), config.BackingPath)
+	default:
+		if d.DiskPreallocation == "full" {
+			log.Infof("Writing zeros to %s, this may take a while...", d.diskVolumeName())
+			if err := uploadToVolume(conn, diskVol, io.LimitReader(zeroReader{}, config.Capacity), config.Capacity); err != nil {
+				return errors.Wrap(err, "preallocating disk volume")
+			}
+		}
+		tarBuf, err := d.generateCertBundle()
+		if err != nil {
+			return errors.Wrap(err, "generating cert bundle")
+		}
+		if err := uploadToVolume(conn, diskVol, tarBuf, int64(tarBuf.Len())); err != nil {
+			return errors.Wrap(err, "writing cert bundle to disk volume")
+		}
+	}
+	if d.DiskPath, err = diskVol.GetPath(); err != nil {
+		return errors.Wrap(err, "getting disk volume path")
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package kvm
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// waitForIP polls for the machine's address until timeout elapses. Past
+// half of the timeout, the console log is followed into the debug output,
+// for the boot messages explaining a machine that never gets a lease.
+func (d *Driver) waitForIP(timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	followAt := time.Now().Add(timeout / 2)
+	var console *consoleFollower
+	for attempt := 1; ; attempt++ {
+		ip, err := d.GetIP()
+		if err != nil {
+			return "", err
+		}
+		if ip != "" {
+			return ip, nil
+		}
+		if time.Now().After(deadline) {
+			return "", d.waitError(fmt.Sprintf("Machine didn't return an IP after %s", timeout), nil)
+		}
+		log.Debugf("Waiting for machine to come up, attempt %d", attempt)
+		if console == nil && d.ConsoleLog != "" && time.Now().After(followAt) {
+			console = d.followConsole()
+		}
+		if console != nil {
+			console.flush()
+		}
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// consoleFollower copies the lines appended to the console log to the
+// debug output
+type consoleFollower struct {
+	path   string
+	offset int64
+}
+
+// followConsole logs the end of the console log so far, and returns a
+// follower for what comes next
+func (d *Driver) followConsole() *consoleFollower {
+	c := &consoleFollower{path: d.ConsoleLog}
+	if fi, err := os.Stat(c.path); err == nil {
+		c.offset = fi.Size()
+	}
+	log.Debugf("No IP yet, following the console log %s", c.path)
+	if tail := d.consoleLogTail(20); tail != "" {
+		for _, line := range strings.Split(tail, "\n") {
+			log.Debugf("console: %s", line)
+		}
+	}
+	return c
+}
+
+// flush logs the complete lines appended since the last call
+func (c *consoleFollower) flush() {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(c.offset, io.SeekStart); err != nil {
+		return
+	}
+	out, err := ioutil.ReadAll(f)
+	if err != nil {
+		return
+	}
+	// A partial last line waits for the next flush
+	end := strings.LastIndex(string(out), "\n")
+	if end < 0 {
+		return
+	}
+	c.offset += int64(end + 1)
+	for _, line := range strings.Split(string(out[:end]), "\n") {
+		log.Debugf("console: %s", strings.TrimRight(line, "\r"))
+	}
+}
+
+// waitForSSH retries an SSH command until it succeeds, timeout elapses or
+// the machine stops running
+func (d *Driver) waitForSSH(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := drivers.RunSSHCommandFromDriver(d, "exit 0")
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return d.waitError(fmt.Sprintf("SSH not available after %s", timeout), err)
+		}
+		if s, serr := d.GetState(); serr == nil && (s == state.Stopped || s == state.Error) {
+			return d.waitError("Machine stopped while waiting for SSH", err)
+		}
+		log.Debugf("Error getting ssh command 'exit 0' : %s", err)
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// bootID identifies the current boot of the machine
+func (d *Driver) bootID() (string, error) {
+	out, err := drivers.RunSSHCommandFromDriver(d, "cat /proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// waitForReboot waits until the machine is reachable over SSH again with a
+// boot ID other than bootID
+func (d *Driver) waitForReboot(bootID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		id, err := d.bootID()
+		if err == nil && id != bootID {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return d.waitError(fmt.Sprintf("Machine didn't reboot after %s", timeout), err)
+		}
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// waitError describes a wait that timed out with the last error seen, the
+// domain state and the end of the console log
+func (d *Driver) waitError(msg string, lastErr error) error {
+	if lastErr != nil {
+		msg = fmt.Sprintf("%s, last error: %v", msg, lastErr)
+	}
+	if s, err := d.GetState(); err == nil {
+		msg = fmt.Sprintf("%s, domain state: %s", msg, s)
+	}
+	if tail := d.consoleLogTail(20); tail != "" {
+		msg = fmt.Sprintf("%s, console output:\n%s", msg, tail)
+	}
+	return fmt.Errorf("%s", msg)
+}
@@ -0,0 +1,6 @@
+// Package version holds the driver version, set at build time with
+// -ldflags "-X <pkg>/pkg/version.VERSION=<version>"
+package version
+
+// VERSION is the driver version
+var VERSION = "unknown"